@@ -0,0 +1,86 @@
+// Copyright 2019 Cohesity Inc.
+//
+// Utility to work with developer's appspec. Build the appspec binary and run
+// one of its commands on an appspec. Eg. ./appspec render appspecpath
+//
+// The exit code is 0 if the command succeeds, 1 if the appspec is invalid or
+// has a problem found by the command, and 2 if the arguments are wrong or the
+// appspec could not be read.
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "sort"
+)
+
+const (
+  kExitSuccess int = 0
+  kExitInvalid int = 1
+  kExitError   int = 2
+)
+
+// command is a command of the appspec binary.
+type command struct {
+  // One line description of the command.
+  description string
+  // Runs the command with the arguments following its name and returns the
+  // exit code.
+  run func(args []string) int
+}
+
+var (
+  // The commands, keyed by name.
+  commands = map[string]*command{
+    "diff": &command{
+      description: "Compare two versions of an appspec object by object.",
+      run:         runDiff,
+    },
+    "env": &command{
+      description: "Print the environment the containers receive.",
+      run:         runEnv,
+    },
+    "inspect": &command{
+      description: "List and verify the files of an app bundle.",
+      run:         runInspect,
+    },
+    "package": &command{
+      description: "Validate an app and bundle it into a single archive.",
+      run:         runPackage,
+    },
+    "render": &command{
+      description: "Render an appspec into plain Kubernetes manifests.",
+      run:         runRender,
+    },
+  }
+)
+
+func usage() {
+  fmt.Fprintf(os.Stderr, "Usage: %s command [flags] args\n\nCommands:\n",
+    os.Args[0])
+  names := make([]string, 0, len(commands))
+  for name := range commands {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].description)
+  }
+  fmt.Fprintf(os.Stderr, "\nRun %s command --help for the flags of a "+
+    "command.\n", os.Args[0])
+}
+
+func main() {
+  if len(os.Args) < 2 {
+    usage()
+    os.Exit(kExitError)
+  }
+  command, ok := commands[os.Args[1]]
+  if !ok {
+    fmt.Fprintf(os.Stderr, "Unknown command %s.\n", os.Args[1])
+    usage()
+    os.Exit(kExitError)
+  }
+  os.Exit(command.run(os.Args[2:]))
+}
@@ -0,0 +1,336 @@
+// Copyright 2019 Cohesity Inc.
+//
+// Package bundle writes and reads app bundles: single gzipped tar archives
+// holding everything uploaded to the DevPortal for an app, i.e. its appspec,
+// its app.json and the docker save tarballs of its images. The archive starts
+// with manifest.json, which identifies the app and lists the size and SHA-256
+// checksum of every other file, so that a bundle can be verified before it is
+// uploaded.
+//
+// The archive is reproducible: building a bundle twice from the same files
+// gives the same bytes.
+
+package bundle
+
+import (
+  "archive/tar"
+  "bytes"
+  "compress/gzip"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "path"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/app_metadata"
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
+)
+
+const (
+  // Version of the layout of bundles, bumped on incompatible changes.
+  FormatVersion int = 1
+
+  kManifestFile    string = "manifest.json"
+  kAppMetadataFile string = "app.json"
+  kImagesDir       string = "images"
+  kFileMode        int64  = 0644
+
+  // Types of the files of a bundle.
+  FileTypeAppSpec     string = "appspec"
+  FileTypeAppMetadata string = "app_metadata"
+  FileTypeImage       string = "image"
+)
+
+var (
+  // Runs of characters which are not allowed in the file name of a bundle.
+  fileNameRegexp = regexp.MustCompile(`[^a-z0-9.]+`)
+)
+
+// App identifies the app of a bundle, as given by its app.json.
+type App struct {
+  Id         *int   `json:"id,omitempty"`
+  Name       string `json:"name"`
+  Version    *int   `json:"version,omitempty"`
+  DevVersion string `json:"dev_version,omitempty"`
+}
+
+// File is a file of a bundle.
+type File struct {
+  // Path of the file in the archive.
+  Path   string `json:"path"`
+  Type   string `json:"type"`
+  Size   int64  `json:"size"`
+  Sha256 string `json:"sha256"`
+  // For an image tarball, the images it holds.
+  Images []string `json:"images,omitempty"`
+}
+
+// Manifest is the content of the manifest.json of a bundle.
+type Manifest struct {
+  FormatVersion int     `json:"format_version"`
+  App           App     `json:"app"`
+  Files         []*File `json:"files"`
+}
+
+// Contents are the files to bundle for an app. They are expected to have been
+// validated together.
+type Contents struct {
+  // Paths of the appspec and of the app.json.
+  AppSpec     string
+  AppMetadata string
+  Metadata    *appmetadata.AppMetadata
+  // The images of the app. A tarball holding several images is bundled once.
+  Images []*appspecvalidator.ShippedImage
+}
+
+// Returns the app identified by metadata.
+func appOf(metadata *appmetadata.AppMetadata) App {
+  app := App{Id: metadata.Id, Version: metadata.Version}
+  if metadata.Name != nil {
+    app.Name = *metadata.Name
+  }
+  if metadata.DevVersion != nil {
+    app.DevVersion = *metadata.DevVersion
+  }
+  return app
+}
+
+// FileName returns the file name of the bundle of an app, made of its name
+// and version, e.g. view-browser-1.0.tar.gz for the version 1.0 of
+// View-browser. The developer version is used if it is set.
+func FileName(metadata *appmetadata.AppMetadata) string {
+  app := appOf(metadata)
+  version := app.DevVersion
+  if version == "" && app.Version != nil {
+    version = strconv.Itoa(*app.Version)
+  }
+  name := strings.Trim(fileNameRegexp.ReplaceAllString(
+    strings.ToLower(app.Name), "-"), "-.")
+  if name == "" {
+    name = "app"
+  }
+  if version != "" {
+    name += "-" + version
+  }
+  return name + ".tar.gz"
+}
+
+// Returns the size and SHA-256 checksum of the file at filePath.
+func checksum(filePath string) (int64, string, error) {
+  file, err := os.Open(filePath)
+  if err != nil {
+    return 0, "", err
+  }
+  defer file.Close()
+  hash := sha256.New()
+  size, err := io.Copy(hash, file)
+  if err != nil {
+    return 0, "", err
+  }
+  return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Writes a file of the archive with a fixed mode and time, so that the
+// archive only depends on the content of its files.
+func writeEntry(archive *tar.Writer, name string, size int64,
+  content io.Reader) error {
+  header := &tar.Header{
+    Name:     name,
+    Mode:     kFileMode,
+    Size:     size,
+    ModTime:  time.Unix(0, 0),
+    Typeflag: tar.TypeReg,
+  }
+  if err := archive.WriteHeader(header); err != nil {
+    return err
+  }
+  _, err := io.Copy(archive, content)
+  return err
+}
+
+// Write writes the bundle of contents to writer and returns its manifest.
+func Write(writer io.Writer, contents *Contents) (*Manifest, error) {
+  manifest := &Manifest{
+    FormatVersion: FormatVersion,
+    App:           appOf(contents.Metadata),
+  }
+  // Maps the paths of the archive to the files they are read from.
+  sources := make(map[string]string)
+  addFile := func(archivePath string, source string,
+    fileType string) (*File, error) {
+    if other, ok := sources[archivePath]; ok {
+      return nil, fmt.Errorf("%s and %s would both be bundled as %s.",
+        other, source, archivePath)
+    }
+    size, sum, err := checksum(source)
+    if err != nil {
+      return nil, err
+    }
+    sources[archivePath] = source
+    file := &File{Path: archivePath, Type: fileType, Size: size, Sha256: sum}
+    manifest.Files = append(manifest.Files, file)
+    return file, nil
+  }
+
+  if _, err := addFile(filepath.Base(contents.AppSpec), contents.AppSpec,
+    FileTypeAppSpec); err != nil {
+    return nil, err
+  }
+  if _, err := addFile(kAppMetadataFile, contents.AppMetadata,
+    FileTypeAppMetadata); err != nil {
+    return nil, err
+  }
+  tarballs := make(map[string]*File)
+  for _, image := range contents.Images {
+    file, ok := tarballs[image.File]
+    if !ok {
+      var err error
+      file, err = addFile(path.Join(kImagesDir, filepath.Base(image.File)),
+        image.File, FileTypeImage)
+      if err != nil {
+        return nil, err
+      }
+      tarballs[image.File] = file
+    }
+    file.Images = append(file.Images, image.Ref)
+  }
+
+  gzipWriter := gzip.NewWriter(writer)
+  archive := tar.NewWriter(gzipWriter)
+  manifestData, err := json.MarshalIndent(manifest, "", "  ")
+  if err != nil {
+    return nil, err
+  }
+  manifestData = append(manifestData, '\n')
+  err = writeEntry(archive, kManifestFile, int64(len(manifestData)),
+    bytes.NewReader(manifestData))
+  if err != nil {
+    return nil, err
+  }
+  for _, file := range manifest.Files {
+    source, err := os.Open(sources[file.Path])
+    if err != nil {
+      return nil, err
+    }
+    err = writeEntry(archive, file.Path, file.Size, source)
+    source.Close()
+    if err != nil {
+      return nil, err
+    }
+  }
+  if err := archive.Close(); err != nil {
+    return nil, err
+  }
+  return manifest, gzipWriter.Close()
+}
+
+// Bundle is a bundle read back, with the problems found verifying it.
+type Bundle struct {
+  Manifest *Manifest
+  Problems []string
+}
+
+// Read reads the bundle from reader and verifies the files it holds against
+// its manifest. The error is set only if the bundle could not be read at all.
+func Read(reader io.Reader) (*Bundle, error) {
+  gzipReader, err := gzip.NewReader(reader)
+  if err != nil {
+    return nil, fmt.Errorf("Not a bundle. %v", err)
+  }
+  archive := tar.NewReader(gzipReader)
+
+  header, err := archive.Next()
+  if err != nil {
+    return nil, fmt.Errorf("Not a bundle. %v", err)
+  }
+  if header.Name != kManifestFile {
+    return nil, fmt.Errorf("Not a bundle, it does not start with %s.",
+      kManifestFile)
+  }
+  manifest := &Manifest{}
+  if err := json.NewDecoder(archive).Decode(manifest); err != nil {
+    return nil, fmt.Errorf("Invalid %s. %v", kManifestFile, err)
+  }
+  bundle := &Bundle{Manifest: manifest}
+  problem := func(format string, args ...interface{}) {
+    bundle.Problems = append(bundle.Problems, fmt.Sprintf(format, args...))
+  }
+  if manifest.FormatVersion != FormatVersion {
+    problem("Unsupported format version %d, expected %d.",
+      manifest.FormatVersion, FormatVersion)
+  }
+
+  files := make(map[string]*File)
+  for _, file := range manifest.Files {
+    files[file.Path] = file
+  }
+  found := make(map[string]bool)
+  for {
+    header, err := archive.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil, err
+    }
+    file, ok := files[header.Name]
+    if !ok {
+      problem("%s is not listed in the manifest.", header.Name)
+      continue
+    }
+    if found[header.Name] {
+      problem("%s is in the bundle more than once.", header.Name)
+      continue
+    }
+    found[header.Name] = true
+    hash := sha256.New()
+    size, err := io.Copy(hash, archive)
+    if err != nil {
+      return nil, err
+    }
+    if size != file.Size {
+      problem("%s has %d bytes, expected %d.", file.Path, size, file.Size)
+    } else if sum := hex.EncodeToString(hash.Sum(nil)); sum != file.Sha256 {
+      problem("%s has the checksum %s, expected %s.", file.Path, sum,
+        file.Sha256)
+    }
+  }
+
+  var missing []string
+  fileTypes := make(map[string]int)
+  for _, file := range manifest.Files {
+    fileTypes[file.Type]++
+    if !found[file.Path] {
+      missing = append(missing, file.Path)
+    }
+  }
+  sort.Strings(missing)
+  for _, filePath := range missing {
+    problem("%s is listed in the manifest but missing.", filePath)
+  }
+  for _, fileType := range []string{FileTypeAppSpec, FileTypeAppMetadata} {
+    if fileTypes[fileType] != 1 {
+      problem("The bundle has %d file(s) of type %s, expected 1.",
+        fileTypes[fileType], fileType)
+    }
+  }
+  return bundle, nil
+}
+
+// ReadFile is like Read but reads the bundle from the file at filePath.
+func ReadFile(filePath string) (*Bundle, error) {
+  file, err := os.Open(filePath)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  return Read(file)
+}
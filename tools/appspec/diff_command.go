@@ -0,0 +1,47 @@
+// Copyright 2019 Cohesity Inc.
+//
+// The diff command, which compares two versions of an appspec object by object
+// and flags the changes which break upgrades. Eg.
+// ./appspec diff oldappspecpath newappspecpath
+
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspec/spec_diff"
+)
+
+func runDiff(args []string) int {
+  flags := flag.NewFlagSet("diff", flag.ExitOnError)
+  flags.Usage = func() {
+    fmt.Fprintf(flags.Output(), "Usage: %s diff oldappspecpath "+
+      "newappspecpath\n", os.Args[0])
+    flags.PrintDefaults()
+  }
+  flags.Parse(args)
+  if flags.NArg() != 2 {
+    flags.Usage()
+    return kExitError
+  }
+
+  oldDocuments, exitCode := loadAppSpec(flags.Arg(0))
+  if oldDocuments == nil {
+    return exitCode
+  }
+  newDocuments, exitCode := loadAppSpec(flags.Arg(1))
+  if newDocuments == nil {
+    return exitCode
+  }
+  changes := specdiff.Compare(oldDocuments, newDocuments)
+  for _, change := range changes {
+    fmt.Println(change)
+  }
+  if changes.HasBreaking() {
+    fmt.Fprintln(os.Stderr, "Some changes break upgrading the app.")
+    return kExitInvalid
+  }
+  return kExitSuccess
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 Cohesity Inc.
+//
+// The env command, which prints the environment each container of an appspec
+// receives from the Cohesity app platform. Eg. ./appspec env appspecpath
+
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "strconv"
+  "strings"
+  "text/tabwriter"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspec/render"
+)
+
+func runEnv(args []string) int {
+  defaults := render.DefaultOptions()
+  flags := flag.NewFlagSet("env", flag.ExitOnError)
+  addEnvFlags(flags, defaults)
+  flags.Usage = func() {
+    fmt.Fprintf(flags.Output(), "Usage: %s env [flags] appspecpath\n",
+      os.Args[0])
+    flags.PrintDefaults()
+  }
+  flags.Parse(args)
+  if flags.NArg() != 1 {
+    flags.Usage()
+    return kExitError
+  }
+
+  documents, exitCode := loadAppSpec(flags.Arg(0))
+  if documents == nil {
+    return exitCode
+  }
+  options := defaults
+  options.NodePortBase = FLAGS_nodePortBase
+  options.ApiEndpointIp = FLAGS_apiEndpointIp
+  options.ApiEndpointPort = FLAGS_apiEndpointPort
+  options.AuthToken = FLAGS_authToken
+  environments, err := render.Environments(documents, options)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return kExitError
+  }
+
+  collisions := 0
+  writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+  for i, containerEnv := range environments {
+    if i > 0 {
+      fmt.Fprintln(writer)
+    }
+    fmt.Fprintf(writer, "%s %s, container %s:\n", containerEnv.Kind,
+      containerEnv.Workload, containerEnv.Container)
+    for _, envVar := range containerEnv.Vars {
+      source := envVar.Source
+      if envVar.Platform != nil {
+        source += ", also set by the platform"
+      }
+      value := envVar.Value
+      if strings.ContainsAny(value, "\t\n") {
+        value = strconv.Quote(value)
+      }
+      fmt.Fprintf(writer, "  %s=%s\t(%s)\n", envVar.Name, value, source)
+    }
+  }
+  writer.Flush()
+
+  for _, containerEnv := range environments {
+    for _, envVar := range containerEnv.Collisions() {
+      fmt.Fprintf(os.Stderr, "%s %s, container %s: %s is declared by the "+
+        "container and also set by the platform to %s (%s).\n",
+        containerEnv.Kind, containerEnv.Workload, containerEnv.Container,
+        envVar.Name, envVar.Platform.Value, envVar.Platform.Source)
+      collisions++
+    }
+  }
+  if collisions > 0 {
+    return kExitInvalid
+  }
+  return kExitSuccess
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Cohesity Inc.
+//
+// The inspect command, which lists the files of a bundle written by the
+// package command and verifies them against its manifest. Eg.
+// ./appspec inspect bundlepath
+
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+  "text/tabwriter"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspec/bundle"
+)
+
+// Returns the app of a bundle as written by inspect, e.g.
+// View-browser (id 1, version 1, dev_version 1.0).
+func appDescription(app *bundle.App) string {
+  var details []string
+  if app.Id != nil {
+    details = append(details, fmt.Sprintf("id %d", *app.Id))
+  }
+  if app.Version != nil {
+    details = append(details, fmt.Sprintf("version %d", *app.Version))
+  }
+  if app.DevVersion != "" {
+    details = append(details, "dev_version "+app.DevVersion)
+  }
+  if len(details) == 0 {
+    return app.Name
+  }
+  return fmt.Sprintf("%s (%s)", app.Name, strings.Join(details, ", "))
+}
+
+func runInspect(args []string) int {
+  flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+  flags.Usage = func() {
+    fmt.Fprintf(flags.Output(), "Usage: %s inspect bundlepath\n", os.Args[0])
+    flags.PrintDefaults()
+  }
+  flags.Parse(args)
+  if flags.NArg() != 1 {
+    flags.Usage()
+    return kExitError
+  }
+
+  appBundle, err := bundle.ReadFile(flags.Arg(0))
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return kExitError
+  }
+  manifest := appBundle.Manifest
+  fmt.Printf("App %s, bundle format %d:\n", appDescription(&manifest.App),
+    manifest.FormatVersion)
+  writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+  fmt.Fprintln(writer, "  TYPE\tSIZE\tSHA256\tPATH")
+  for _, file := range manifest.Files {
+    path := file.Path
+    if len(file.Images) > 0 {
+      path += " (" + strings.Join(file.Images, ", ") + ")"
+    }
+    fmt.Fprintf(writer, "  %s\t%d\t%s\t%s\n", file.Type, file.Size,
+      file.Sha256, path)
+  }
+  writer.Flush()
+
+  if len(appBundle.Problems) > 0 {
+    fmt.Fprintf(os.Stderr, "Invalid bundle. %d problem(s).\n",
+      len(appBundle.Problems))
+    for _, problem := range appBundle.Problems {
+      fmt.Fprintln(os.Stderr, problem)
+    }
+    return kExitInvalid
+  }
+  fmt.Printf("Verified %d file(s).\n", len(manifest.Files))
+  return kExitSuccess
+}
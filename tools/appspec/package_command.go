@@ -0,0 +1,134 @@
+// Copyright 2019 Cohesity Inc.
+//
+// The package command, which validates an app and bundles its appspec,
+// app.json and image tarballs into a single archive to upload. Eg.
+// ./appspec package appspecpath appjsonpath imagepath...
+
+package main
+
+import (
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspec/bundle"
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/app_metadata"
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
+)
+
+var (
+  // FLAGS_output specifies the path of the bundle to write.
+  FLAGS_output string
+)
+
+// Writes the bundle of contents to the file at path. The bundle is written to
+// a temporary file first, so that a failure does not leave a partial bundle.
+func writeBundle(path string, contents *bundle.Contents) (*bundle.Manifest,
+  error) {
+  tempFile, err := ioutil.TempFile(filepath.Dir(path),
+    "."+filepath.Base(path))
+  if err != nil {
+    return nil, err
+  }
+  defer os.Remove(tempFile.Name())
+  manifest, err := bundle.Write(tempFile, contents)
+  if closeErr := tempFile.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    err = os.Chmod(tempFile.Name(), 0644)
+  }
+  if err == nil {
+    err = os.Rename(tempFile.Name(), path)
+  }
+  if err != nil {
+    return nil, err
+  }
+  return manifest, nil
+}
+
+// Returns the first of images saved in the file at path, or nil if there is
+// none.
+func imageInFile(images []*appspecvalidator.ShippedImage,
+  path string) *appspecvalidator.ShippedImage {
+  info, err := os.Stat(path)
+  if err != nil {
+    return nil
+  }
+  for _, image := range images {
+    if imageInfo, err := os.Stat(image.File); err == nil &&
+      os.SameFile(info, imageInfo) {
+      return image
+    }
+  }
+  return nil
+}
+
+func runPackage(args []string) int {
+  flags := flag.NewFlagSet("package", flag.ExitOnError)
+  flags.StringVar(&FLAGS_output, "output", "",
+    "Path of the bundle. By default, it is named after the name and version "+
+      "of the app, e.g. view-browser-1.0.tar.gz, in the current directory.")
+  flags.Usage = func() {
+    fmt.Fprintf(flags.Output(), "Usage: %s package [flags] appspecpath "+
+      "appjsonpath imagepath...\n", os.Args[0])
+    flags.PrintDefaults()
+  }
+  flags.Parse(args)
+  if flags.NArg() < 3 {
+    flags.Usage()
+    return kExitError
+  }
+  appSpecPath := flags.Arg(0)
+  appMetadataPath := flags.Arg(1)
+
+  validator := appspecvalidator.NewValidator()
+  var err error
+  validator.Images, err = appspecvalidator.LoadImages(flags.Args()[2:])
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return kExitError
+  }
+  documents, findings, err := validator.ParseAndValidateFile(appSpecPath)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return kExitError
+  }
+  metadata, metadataFindings, err := appmetadata.ValidateFile(
+    appMetadataPath, documents)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return kExitError
+  }
+  findings = append(findings, metadataFindings...)
+  if len(findings) > 0 {
+    findings.WriteText(os.Stderr)
+  }
+  if findings.HasErrors() {
+    return kExitInvalid
+  }
+
+  output := FLAGS_output
+  if output == "" {
+    output = bundle.FileName(metadata)
+  }
+  if image := imageInFile(validator.Images, output); image != nil {
+    fmt.Fprintf(os.Stderr, "The bundle %s would overwrite %s, which ships "+
+      "the image %s.\n", output, image.File, image.Ref)
+    return kExitError
+  }
+  manifest, err := writeBundle(output, &bundle.Contents{
+    AppSpec:     appSpecPath,
+    AppMetadata: appMetadataPath,
+    Metadata:    metadata,
+    Images:      validator.Images,
+  })
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return kExitError
+  }
+  fmt.Printf("Wrote %s with %d file(s).\n", output, len(manifest.Files))
+  return kExitSuccess
+}
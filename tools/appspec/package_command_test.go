@@ -0,0 +1,153 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file tests the package command.
+
+package main
+
+import (
+  "archive/tar"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspec/bundle"
+)
+
+const (
+  kSampleAppDir string = "../../sampleapp/viewbrowser/deployment"
+)
+
+// Copies the file at source to target.
+func copyFile(t *testing.T, source string, target string) {
+  data, err := ioutil.ReadFile(source)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := ioutil.WriteFile(target, data, 0644); err != nil {
+    t.Fatal(err)
+  }
+}
+
+// Writes a docker save tarball holding the image ref at path.
+func writeImageTarball(t *testing.T, path string, ref string) {
+  file, err := os.Create(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer file.Close()
+  archive := tar.NewWriter(file)
+  manifest := []byte(`[{"Config":"config.json","RepoTags":["` + ref +
+    `"],"Layers":[]}]`)
+  err = archive.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644,
+    Size: int64(len(manifest)), Typeflag: tar.TypeReg})
+  if err == nil {
+    _, err = archive.Write(manifest)
+  }
+  if err == nil {
+    err = archive.Close()
+  }
+  if err != nil {
+    t.Fatal(err)
+  }
+}
+
+// Packages the package directory of the sample app from within it, twice,
+// so that the second run finds the bundle of the first one in the directory.
+func TestPackageDirectoryTwice(t *testing.T) {
+  sampleDir, err := filepath.Abs(kSampleAppDir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  dir, err := ioutil.TempDir("", "package")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  copyFile(t, filepath.Join(sampleDir, "viewbrowser_spec.yaml"),
+    filepath.Join(dir, "viewbrowser_spec.yaml"))
+  copyFile(t, filepath.Join(sampleDir, "app.json"),
+    filepath.Join(dir, "app.json"))
+  writeImageTarball(t, filepath.Join(dir, "view-browser.tar"),
+    "view-browser:latest")
+
+  workingDir, err := os.Getwd()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := os.Chdir(dir); err != nil {
+    t.Fatal(err)
+  }
+  defer os.Chdir(workingDir)
+
+  args := []string{"viewbrowser_spec.yaml", "app.json", "."}
+  var bundles [][]byte
+  for run := 0; run < 2; run++ {
+    if exitCode := runPackage(args); exitCode != kExitSuccess {
+      t.Fatalf("Run %d of package exited with %d.", run+1, exitCode)
+    }
+    matches, err := filepath.Glob("*.tar.gz")
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(matches) != 1 {
+      t.Fatalf("Run %d of package left the bundles %v, expected one.",
+        run+1, matches)
+    }
+    data, err := ioutil.ReadFile(matches[0])
+    if err != nil {
+      t.Fatal(err)
+    }
+    bundles = append(bundles, data)
+
+    readBundle, err := bundle.ReadFile(matches[0])
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(readBundle.Problems) > 0 {
+      t.Errorf("Run %d wrote a bundle with problems %v.", run+1,
+        readBundle.Problems)
+    }
+    var paths []string
+    for _, file := range readBundle.Manifest.Files {
+      paths = append(paths, file.Path)
+    }
+    expected := []string{"viewbrowser_spec.yaml", "app.json",
+      "images/view-browser.tar"}
+    if len(paths) != len(expected) {
+      t.Fatalf("Run %d bundled %v, expected %v.", run+1, paths, expected)
+    }
+    for i := range expected {
+      if paths[i] != expected[i] {
+        t.Errorf("Run %d bundled %v, expected %v.", run+1, paths, expected)
+        break
+      }
+    }
+  }
+  if string(bundles[0]) != string(bundles[1]) {
+    t.Errorf("Packaging the directory again changed the bundle.")
+  }
+}
+
+// Packages the app into the file of its own image tarball.
+func TestPackageOverImageTarball(t *testing.T) {
+  sampleDir, err := filepath.Abs(kSampleAppDir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  dir, err := ioutil.TempDir("", "package")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  image := filepath.Join(dir, "view-browser.tar")
+  writeImageTarball(t, image, "view-browser:latest")
+
+  args := []string{"--output", image,
+    filepath.Join(sampleDir, "viewbrowser_spec.yaml"),
+    filepath.Join(sampleDir, "app.json"), image}
+  defer func() { FLAGS_output = "" }()
+  if exitCode := runPackage(args); exitCode != kExitError {
+    t.Errorf("Package exited with %d, expected %d.", exitCode, kExitError)
+  }
+}
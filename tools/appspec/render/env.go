@@ -0,0 +1,228 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file computes the environment each container of an appspec receives
+// once the Cohesity app platform has added its own variables. The variables
+// taken from ConfigMaps are shown with their values, those taken from Secrets
+// are not.
+
+package render
+
+import (
+  "fmt"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
+)
+
+// ContainerEnvVar is a variable in the environment of a container.
+type ContainerEnvVar struct {
+  Name  string
+  Value string
+  // Who sets the variable: the container itself, the ConfigMap or Secret it
+  // is taken from, the platform or, for the node port of a port with
+  // cohesityEnv, that port.
+  Source string
+  // If the container declares a variable the platform sets too, the
+  // variable set by the platform.
+  Platform *ContainerEnvVar
+}
+
+// ContainerEnv is the environment of a container of a workload.
+type ContainerEnv struct {
+  Kind      string
+  Workload  string
+  Container string
+  Vars      []*ContainerEnvVar
+}
+
+// Collisions returns the variables the container declares which the platform
+// sets too.
+func (containerEnv *ContainerEnv) Collisions() []*ContainerEnvVar {
+  var collisions []*ContainerEnvVar
+  for _, envVar := range containerEnv.Vars {
+    if envVar.Platform != nil {
+      collisions = append(collisions, envVar)
+    }
+  }
+  return collisions
+}
+
+// Returns the value of a variable set by the platform, as shown to users.
+func envValue(env *EnvVar) string {
+  if env.Value != nil {
+    return *env.Value
+  }
+  if env.ValueFrom != nil && env.ValueFrom.FieldRef != nil {
+    return "<" + env.ValueFrom.FieldRef.FieldPath + ">"
+  }
+  return ""
+}
+
+// Returns the value of the key of a ConfigMap or Secret, as shown to users.
+func (run *renderRun) configValue(kind string, name string,
+  key string) string {
+  if kind == "Secret" {
+    return fmt.Sprintf("<key %s of Secret %s>", key, name)
+  }
+  config, ok := run.configs[kind+"/"+name]
+  if !ok {
+    return ""
+  }
+  return config.AppSpec.Data[key]
+}
+
+// Returns the variables envFrom sets, one per key of its ConfigMap or Secret.
+// Like Kubernetes, keys which do not make a valid variable name are skipped.
+func (run *renderRun) envFromVars(
+  envFrom *appspecvalidator.EnvFromSource) []*ContainerEnvVar {
+  kind, ref := "ConfigMap", envFrom.ConfigMapRef
+  if ref == nil {
+    kind, ref = "Secret", envFrom.SecretRef
+  }
+  if ref == nil || ref.Name == nil {
+    return nil
+  }
+  config, ok := run.configs[kind+"/"+*ref.Name]
+  if !ok {
+    return nil
+  }
+  prefix := ""
+  if envFrom.Prefix != nil {
+    prefix = *envFrom.Prefix
+  }
+  var vars []*ContainerEnvVar
+  for _, key := range config.AppSpec.Keys() {
+    if !appspecvalidator.IsEnvName(prefix + key) {
+      continue
+    }
+    vars = append(vars, &ContainerEnvVar{
+      Name:   prefix + key,
+      Value:  run.configValue(kind, *ref.Name, key),
+      Source: kind + " " + *ref.Name,
+    })
+  }
+  return vars
+}
+
+// Returns the variable declared by env.
+func (run *renderRun) declaredVar(env *appspecvalidator.Env) *ContainerEnvVar {
+  envVar := &ContainerEnvVar{Name: *env.Name, Source: "container"}
+  if env.Value != nil {
+    envVar.Value = *env.Value
+  }
+  if env.ValueFrom == nil {
+    return envVar
+  }
+  kind, selector := "ConfigMap", env.ValueFrom.ConfigMapKeyRef
+  if selector == nil {
+    kind, selector = "Secret", env.ValueFrom.SecretKeyRef
+  }
+  if selector != nil && selector.Name != nil && selector.Key != nil {
+    envVar.Value = run.configValue(kind, *selector.Name, *selector.Key)
+    envVar.Source = kind + " " + *selector.Name
+  }
+  return envVar
+}
+
+// Returns who sets the platform variable named name.
+func (run *renderRun) envSource(name string) string {
+  for _, nodePort := range run.manifests.NodePorts {
+    if nodePort.CohesityEnv == name {
+      return fmt.Sprintf("node port of port %d of Service %s", nodePort.Port,
+        nodePort.Service)
+    }
+  }
+  return "platform"
+}
+
+// Returns the environment of a container: the variables it declares, then
+// those the platform sets. As in Kubernetes, the variables of env override
+// those of envFrom, and later envFrom override earlier ones.
+func (run *renderRun) containerEnv(
+  containerSpec *appspecvalidator.ContainerSpec) []*ContainerEnvVar {
+  var vars []*ContainerEnvVar
+  declared := make(map[string]*ContainerEnvVar)
+  declare := func(envVar *ContainerEnvVar) {
+    if previous, ok := declared[envVar.Name]; ok {
+      *previous = *envVar
+      return
+    }
+    declared[envVar.Name] = envVar
+    vars = append(vars, envVar)
+  }
+  for _, envFrom := range containerSpec.EnvFrom {
+    if envFrom == nil {
+      continue
+    }
+    for _, envVar := range run.envFromVars(envFrom) {
+      declare(envVar)
+    }
+  }
+  for _, env := range containerSpec.Env {
+    if env != nil && env.Name != nil {
+      declare(run.declaredVar(env))
+    }
+  }
+  for _, env := range run.env {
+    platform := &ContainerEnvVar{
+      Name:   env.Name,
+      Value:  envValue(env),
+      Source: run.envSource(env.Name),
+    }
+    if envVar, ok := declared[env.Name]; ok {
+      envVar.Platform = platform
+    } else {
+      vars = append(vars, platform)
+    }
+  }
+  return vars
+}
+
+// Environments returns the environment of every container of the workloads of
+// a valid appspec, including the cleanup Job. The variables of the platform
+// are always set, with the values of the options.
+func Environments(documents []*appspecvalidator.Document,
+  options *Options) ([]*ContainerEnv, error) {
+  stubOptions := *options
+  stubOptions.StubEnv = true
+  run := &renderRun{
+    options:   &stubOptions,
+    manifests: &Manifests{},
+    configs:   make(map[string]*appspecvalidator.Document),
+  }
+  for _, document := range documents {
+    if document.IsConfig() {
+      run.configs[document.Kind()+"/"+document.Name()] = document
+    }
+  }
+  if err := run.allocateNodePorts(documents); err != nil {
+    return nil, err
+  }
+
+  var environments []*ContainerEnv
+  for _, document := range documents {
+    if !document.IsWorkload() {
+      continue
+    }
+    spec := document.AppSpec.Spec
+    if spec == nil || spec.Template == nil ||
+      spec.Template.TemplateSpec == nil {
+      return nil, fmt.Errorf("%s %s has no pod template.", document.Kind(),
+        document.Name())
+    }
+    for _, containerSpec := range spec.Template.TemplateSpec.Containers {
+      if containerSpec == nil {
+        continue
+      }
+      containerEnv := &ContainerEnv{
+        Kind:     document.Kind(),
+        Workload: document.Name(),
+        Vars:     run.containerEnv(containerSpec),
+      }
+      if containerSpec.Name != nil {
+        containerEnv.Container = *containerSpec.Name
+      }
+      environments = append(environments, containerEnv)
+    }
+  }
+  return environments, nil
+}
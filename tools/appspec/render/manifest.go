@@ -0,0 +1,131 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file defines the subset of the Kubernetes objects rendered from an
+// appspec. The fields the appspec shares with Kubernetes, such as the
+// resources and probes of containers, reuse the appspec types.
+
+package render
+
+import (
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
+)
+
+type ObjectMeta struct {
+  Name   string            `yaml:"name,omitempty"`
+  Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// Object is a rendered Kubernetes object. The apiVersion and kind are left
+// out of the claim templates of a StatefulSet. ConfigMaps and Secrets have
+// data instead of a spec.
+type Object struct {
+  ApiVersion string            `yaml:"apiVersion,omitempty"`
+  Kind       string            `yaml:"kind,omitempty"`
+  Metadata   ObjectMeta        `yaml:"metadata"`
+  Type       string            `yaml:"type,omitempty"`
+  Data       map[string]string `yaml:"data,omitempty"`
+  StringData map[string]string `yaml:"stringData,omitempty"`
+  Spec       interface{}       `yaml:"spec,omitempty"`
+}
+
+type LabelSelector struct {
+  MatchLabels      map[string]string                   `yaml:"matchLabels,omitempty"`
+  MatchExpressions []*appspecvalidator.MatchExpression `yaml:"matchExpressions,omitempty"`
+}
+
+type ObjectFieldSelector struct {
+  FieldPath string `yaml:"fieldPath"`
+}
+
+type EnvVarSource struct {
+  FieldRef        *ObjectFieldSelector          `yaml:"fieldRef,omitempty"`
+  ConfigMapKeyRef *appspecvalidator.KeySelector `yaml:"configMapKeyRef,omitempty"`
+  SecretKeyRef    *appspecvalidator.KeySelector `yaml:"secretKeyRef,omitempty"`
+}
+
+type EnvVar struct {
+  Name      string        `yaml:"name"`
+  Value     *string       `yaml:"value,omitempty"`
+  ValueFrom *EnvVarSource `yaml:"valueFrom,omitempty"`
+}
+
+type Container struct {
+  Name            string                            `yaml:"name"`
+  Image           string                            `yaml:"image"`
+  ImagePullPolicy *string                           `yaml:"imagePullPolicy,omitempty"`
+  Command         []string                          `yaml:"command,omitempty"`
+  Args            []string                          `yaml:"args,omitempty"`
+  Ports           []*appspecvalidator.ContainerPort `yaml:"ports,omitempty"`
+  Resources       *appspecvalidator.Resources       `yaml:"resources,omitempty"`
+  VolumeMounts    []*appspecvalidator.VolumeMounts  `yaml:"volumeMounts,omitempty"`
+  EnvFrom         []*appspecvalidator.EnvFromSource `yaml:"envFrom,omitempty"`
+  Env             []*EnvVar                         `yaml:"env,omitempty"`
+  LivenessProbe   *appspecvalidator.Probe           `yaml:"livenessProbe,omitempty"`
+  ReadinessProbe  *appspecvalidator.Probe           `yaml:"readinessProbe,omitempty"`
+  SecurityContext *appspecvalidator.SecurityContext `yaml:"securityContext,omitempty"`
+}
+
+type HostPathVolumeSource struct {
+  Path string `yaml:"path"`
+  Type string `yaml:"type,omitempty"`
+}
+
+type PersistentVolumeClaimVolumeSource struct {
+  ClaimName string `yaml:"claimName"`
+}
+
+type Volume struct {
+  Name                  string                                  `yaml:"name"`
+  HostPath              *HostPathVolumeSource                   `yaml:"hostPath,omitempty"`
+  PersistentVolumeClaim *PersistentVolumeClaimVolumeSource      `yaml:"persistentVolumeClaim,omitempty"`
+  ConfigMap             *appspecvalidator.ConfigMapVolumeSource `yaml:"configMap,omitempty"`
+  Secret                *appspecvalidator.SecretVolumeSource    `yaml:"secret,omitempty"`
+}
+
+type PodSpec struct {
+  RestartPolicy string       `yaml:"restartPolicy,omitempty"`
+  Containers    []*Container `yaml:"containers"`
+  Volumes       []*Volume    `yaml:"volumes,omitempty"`
+}
+
+type PodTemplate struct {
+  Metadata ObjectMeta `yaml:"metadata"`
+  Spec     PodSpec    `yaml:"spec"`
+}
+
+type ResourceRequirements struct {
+  Requests map[string]string `yaml:"requests"`
+}
+
+type PersistentVolumeClaimSpec struct {
+  AccessModes []string             `yaml:"accessModes"`
+  Resources   ResourceRequirements `yaml:"resources"`
+}
+
+// WorkloadSpec is the spec of a StatefulSet, ReplicaSet, Deployment,
+// DaemonSet or Job.
+type WorkloadSpec struct {
+  Replicas              *int                                 `yaml:"replicas,omitempty"`
+  ServiceName           string                               `yaml:"serviceName,omitempty"`
+  Strategy              *appspecvalidator.DeploymentStrategy `yaml:"strategy,omitempty"`
+  BackoffLimit          *int                                 `yaml:"backoffLimit,omitempty"`
+  ActiveDeadlineSeconds *int                                 `yaml:"activeDeadlineSeconds,omitempty"`
+  Selector              *LabelSelector                       `yaml:"selector,omitempty"`
+  Template              PodTemplate                          `yaml:"template"`
+  VolumeClaimTemplates  []*Object                            `yaml:"volumeClaimTemplates,omitempty"`
+}
+
+type ServicePort struct {
+  Name       string                        `yaml:"name,omitempty"`
+  Protocol   string                        `yaml:"protocol,omitempty"`
+  Port       int                           `yaml:"port"`
+  TargetPort *appspecvalidator.IntOrString `yaml:"targetPort,omitempty"`
+  NodePort   int                           `yaml:"nodePort,omitempty"`
+}
+
+type ServiceSpec struct {
+  Type      string            `yaml:"type,omitempty"`
+  ClusterIP string            `yaml:"clusterIP,omitempty"`
+  Selector  map[string]string `yaml:"selector,omitempty"`
+  Ports     []*ServicePort    `yaml:"ports,omitempty"`
+}
@@ -0,0 +1,476 @@
+// Copyright 2019 Cohesity Inc.
+//
+// Package render turns a Cohesity appspec into plain Kubernetes manifests, so
+// that an app can be smoke-tested on a local cluster such as kind or k3s. The
+// Cohesity extensions are replaced by what the Cohesity app platform does for
+// them:
+//   - replicas.fixed/share/min/max become a replica count for a given number
+//     of nodes;
+//   - node ports are allocated to the ports of NodePort Services, and passed
+//     to all the containers through the cohesityEnv variables;
+//   - dynamic volumes become PersistentVolumeClaims and static volumes, which
+//     mount Cohesity views, become hostPath volumes.
+// ConfigMaps and Secrets, and the volumes and variables taken from them, are
+// rendered as they are.
+
+package render
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "path"
+  "strconv"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
+  "gopkg.in/yaml.v3"
+)
+
+const (
+  // The variables the Cohesity app server sets in the environment of every
+  // container of an app.
+  EnvHostIp          string = "HOST_IP"
+  EnvApiEndpointIp   string = "APPS_API_ENDPOINT_IP"
+  EnvApiEndpointPort string = "APPS_API_ENDPOINT_PORT"
+  EnvAuthToken       string = "APP_AUTHENTICATION_TOKEN"
+
+  kHostIpFieldPath string = "status.hostIP"
+
+  // The range of node ports of a default Kubernetes cluster.
+  kMinNodePort int = 30000
+  kMaxNodePort int = 32767
+
+  kServiceKind         string = "Service"
+  kServiceTypeNodePort string = "NodePort"
+  kClusterIpNone       string = "None"
+
+  kHostPathDirectoryOrCreate string = "DirectoryOrCreate"
+  kAccessModeReadWriteOnce   string = "ReadWriteOnce"
+)
+
+// Options tune how an appspec is rendered.
+type Options struct {
+  // Number of nodes of the cluster, which share replicas are multiplied by.
+  Nodes int
+  // Node port allocated to the first port of the NodePort Services. The
+  // others follow.
+  NodePortBase int
+  // Size of the claims of the dynamic volumes, e.g. 1Gi.
+  VolumeSize string
+  // Directory of the nodes holding the views mounted by static volumes. Each
+  // view is the subdirectory named by its volumeName.
+  ViewRoot string
+  // If set, the variables of the Cohesity app server are set in the
+  // environment of the containers, with the values below. HOST_IP is always
+  // the IP of the node.
+  StubEnv         bool
+  ApiEndpointIp   string
+  ApiEndpointPort string
+  AuthToken       string
+  // If set, the cleanup Job is rendered too. It is normally only run when the
+  // app is uninstalled.
+  Cleanup bool
+}
+
+// DefaultOptions returns the options for a single node cluster.
+func DefaultOptions() *Options {
+  return &Options{
+    Nodes:           1,
+    NodePortBase:    kMinNodePort,
+    VolumeSize:      "1Gi",
+    ViewRoot:        "/tmp/cohesity-views",
+    ApiEndpointIp:   "127.0.0.1",
+    ApiEndpointPort: "443",
+    AuthToken:       "stub-token",
+  }
+}
+
+// NodePort is a node port allocated to a port of a Service.
+type NodePort struct {
+  Service  string
+  Port     int
+  NodePort int
+  // Variable passing the node port to the containers, if any.
+  CohesityEnv string
+  // True if the port serves the UI of the app.
+  Ui bool
+}
+
+// Manifests are the Kubernetes objects rendered from an appspec.
+type Manifests struct {
+  Objects   []*Object
+  NodePorts []*NodePort
+}
+
+// renderRun holds the state of a single rendering of an appspec.
+type renderRun struct {
+  options   *Options
+  manifests *Manifests
+  // Variables set in the environment of every container.
+  env []*EnvVar
+  // The ConfigMaps and Secrets of the appspec, keyed by kind/name.
+  configs map[string]*appspecvalidator.Document
+}
+
+// Returns value as a pointer, for the optional fields of objects.
+func stringPtr(value string) *string {
+  return &value
+}
+
+// Returns the labels as a map, nil if there are none.
+func labelsMap(labels *appspecvalidator.Labels) map[string]string {
+  labelMap := labels.Map()
+  if len(labelMap) == 0 {
+    return nil
+  }
+  return labelMap
+}
+
+// Returns the metadata of a rendered object.
+func objectMeta(metadata *appspecvalidator.Metadata) ObjectMeta {
+  objectMeta := ObjectMeta{}
+  if metadata != nil {
+    if metadata.Name != nil {
+      objectMeta.Name = *metadata.Name
+    }
+    objectMeta.Labels = labelsMap(metadata.Labels)
+  }
+  return objectMeta
+}
+
+// Allocates the node ports of the NodePort Services and builds the variables
+// set in the environment of every container.
+func (run *renderRun) allocateNodePorts(
+  documents []*appspecvalidator.Document) error {
+  if run.options.StubEnv {
+    run.env = append(run.env,
+      &EnvVar{Name: EnvHostIp, ValueFrom: &EnvVarSource{
+        FieldRef: &ObjectFieldSelector{FieldPath: kHostIpFieldPath},
+      }},
+      &EnvVar{Name: EnvApiEndpointIp,
+        Value: stringPtr(run.options.ApiEndpointIp)},
+      &EnvVar{Name: EnvApiEndpointPort,
+        Value: stringPtr(run.options.ApiEndpointPort)},
+      &EnvVar{Name: EnvAuthToken, Value: stringPtr(run.options.AuthToken)})
+  }
+
+  nodePort := run.options.NodePortBase
+  for _, document := range documents {
+    spec := document.AppSpec.Spec
+    if document.Kind() != kServiceKind || spec == nil || spec.Type == nil ||
+      *spec.Type != kServiceTypeNodePort {
+      continue
+    }
+    for _, port := range spec.Ports {
+      if port == nil || port.Port == nil {
+        continue
+      }
+      if nodePort > kMaxNodePort {
+        return fmt.Errorf("Node port %d of Service %s is out of the range "+
+          "%d-%d.", nodePort, document.Name(), kMinNodePort, kMaxNodePort)
+      }
+      allocated := &NodePort{
+        Service:  document.Name(),
+        Port:     *port.Port,
+        NodePort: nodePort,
+        Ui:       port.IsUi(),
+      }
+      if port.CohesityEnv != nil {
+        allocated.CohesityEnv = *port.CohesityEnv
+        run.env = append(run.env, &EnvVar{Name: *port.CohesityEnv,
+          Value: stringPtr(strconv.Itoa(nodePort))})
+      }
+      run.manifests.NodePorts = append(run.manifests.NodePorts, allocated)
+      nodePort++
+    }
+  }
+  return nil
+}
+
+// Returns the node port allocated to port of the Service named service, or 0.
+func (run *renderRun) nodePort(service string, port int) int {
+  for _, allocated := range run.manifests.NodePorts {
+    if allocated.Service == service && allocated.Port == port {
+      return allocated.NodePort
+    }
+  }
+  return 0
+}
+
+// Renders a Service.
+func (run *renderRun) renderService(document *appspecvalidator.Document) {
+  spec := document.AppSpec.Spec
+  serviceSpec := &ServiceSpec{}
+  if spec.Type != nil {
+    serviceSpec.Type = *spec.Type
+  }
+  if spec.IsHeadless() {
+    serviceSpec.ClusterIP = kClusterIpNone
+  }
+  if spec.Selector != nil && len(spec.Selector.Labels) > 0 {
+    serviceSpec.Selector = spec.Selector.Labels
+  }
+  for _, port := range spec.Ports {
+    if port == nil || port.Port == nil {
+      continue
+    }
+    servicePort := &ServicePort{
+      Port:       *port.Port,
+      TargetPort: port.TargetPort,
+      NodePort:   run.nodePort(document.Name(), *port.Port),
+    }
+    if port.Name != nil {
+      servicePort.Name = *port.Name
+    }
+    if port.Protocol != nil {
+      servicePort.Protocol = *port.Protocol
+    }
+    serviceSpec.Ports = append(serviceSpec.Ports, servicePort)
+  }
+
+  run.manifests.Objects = append(run.manifests.Objects, &Object{
+    ApiVersion: appspecvalidator.ExpectedApiVersion(document.Kind()),
+    Kind:       document.Kind(),
+    Metadata:   objectMeta(document.AppSpec.Metadata),
+    Spec:       serviceSpec,
+  })
+}
+
+// Renders a ConfigMap or Secret.
+func (run *renderRun) renderConfig(document *appspecvalidator.Document) {
+  appSpec := document.AppSpec
+  object := &Object{
+    ApiVersion: appspecvalidator.ExpectedApiVersion(document.Kind()),
+    Kind:       document.Kind(),
+    Metadata:   objectMeta(appSpec.Metadata),
+    Data:       appSpec.Data,
+    StringData: appSpec.StringData,
+  }
+  if appSpec.Type != nil {
+    object.Type = *appSpec.Type
+  }
+  run.manifests.Objects = append(run.manifests.Objects, object)
+}
+
+// Renders a container, adding the variables of the platform to its
+// environment. Variables the container sets itself are kept.
+func (run *renderRun) renderContainer(
+  containerSpec *appspecvalidator.ContainerSpec) *Container {
+  container := &Container{
+    ImagePullPolicy: containerSpec.ImagePullPolicy,
+    Command:         containerSpec.Command,
+    Args:            containerSpec.Args,
+    Ports:           containerSpec.Ports,
+    Resources:       containerSpec.Resources,
+    VolumeMounts:    containerSpec.VolumeMounts,
+    EnvFrom:         containerSpec.EnvFrom,
+    LivenessProbe:   containerSpec.LivenessProbe,
+    ReadinessProbe:  containerSpec.ReadinessProbe,
+    SecurityContext: containerSpec.SecurityContext,
+  }
+  if containerSpec.Name != nil {
+    container.Name = *containerSpec.Name
+  }
+  if containerSpec.Image != nil {
+    container.Image = *containerSpec.Image
+  }
+
+  defined := make(map[string]bool)
+  for _, env := range containerSpec.Env {
+    if env == nil || env.Name == nil {
+      continue
+    }
+    defined[*env.Name] = true
+    envVar := &EnvVar{Name: *env.Name, Value: env.Value}
+    if env.ValueFrom != nil {
+      envVar.ValueFrom = &EnvVarSource{
+        ConfigMapKeyRef: env.ValueFrom.ConfigMapKeyRef,
+        SecretKeyRef:    env.ValueFrom.SecretKeyRef,
+      }
+    }
+    container.Env = append(container.Env, envVar)
+  }
+  for _, env := range run.env {
+    if !defined[env.Name] {
+      container.Env = append(container.Env, env)
+    }
+  }
+  return container
+}
+
+// Returns a claim of a volume of the configured size.
+func (run *renderRun) volumeClaim(name string) *Object {
+  return &Object{
+    Metadata: ObjectMeta{Name: name},
+    Spec: &PersistentVolumeClaimSpec{
+      AccessModes: []string{kAccessModeReadWriteOnce},
+      Resources: ResourceRequirements{
+        Requests: map[string]string{"storage": run.options.VolumeSize},
+      },
+    },
+  }
+}
+
+// Renders a workload: a StatefulSet, ReplicaSet, Deployment, DaemonSet or Job.
+func (run *renderRun) renderWorkload(
+  document *appspecvalidator.Document) error {
+  kind := document.Kind()
+  features, _ := appspecvalidator.LookupKind(kind)
+  spec := document.AppSpec.Spec
+  if spec.Template == nil || spec.Template.TemplateSpec == nil {
+    return fmt.Errorf("%s %s has no pod template.", kind, document.Name())
+  }
+  workloadSpec := &WorkloadSpec{}
+  templateSpec := spec.Template.TemplateSpec
+  if templateSpec.RestartPolicy != nil {
+    workloadSpec.Template.Spec.RestartPolicy = *templateSpec.RestartPolicy
+  }
+  if features.RunToCompletion {
+    workloadSpec.BackoffLimit = spec.BackoffLimit
+    workloadSpec.ActiveDeadlineSeconds = spec.ActiveDeadlineSeconds
+  } else {
+    // A DaemonSet runs a pod on every node, it has no replica count.
+    if features.Replicas {
+      replicas := document.Replicas(run.options.Nodes)
+      workloadSpec.Replicas = &replicas
+    }
+    if spec.Selector != nil {
+      workloadSpec.Selector = &LabelSelector{
+        MatchLabels:      labelsMap(spec.Selector.MatchLabels),
+        MatchExpressions: spec.Selector.MatchExpressions,
+      }
+    }
+  }
+  if features.ServiceName && spec.ServiceName != nil {
+    workloadSpec.ServiceName = *spec.ServiceName
+  }
+  if features.Strategy {
+    workloadSpec.Strategy = spec.Strategy
+  }
+  if spec.Template.Metadata != nil {
+    workloadSpec.Template.Metadata.Labels =
+      labelsMap(spec.Template.Metadata.Labels)
+  }
+
+  for _, containerSpec := range templateSpec.Containers {
+    if containerSpec != nil {
+      workloadSpec.Template.Spec.Containers = append(
+        workloadSpec.Template.Spec.Containers,
+        run.renderContainer(containerSpec))
+    }
+  }
+
+  var claims []*Object
+  for _, volumeSpec := range templateSpec.Volumes {
+    if volumeSpec == nil || volumeSpec.Name == nil {
+      continue
+    }
+    volume := &Volume{Name: *volumeSpec.Name}
+    switch {
+    case volumeSpec.ConfigMap != nil || volumeSpec.Secret != nil:
+      volume.ConfigMap = volumeSpec.ConfigMap
+      volume.Secret = volumeSpec.Secret
+    case volumeSpec.IsStatic():
+      viewName := ""
+      if volumeSpec.VolumeName != nil {
+        viewName = *volumeSpec.VolumeName
+      }
+      volume.HostPath = &HostPathVolumeSource{
+        Path: path.Join(run.options.ViewRoot, viewName),
+        Type: kHostPathDirectoryOrCreate,
+      }
+    case features.ClaimPerPod:
+      // Each pod of a StatefulSet gets its own claim, mounted by the name of
+      // the template.
+      workloadSpec.VolumeClaimTemplates = append(
+        workloadSpec.VolumeClaimTemplates, run.volumeClaim(volume.Name))
+      continue
+    default:
+      claim := run.volumeClaim(document.Name() + "-" + volume.Name)
+      claim.ApiVersion = "v1"
+      claim.Kind = "PersistentVolumeClaim"
+      claims = append(claims, claim)
+      volume.PersistentVolumeClaim = &PersistentVolumeClaimVolumeSource{
+        ClaimName: claim.Metadata.Name,
+      }
+    }
+    workloadSpec.Template.Spec.Volumes = append(
+      workloadSpec.Template.Spec.Volumes, volume)
+  }
+
+  run.manifests.Objects = append(run.manifests.Objects, claims...)
+  run.manifests.Objects = append(run.manifests.Objects, &Object{
+    ApiVersion: appspecvalidator.ExpectedApiVersion(kind),
+    Kind:       kind,
+    Metadata:   objectMeta(document.AppSpec.Metadata),
+    Spec:       workloadSpec,
+  })
+  return nil
+}
+
+// Render renders the objects of a valid appspec as Kubernetes objects.
+func Render(documents []*appspecvalidator.Document,
+  options *Options) (*Manifests, error) {
+  if options.Nodes < 1 {
+    return nil, errors.New("The cluster needs at least 1 node.")
+  }
+  run := &renderRun{options: options, manifests: &Manifests{}}
+  if err := run.allocateNodePorts(documents); err != nil {
+    return nil, err
+  }
+
+  for _, document := range documents {
+    if document.IsConfig() {
+      run.renderConfig(document)
+      continue
+    }
+    if document.AppSpec.Spec == nil {
+      return nil, fmt.Errorf("%s %s has no spec.", document.Kind(),
+        document.Name())
+    }
+    switch {
+    case document.Kind() == kServiceKind:
+      run.renderService(document)
+    case document.IsWorkload():
+      if document.IsCleanupJob() && !options.Cleanup {
+        continue
+      }
+      if err := run.renderWorkload(document); err != nil {
+        return nil, err
+      }
+    default:
+      return nil, fmt.Errorf("Can not render objects of kind %s.",
+        document.Kind())
+    }
+  }
+  return run.manifests, nil
+}
+
+// Write writes the manifests as a stream of YAML documents, preceded by
+// comments telling which node ports the Services are reachable on.
+func (manifests *Manifests) Write(writer io.Writer) error {
+  header := "# Rendered from a Cohesity appspec.\n"
+  for _, nodePort := range manifests.NodePorts {
+    header += fmt.Sprintf("# Port %d of Service %s is node port %d",
+      nodePort.Port, nodePort.Service, nodePort.NodePort)
+    if nodePort.CohesityEnv != "" {
+      header += ", passed in " + nodePort.CohesityEnv
+    }
+    if nodePort.Ui {
+      header += ", serving the UI of the app"
+    }
+    header += ".\n"
+  }
+  if _, err := io.WriteString(writer, header); err != nil {
+    return err
+  }
+
+  encoder := yaml.NewEncoder(writer)
+  encoder.SetIndent(2)
+  for _, object := range manifests.Objects {
+    if err := encoder.Encode(object); err != nil {
+      return err
+    }
+  }
+  return encoder.Close()
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Cohesity Inc.
+//
+// The render command, which turns an appspec into plain Kubernetes manifests
+// for a local cluster. Eg. ./appspec render --nodes 3 appspecpath
+
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspec/render"
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
+)
+
+var (
+  // FLAGS_nodes specifies the number of nodes of the cluster.
+  FLAGS_nodes int
+
+  // FLAGS_nodePortBase specifies the first node port allocated to Services.
+  FLAGS_nodePortBase int
+
+  // FLAGS_volumeSize specifies the size of the claims of dynamic volumes.
+  FLAGS_volumeSize string
+
+  // FLAGS_viewRoot specifies the directory of the nodes holding the views
+  // mounted by static volumes.
+  FLAGS_viewRoot string
+
+  // FLAGS_stubEnv specifies whether to set the variables of the Cohesity app
+  // server in the environment of the containers.
+  FLAGS_stubEnv bool
+
+  // FLAGS_apiEndpointIp specifies the stub APPS_API_ENDPOINT_IP.
+  FLAGS_apiEndpointIp string
+
+  // FLAGS_apiEndpointPort specifies the stub APPS_API_ENDPOINT_PORT.
+  FLAGS_apiEndpointPort string
+
+  // FLAGS_authToken specifies the stub APP_AUTHENTICATION_TOKEN.
+  FLAGS_authToken string
+
+  // FLAGS_cleanup specifies whether to render the cleanup Job.
+  FLAGS_cleanup bool
+)
+
+// Validates the appspec at path and returns its objects. Invalid appspecs
+// are reported and end the command.
+func loadAppSpec(path string) ([]*appspecvalidator.Document, int) {
+  documents, findings, err :=
+    appspecvalidator.NewValidator().ParseAndValidateFile(path)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return nil, kExitError
+  }
+  if findings.HasErrors() {
+    findings.WriteText(os.Stderr)
+    return nil, kExitInvalid
+  }
+  return documents, kExitSuccess
+}
+
+// Registers the flags setting the node ports and the variables of the
+// Cohesity app server, which the render and env commands share.
+func addEnvFlags(flags *flag.FlagSet, defaults *render.Options) {
+  flags.IntVar(&FLAGS_nodePortBase, "node_port_base", defaults.NodePortBase,
+    "Node port allocated to the first port of the NodePort Services.")
+  flags.StringVar(&FLAGS_apiEndpointIp, "api_endpoint_ip",
+    defaults.ApiEndpointIp, "Value of APPS_API_ENDPOINT_IP.")
+  flags.StringVar(&FLAGS_apiEndpointPort, "api_endpoint_port",
+    defaults.ApiEndpointPort, "Value of APPS_API_ENDPOINT_PORT.")
+  flags.StringVar(&FLAGS_authToken, "auth_token", defaults.AuthToken,
+    "Value of APP_AUTHENTICATION_TOKEN.")
+}
+
+func runRender(args []string) int {
+  defaults := render.DefaultOptions()
+  flags := flag.NewFlagSet("render", flag.ExitOnError)
+  flags.IntVar(&FLAGS_nodes, "nodes", defaults.Nodes,
+    "Number of nodes of the cluster, which share replicas are multiplied by.")
+  flags.StringVar(&FLAGS_volumeSize, "volume_size", defaults.VolumeSize,
+    "Size of the claims of dynamic volumes.")
+  flags.StringVar(&FLAGS_viewRoot, "view_root", defaults.ViewRoot,
+    "Directory of the nodes holding the views mounted by static volumes.")
+  flags.BoolVar(&FLAGS_stubEnv, "stub_env", false,
+    "Set the variables of the Cohesity app server, e.g. HOST_IP, in the "+
+      "environment of the containers.")
+  addEnvFlags(flags, defaults)
+  flags.BoolVar(&FLAGS_cleanup, "cleanup", false,
+    "Also render the cleanup Job, which is normally run on uninstall.")
+  flags.Usage = func() {
+    fmt.Fprintf(flags.Output(), "Usage: %s render [flags] appspecpath\n",
+      os.Args[0])
+    flags.PrintDefaults()
+  }
+  flags.Parse(args)
+  if flags.NArg() != 1 {
+    flags.Usage()
+    return kExitError
+  }
+
+  documents, exitCode := loadAppSpec(flags.Arg(0))
+  if documents == nil {
+    return exitCode
+  }
+  options := &render.Options{
+    Nodes:           FLAGS_nodes,
+    NodePortBase:    FLAGS_nodePortBase,
+    VolumeSize:      FLAGS_volumeSize,
+    ViewRoot:        FLAGS_viewRoot,
+    StubEnv:         FLAGS_stubEnv,
+    ApiEndpointIp:   FLAGS_apiEndpointIp,
+    ApiEndpointPort: FLAGS_apiEndpointPort,
+    AuthToken:       FLAGS_authToken,
+    Cleanup:         FLAGS_cleanup,
+  }
+  manifests, err := render.Render(documents, options)
+  if err == nil {
+    err = manifests.Write(os.Stdout)
+  }
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return kExitError
+  }
+  return kExitSuccess
+}
@@ -0,0 +1,661 @@
+// Copyright 2019 Cohesity Inc.
+//
+// Package specdiff compares two versions of an appspec object by object,
+// rather than line by line, and tells which changes break upgrading an
+// installed app from the old version to the new one. Objects are matched by
+// their kind and name, and containers, volumes and ports by their names.
+
+package specdiff
+
+import (
+  "encoding/base64"
+  "fmt"
+  "reflect"
+  "sort"
+  "strconv"
+  "strings"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
+)
+
+const (
+  kNone          string = "<none>"
+  kClusterIpNone string = "None"
+)
+
+// Change is a change between two versions of an appspec.
+type Change struct {
+  // Kind and name of the object changed.
+  Kind string
+  Name string
+  // Path of the changed field, "" if the object was added or removed.
+  // Containers, volumes and ports are given by name, e.g.
+  // spec.template.spec.containers[web].image.
+  Field string
+  // Old and new values. Old is "" for an addition, New for a removal.
+  Old string
+  New string
+  // Description of the change.
+  Message string
+  // True if the change breaks upgrading an installed app.
+  Breaking bool
+}
+
+func (change *Change) String() string {
+  prefix := "~"
+  switch {
+  case change.Breaking:
+    prefix = "!"
+  case change.Old == "":
+    prefix = "+"
+  case change.New == "":
+    prefix = "-"
+  }
+  description := fmt.Sprintf("%s %s %s", prefix, change.Kind, change.Name)
+  if change.Field != "" {
+    description += " " + change.Field
+  }
+  description += ": " + change.Message
+  if change.Breaking {
+    description += " (breaking)"
+  }
+  return description
+}
+
+// Changes are all the changes between two versions of an appspec.
+type Changes []*Change
+
+// HasBreaking returns true if one of the changes breaks upgrades.
+func (changes Changes) HasBreaking() bool {
+  for _, change := range changes {
+    if change.Breaking {
+      return true
+    }
+  }
+  return false
+}
+
+// diffRun holds the state of a single comparison. kind and name identify the
+// object being compared.
+type diffRun struct {
+  kind    string
+  name    string
+  changes Changes
+}
+
+// Returns the features of the kind of the current object.
+func (run *diffRun) features() appspecvalidator.KindFeatures {
+  features, _ := appspecvalidator.LookupKind(run.kind)
+  return features
+}
+
+// Records a change of the given field of the current object.
+func (run *diffRun) add(breaking bool, field string, oldValue string,
+  newValue string, format string, args ...interface{}) {
+  run.changes = append(run.changes, &Change{
+    Kind:     run.kind,
+    Name:     run.name,
+    Field:    field,
+    Old:      oldValue,
+    New:      newValue,
+    Message:  fmt.Sprintf(format, args...),
+    Breaking: breaking,
+  })
+}
+
+// Records a change of a value, described by its old and new values, if they
+// differ.
+func (run *diffRun) compareValue(breaking bool, field string, oldValue string,
+  newValue string) {
+  if oldValue != newValue {
+    run.add(breaking, field, oldValue, newValue, "%s -> %s", oldValue,
+      newValue)
+  }
+}
+
+// Returns value, or kNone if it is not set.
+func stringValue(value *string) string {
+  if value == nil {
+    return kNone
+  }
+  return *value
+}
+
+// Returns the clusterIp of the Service with the spec, or kNone if it is not
+// set. The none of older appspecs is spelled None, so respelling it is not a
+// change.
+func clusterIpValue(spec *appspecvalidator.Spec) string {
+  if spec.IsHeadless() {
+    return kClusterIpNone
+  }
+  return stringValue(spec.ClusterIp)
+}
+
+// Returns value, or kNone if it is not set.
+func intValue(value *int) string {
+  if value == nil {
+    return kNone
+  }
+  return strconv.Itoa(*value)
+}
+
+// Returns the number or name held by value, or kNone if it is not set.
+func intOrStringValue(value *appspecvalidator.IntOrString) string {
+  if value == nil {
+    return kNone
+  }
+  return value.String()
+}
+
+// Returns the labels formatted as key=value pairs in key order.
+func labelsValue(labels map[string]string) string {
+  if len(labels) == 0 {
+    return kNone
+  }
+  pairs := make([]string, 0, len(labels))
+  for key, value := range labels {
+    pairs = append(pairs, key+"="+value)
+  }
+  sort.Strings(pairs)
+  return strings.Join(pairs, ",")
+}
+
+// Returns the replica policy formatted like it is written, e.g. share: 1,
+// max: 3.
+func replicasValue(replicas *appspecvalidator.Replicas) string {
+  if replicas == nil {
+    return kNone
+  }
+  var fields []string
+  for _, field := range []struct {
+    name  string
+    value *int
+  }{
+    {"fixed", replicas.Fixed},
+    {"share", replicas.Share},
+    {"min", replicas.Min},
+    {"max", replicas.Max},
+  } {
+    if field.value != nil {
+      fields = append(fields, fmt.Sprintf("%s: %d", field.name, *field.value))
+    }
+  }
+  if len(fields) == 0 {
+    return kNone
+  }
+  return strings.Join(fields, ", ")
+}
+
+// Returns the update strategy of a Deployment formatted like it is written,
+// e.g. RollingUpdate, maxSurge: 1.
+func strategyValue(strategy *appspecvalidator.DeploymentStrategy) string {
+  if strategy == nil {
+    return kNone
+  }
+  parts := []string{stringValue(strategy.Type)}
+  if rollingUpdate := strategy.RollingUpdate; rollingUpdate != nil {
+    if rollingUpdate.MaxUnavailable != nil {
+      parts = append(parts, "maxUnavailable: "+
+        rollingUpdate.MaxUnavailable.String())
+    }
+    if rollingUpdate.MaxSurge != nil {
+      parts = append(parts, "maxSurge: "+rollingUpdate.MaxSurge.String())
+    }
+  }
+  return strings.Join(parts, ", ")
+}
+
+// Returns the selector formatted as its labels and expressions.
+func selectorValue(selector *appspecvalidator.Selector) string {
+  if selector == nil {
+    return kNone
+  }
+  value := labelsValue(selector.MatchLabels.Map())
+  if len(selector.Labels) > 0 {
+    value = labelsValue(selector.Labels)
+  }
+  for _, expression := range selector.MatchExpressions {
+    if expression != nil {
+      value += fmt.Sprintf(" %s %s (%s)", stringValue(expression.Key),
+        stringValue(expression.Operator),
+        strings.Join(expression.Values, ","))
+    }
+  }
+  return value
+}
+
+// Returns the requests or limits formatted as resource=quantity pairs.
+func requestsValue(requests *appspecvalidator.Requests) string {
+  if requests == nil {
+    return kNone
+  }
+  resources := make(map[string]string)
+  if requests.Cpu != nil {
+    resources["cpu"] = *requests.Cpu
+  }
+  if requests.Memory != nil {
+    resources["memory"] = *requests.Memory
+  }
+  if requests.EphemeralStorage != nil {
+    resources["ephemeral-storage"] = *requests.EphemeralStorage
+  }
+  return labelsValue(resources)
+}
+
+// Compares the containers of the current workload, matched by name.
+func (run *diffRun) compareContainers(
+  oldContainers []*appspecvalidator.ContainerSpec,
+  newContainers []*appspecvalidator.ContainerSpec) {
+  const path = "spec.template.spec.containers"
+  oldByName := make(map[string]*appspecvalidator.ContainerSpec)
+  for _, container := range oldContainers {
+    if container != nil {
+      oldByName[stringValue(container.Name)] = container
+    }
+  }
+  newByName := make(map[string]bool)
+  for _, newContainer := range newContainers {
+    if newContainer == nil {
+      continue
+    }
+    name := stringValue(newContainer.Name)
+    newByName[name] = true
+    field := fmt.Sprintf("%s[%s]", path, name)
+    oldContainer, ok := oldByName[name]
+    if !ok {
+      run.add(false, field, "", name, "Added container %s.", name)
+      continue
+    }
+
+    run.compareValue(false, field+".image", stringValue(oldContainer.Image),
+      stringValue(newContainer.Image))
+    var oldResources, newResources appspecvalidator.Resources
+    if oldContainer.Resources != nil {
+      oldResources = *oldContainer.Resources
+    }
+    if newContainer.Resources != nil {
+      newResources = *newContainer.Resources
+    }
+    run.compareValue(false, field+".resources.requests",
+      requestsValue(oldResources.Requests),
+      requestsValue(newResources.Requests))
+    run.compareValue(false, field+".resources.limits",
+      requestsValue(oldResources.Limits), requestsValue(newResources.Limits))
+    run.compareValue(false, field+".ports",
+      containerPortsValue(oldContainer.Ports),
+      containerPortsValue(newContainer.Ports))
+  }
+  for _, container := range oldContainers {
+    if container == nil || newByName[stringValue(container.Name)] {
+      continue
+    }
+    name := stringValue(container.Name)
+    run.add(false, fmt.Sprintf("%s[%s]", path, name), name, "",
+      "Removed container %s.", name)
+  }
+}
+
+// Returns the ports of a container formatted as name=port/protocol pairs.
+func containerPortsValue(ports []*appspecvalidator.ContainerPort) string {
+  values := make(map[string]string)
+  for i, port := range ports {
+    if port == nil {
+      continue
+    }
+    name := strconv.Itoa(i)
+    if port.Name != nil {
+      name = *port.Name
+    }
+    protocol := "TCP"
+    if port.Protocol != nil {
+      protocol = *port.Protocol
+    }
+    values[name] = intValue(port.ContainerPort) + "/" + protocol
+  }
+  return labelsValue(values)
+}
+
+// Returns the volumes of a template by name.
+func volumesByName(templateSpec *appspecvalidator.TemplateSpec) (
+  map[string]*appspecvalidator.VolumeSpec) {
+  volumes := make(map[string]*appspecvalidator.VolumeSpec)
+  if templateSpec == nil {
+    return volumes
+  }
+  for _, volume := range templateSpec.Volumes {
+    if volume != nil && volume.Name != nil {
+      volumes[*volume.Name] = volume
+    }
+  }
+  return volumes
+}
+
+// Returns the names of volumes in order.
+func sortedNames(volumes map[string]*appspecvalidator.VolumeSpec) []string {
+  names := make([]string, 0, len(volumes))
+  for name := range volumes {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// Returns the name of the ConfigMap of a volume, or kNone.
+func configMapName(volume *appspecvalidator.VolumeSpec) string {
+  if volume.ConfigMap == nil {
+    return kNone
+  }
+  return stringValue(volume.ConfigMap.Name)
+}
+
+// Returns the name of the Secret of a volume, or kNone.
+func secretName(volume *appspecvalidator.VolumeSpec) string {
+  if volume.Secret == nil {
+    return kNone
+  }
+  return stringValue(volume.Secret.SecretName)
+}
+
+// Compares the volumes of the current workload, matched by name. Changes to
+// the Cohesity volumes of a StatefulSet break upgrades: its claims are
+// created once, so a renamed or retyped volume leaves the data of the old one
+// behind. Volumes of ConfigMaps and Secrets have no claim.
+func (run *diffRun) compareVolumes(oldSpec *appspecvalidator.TemplateSpec,
+  newSpec *appspecvalidator.TemplateSpec) {
+  const path = "spec.template.spec.volumes"
+  isBreaking := func(volume *appspecvalidator.VolumeSpec) bool {
+    return run.features().ClaimPerPod && volume.Type != nil
+  }
+  oldVolumes := volumesByName(oldSpec)
+  newVolumes := volumesByName(newSpec)
+
+  var removed, added []string
+  for _, name := range sortedNames(oldVolumes) {
+    if _, ok := newVolumes[name]; !ok {
+      removed = append(removed, name)
+    }
+  }
+  for _, name := range sortedNames(newVolumes) {
+    oldVolume, ok := oldVolumes[name]
+    if !ok {
+      added = append(added, name)
+      continue
+    }
+    newVolume := newVolumes[name]
+    breaking := isBreaking(oldVolume) || isBreaking(newVolume)
+    field := fmt.Sprintf("%s[%s]", path, name)
+    run.compareValue(breaking, field+".volumeType",
+      stringValue(oldVolume.Type), stringValue(newVolume.Type))
+    run.compareValue(breaking, field+".volumeName",
+      stringValue(oldVolume.VolumeName), stringValue(newVolume.VolumeName))
+    run.compareValue(breaking, field+".fsType",
+      stringValue(oldVolume.FsType), stringValue(newVolume.FsType))
+    run.compareValue(false, field+".configMap.name", configMapName(oldVolume),
+      configMapName(newVolume))
+    run.compareValue(false, field+".secret.secretName", secretName(oldVolume),
+      secretName(newVolume))
+  }
+
+  // A volume removed and another one of the same type added is taken as a
+  // rename.
+  for _, oldName := range removed {
+    renamed := false
+    for i, newName := range added {
+      if stringValue(oldVolumes[oldName].Type) ==
+        stringValue(newVolumes[newName].Type) {
+        run.add(isBreaking(oldVolumes[oldName]),
+          fmt.Sprintf("%s[%s]", path, oldName), oldName, newName,
+          "Renamed volume %s to %s.", oldName, newName)
+        added = append(added[:i], added[i+1:]...)
+        renamed = true
+        break
+      }
+    }
+    if !renamed {
+      run.add(isBreaking(oldVolumes[oldName]),
+        fmt.Sprintf("%s[%s]", path, oldName), oldName, "",
+        "Removed volume %s.", oldName)
+    }
+  }
+  for _, name := range added {
+    run.add(isBreaking(newVolumes[name]), fmt.Sprintf("%s[%s]", path, name),
+      "", name, "Added volume %s.", name)
+  }
+}
+
+// Compares two versions of a workload.
+func (run *diffRun) compareWorkload(oldSpec *appspecvalidator.Spec,
+  newSpec *appspecvalidator.Spec) {
+  run.compareValue(false, "spec.replicas", replicasValue(oldSpec.Replicas),
+    replicasValue(newSpec.Replicas))
+  // The selector and serviceName of a workload can not be changed once it
+  // is created.
+  run.compareValue(true, "spec.selector", selectorValue(oldSpec.Selector),
+    selectorValue(newSpec.Selector))
+  features := run.features()
+  if features.ServiceName {
+    run.compareValue(true, "spec.serviceName",
+      stringValue(oldSpec.ServiceName), stringValue(newSpec.ServiceName))
+  }
+  if features.Strategy {
+    run.compareValue(false, "spec.strategy", strategyValue(oldSpec.Strategy),
+      strategyValue(newSpec.Strategy))
+  }
+  if features.RunToCompletion {
+    run.compareValue(false, "spec.backoffLimit", intValue(oldSpec.BackoffLimit),
+      intValue(newSpec.BackoffLimit))
+    run.compareValue(false, "spec.activeDeadlineSeconds",
+      intValue(oldSpec.ActiveDeadlineSeconds),
+      intValue(newSpec.ActiveDeadlineSeconds))
+  }
+
+  var oldTemplate, newTemplate appspecvalidator.Template
+  if oldSpec.Template != nil {
+    oldTemplate = *oldSpec.Template
+  }
+  if newSpec.Template != nil {
+    newTemplate = *newSpec.Template
+  }
+  var oldTemplateSpec, newTemplateSpec appspecvalidator.TemplateSpec
+  if oldTemplate.TemplateSpec != nil {
+    oldTemplateSpec = *oldTemplate.TemplateSpec
+  }
+  if newTemplate.TemplateSpec != nil {
+    newTemplateSpec = *newTemplate.TemplateSpec
+  }
+  run.compareValue(false, "spec.template.spec.restartPolicy",
+    stringValue(oldTemplateSpec.RestartPolicy),
+    stringValue(newTemplateSpec.RestartPolicy))
+  run.compareContainers(oldTemplateSpec.Containers,
+    newTemplateSpec.Containers)
+  run.compareVolumes(&oldTemplateSpec, &newTemplateSpec)
+}
+
+// Returns the ports of a Service by name, or by number for unnamed ports, and
+// their names in order.
+func servicePorts(spec *appspecvalidator.Spec) (
+  map[string]*appspecvalidator.Ports, []string) {
+  ports := make(map[string]*appspecvalidator.Ports)
+  var names []string
+  for _, port := range spec.Ports {
+    if port == nil {
+      continue
+    }
+    name := intValue(port.Port)
+    if port.Name != nil {
+      name = *port.Name
+    }
+    ports[name] = port
+    names = append(names, name)
+  }
+  return ports, names
+}
+
+// Compares two versions of a Service.
+func (run *diffRun) compareService(oldSpec *appspecvalidator.Spec,
+  newSpec *appspecvalidator.Spec) {
+  // Switching between NodePort and ClusterIP changes how the Service is
+  // reached, and the node ports of the app are lost.
+  run.compareValue(true, "spec.type", stringValue(oldSpec.Type),
+    stringValue(newSpec.Type))
+  run.compareValue(true, "spec.clusterIp", clusterIpValue(oldSpec),
+    clusterIpValue(newSpec))
+  run.compareValue(false, "spec.selector", selectorValue(oldSpec.Selector),
+    selectorValue(newSpec.Selector))
+
+  const path = "spec.ports"
+  oldPorts, oldNames := servicePorts(oldSpec)
+  newPorts, newNames := servicePorts(newSpec)
+  for _, name := range newNames {
+    field := fmt.Sprintf("%s[%s]", path, name)
+    oldPort, ok := oldPorts[name]
+    if !ok {
+      run.add(false, field, "", name, "Added port %s.", name)
+      continue
+    }
+    newPort := newPorts[name]
+    run.compareValue(false, field+".port", intValue(oldPort.Port),
+      intValue(newPort.Port))
+    run.compareValue(false, field+".protocol", stringValue(oldPort.Protocol),
+      stringValue(newPort.Protocol))
+    run.compareValue(false, field+".targetPort",
+      intOrStringValue(oldPort.TargetPort),
+      intOrStringValue(newPort.TargetPort))
+    run.compareValue(false, field+".cohesityTag",
+      stringValue(oldPort.CohesityTag), stringValue(newPort.CohesityTag))
+    // The containers reading the node port from the old variable no longer
+    // find it.
+    run.compareValue(true, field+".cohesityEnv",
+      stringValue(oldPort.CohesityEnv), stringValue(newPort.CohesityEnv))
+  }
+  for _, name := range oldNames {
+    if _, ok := newPorts[name]; !ok {
+      run.add(false, fmt.Sprintf("%s[%s]", path, name), name, "",
+        "Removed port %s.", name)
+    }
+  }
+}
+
+// Returns the keys and values of a ConfigMap or Secret. The data of a Secret
+// is decoded, so that moving a value between data and stringData is not a
+// change.
+func configData(object *appspecvalidator.AppSpec) map[string]string {
+  data := make(map[string]string)
+  for key, value := range object.Data {
+    if object.Kind != nil && *object.Kind == "Secret" {
+      if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+        value = string(decoded)
+      }
+    }
+    data[key] = value
+  }
+  for key, value := range object.StringData {
+    data[key] = value
+  }
+  return data
+}
+
+// Compares two versions of a ConfigMap or Secret key by key. The values of a
+// Secret are not shown.
+func (run *diffRun) compareConfig(oldObject *appspecvalidator.AppSpec,
+  newObject *appspecvalidator.AppSpec) {
+  run.compareValue(false, "type", stringValue(oldObject.Type),
+    stringValue(newObject.Type))
+  oldData := configData(oldObject)
+  newData := configData(newObject)
+  var keys []string
+  for key := range oldData {
+    keys = append(keys, key)
+  }
+  for key := range newData {
+    if _, ok := oldData[key]; !ok {
+      keys = append(keys, key)
+    }
+  }
+  sort.Strings(keys)
+
+  for _, key := range keys {
+    field := fmt.Sprintf("data[%s]", key)
+    oldValue, inOld := oldData[key]
+    newValue, inNew := newData[key]
+    switch {
+    case !inOld:
+      run.add(false, field, "", key, "Added key %s.", key)
+    case !inNew:
+      run.add(false, field, key, "", "Removed key %s.", key)
+    case oldValue == newValue:
+    case run.kind == "Secret":
+      run.add(false, field, key, key, "Changed the value of key %s.", key)
+    default:
+      run.compareValue(false, field, oldValue, newValue)
+    }
+  }
+}
+
+// Compares two versions of an object of the same kind and name.
+func (run *diffRun) compareObject(oldDocument *appspecvalidator.Document,
+  newDocument *appspecvalidator.Document) {
+  if reflect.DeepEqual(oldDocument.AppSpec, newDocument.AppSpec) {
+    return
+  }
+  oldSpec := oldDocument.AppSpec.Spec
+  newSpec := newDocument.AppSpec.Spec
+  if oldSpec == nil {
+    oldSpec = &appspecvalidator.Spec{}
+  }
+  if newSpec == nil {
+    newSpec = &appspecvalidator.Spec{}
+  }
+  if newDocument.IsWorkload() {
+    run.compareWorkload(oldSpec, newSpec)
+  } else if newDocument.Kind() == "Service" {
+    run.compareService(oldSpec, newSpec)
+  } else if newDocument.IsConfig() {
+    run.compareConfig(oldDocument.AppSpec, newDocument.AppSpec)
+  }
+}
+
+// Compare returns the changes from the objects of the old version of an
+// appspec to those of the new version. Added objects come first, in the order
+// of the new version, then changed objects, then removed objects.
+func Compare(oldDocuments []*appspecvalidator.Document,
+  newDocuments []*appspecvalidator.Document) Changes {
+  run := &diffRun{}
+  oldObjects := make(map[appspecvalidator.Pair]*appspecvalidator.Document)
+  for _, document := range oldDocuments {
+    oldObjects[document.Pair()] = document
+  }
+  newObjects := make(map[appspecvalidator.Pair]bool)
+
+  var changed []*appspecvalidator.Document
+  for _, document := range newDocuments {
+    newObjects[document.Pair()] = true
+    run.kind = document.Kind()
+    run.name = document.Name()
+    if _, ok := oldObjects[document.Pair()]; !ok {
+      run.add(false, "", "", document.Name(), "Added.")
+    } else {
+      changed = append(changed, document)
+    }
+  }
+  for _, document := range changed {
+    run.kind = document.Kind()
+    run.name = document.Name()
+    run.compareObject(oldObjects[document.Pair()], document)
+  }
+  for _, document := range oldDocuments {
+    if newObjects[document.Pair()] {
+      continue
+    }
+    run.kind = document.Kind()
+    run.name = document.Name()
+    if run.features().ClaimPerPod {
+      // The claims of the volumes of a StatefulSet outlive it.
+      run.add(true, "", document.Name(), "", "Removed. The claims of its "+
+        "volumes are left behind.")
+    } else {
+      run.add(false, "", document.Name(), "", "Removed.")
+    }
+  }
+  return run.changes
+}
@@ -0,0 +1,57 @@
+// Copyright 2019 Cohesity Inc.
+//
+// Language server for Cohesity appspec files. Build the appspec-lsp binary
+// and configure the editor to run it for appspec files, e.g. *_spec.yaml. It
+// talks the Language Server Protocol over stdin and stdout.
+// Eg. go build -o appspec-lsp appspec_lsp.go
+
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspec_lsp/appspeclsp"
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
+)
+
+var (
+  // FLAGS_strict specifies whether unknown fields in the appspec are errors.
+  FLAGS_strict bool
+
+  // FLAGS_schemaCheck specifies whether to also validate appspecs against
+  // their JSON Schema.
+  FLAGS_schemaCheck bool
+
+  // FLAGS_lintConfig specifies the lint config file whose rules are run.
+  FLAGS_lintConfig string
+)
+
+func main() {
+  flag.BoolVar(&FLAGS_strict, "strict", true,
+    "Report fields which are not part of the appspec format.")
+  flag.BoolVar(&FLAGS_schemaCheck, "schema_check", false,
+    "Also validate appspecs against their JSON Schema.")
+  flag.StringVar(&FLAGS_lintConfig, "lint_config", "",
+    "If set, the lint config file whose rules are run.")
+  flag.Parse()
+
+  validator := appspecvalidator.NewValidator()
+  validator.Strict = FLAGS_strict
+  validator.SchemaCheck = FLAGS_schemaCheck
+  if FLAGS_lintConfig != "" {
+    var err error
+    validator.Lint, err = appspecvalidator.LoadLintConfigFile(FLAGS_lintConfig)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(1)
+    }
+  }
+  server := appspeclsp.NewServer(validator)
+  if err := server.Run(os.Stdin, os.Stdout); err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(1)
+  }
+  os.Exit(0)
+}
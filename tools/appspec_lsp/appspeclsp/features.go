@@ -0,0 +1,359 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file implements the hover, completion and code action requests. The
+// documentation and the allowed values of the fields come from the JSON
+// Schema of appspecs, so they stay in sync with the validator.
+
+package appspeclsp
+
+import (
+  "fmt"
+  "regexp"
+  "sort"
+  "strings"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
+)
+
+const (
+  kSchemaDefinitions string = "#/definitions/"
+  kApiVersionKey     string = "apiVersion"
+)
+
+var (
+  // Matches the index of a list item in the path of a field.
+  fieldIndexRegexp = regexp.MustCompile(`\[[0-9]+\]`)
+)
+
+// Returns the schema schema refers to, or schema itself.
+func (server *Server) resolve(
+  schema *appspecvalidator.Schema) *appspecvalidator.Schema {
+  if schema.Ref != "" {
+    definition, ok := server.schema.Definitions[strings.TrimPrefix(schema.Ref,
+      kSchemaDefinitions)]
+    if ok {
+      return definition
+    }
+  }
+  return schema
+}
+
+// Returns the schema of the path element element of a value of schema, or nil
+// if schema does not describe it.
+func (server *Server) childSchema(schema *appspecvalidator.Schema,
+  element string) *appspecvalidator.Schema {
+  schema = server.resolve(schema)
+  if element == kListItem {
+    if schema.Items != nil {
+      return schema.Items
+    }
+  } else if property, ok := schema.Properties[element]; ok {
+    return property
+  } else if additional, ok :=
+    schema.AdditionalProperties.(*appspecvalidator.Schema); ok {
+    return additional
+  }
+  for _, subschema := range schema.AllOf {
+    if child := server.childSchema(subschema, element); child != nil {
+      return child
+    }
+  }
+  return nil
+}
+
+// Returns the schema of the field at path, or nil if it is not known.
+func (server *Server) lookupSchema(path []string) *appspecvalidator.Schema {
+  schema := server.schema
+  for _, element := range path {
+    if schema = server.childSchema(schema, element); schema == nil {
+      return nil
+    }
+  }
+  return schema
+}
+
+// Returns the properties of objects described by schema.
+func (server *Server) properties(
+  schema *appspecvalidator.Schema) map[string]*appspecvalidator.Schema {
+  properties := make(map[string]*appspecvalidator.Schema)
+  schema = server.resolve(schema)
+  for _, subschema := range schema.AllOf {
+    for key, property := range server.properties(subschema) {
+      properties[key] = property
+    }
+  }
+  for key, property := range schema.Properties {
+    properties[key] = property
+  }
+  return properties
+}
+
+// Returns the types allowed by schema.
+func (server *Server) schemaTypes(schema *appspecvalidator.Schema) []string {
+  schema = server.resolve(schema)
+  switch schemaType := schema.Type.(type) {
+  case string:
+    return []string{schemaType}
+  case []string:
+    return schemaType
+  }
+  for _, subschema := range schema.AllOf {
+    if types := server.schemaTypes(subschema); types != nil {
+      return types
+    }
+  }
+  return nil
+}
+
+// Returns the values allowed for the field at path, found on the line
+// lineIndex of lines.
+func (server *Server) allowedValues(path []string, lines []string,
+  lineIndex int) []string {
+  if len(path) == 1 && path[0] == kApiVersionKey {
+    // The apiVersion depends on the kind, which the schema can not tell.
+    kind := objectKind(lines, lineIndex)
+    if apiVersion := appspecvalidator.ExpectedApiVersion(kind);
+      apiVersion != "" {
+      return []string{apiVersion}
+    }
+    return nil
+  }
+  schema := server.lookupSchema(path)
+  if schema == nil {
+    return nil
+  }
+  var values []string
+  for _, value := range schema.Enum {
+    values = append(values, fmt.Sprint(value))
+  }
+  if values == nil {
+    for _, schemaType := range server.schemaTypes(schema) {
+      if schemaType == "boolean" {
+        values = []string{"true", "false"}
+      }
+    }
+  }
+  return values
+}
+
+// Returns the markdown documentation of the field key described by schema.
+func (server *Server) documentation(key string, path []string,
+  schema *appspecvalidator.Schema, lines []string, lineIndex int) string {
+  doc := "**" + key + "**"
+  if types := server.schemaTypes(schema); types != nil {
+    doc += ": " + strings.Join(types, " or ")
+  }
+  if schema.Description != "" {
+    doc += "\n\n" + schema.Description
+  }
+  if values := server.allowedValues(path, lines, lineIndex); values != nil {
+    doc += "\n\nAllowed values: `" + strings.Join(values, "`, `") + "`."
+  }
+  return doc
+}
+
+// Returns the text and the lines of the open document at uri.
+func (server *Server) documentLines(uri string) ([]string, bool) {
+  text, ok := server.documents[uri]
+  if !ok {
+    return nil, false
+  }
+  return splitLines(text), true
+}
+
+// Returns the documentation of the field on the hovered line.
+func (server *Server) hover(params *TextDocumentPositionParams) *Hover {
+  lines, ok := server.documentLines(params.TextDocument.Uri)
+  lineIndex := params.Position.Line
+  if !ok || lineIndex < 0 || lineIndex >= len(lines) {
+    return nil
+  }
+  line := lines[lineIndex]
+  key := parseKeyLine(line)
+  if key == nil {
+    return nil
+  }
+  path := keyPath(lines, lineIndex, key)
+  schema := server.lookupSchema(path)
+  if schema == nil {
+    return nil
+  }
+  return &Hover{
+    Contents: MarkupContent{
+      Kind:  kMarkupKindMarkdown,
+      Value: server.documentation(key.key, path, schema, lines, lineIndex),
+    },
+    Range: &Range{
+      Start: Position{Line: lineIndex,
+        Character: utf16Length(line[:key.column])},
+      End: Position{Line: lineIndex,
+        Character: utf16Length(line[:key.column+len(key.key)])},
+    },
+  }
+}
+
+// Returns the keys or values which can be typed at the position.
+func (server *Server) complete(
+  params *TextDocumentPositionParams) *CompletionList {
+  completions := &CompletionList{Items: []*CompletionItem{}}
+  lines, ok := server.documentLines(params.TextDocument.Uri)
+  lineIndex := params.Position.Line
+  if !ok || lineIndex < 0 || lineIndex >= len(lines) {
+    return completions
+  }
+  line := lines[lineIndex]
+  prefix := line[:utf16ByteOffset(line, params.Position.Character)]
+
+  if match := partialValueRegexp.FindStringSubmatchIndex(prefix);
+    match != nil {
+    path := keyPath(lines, lineIndex, matchedKey(prefix, match))
+    for _, value := range server.allowedValues(path, lines, lineIndex) {
+      completions.Items = append(completions.Items, &CompletionItem{
+        Label: value,
+        Kind:  kCompletionItemKindValue,
+      })
+    }
+    return completions
+  }
+
+  if match := partialKeyRegexp.FindStringSubmatchIndex(prefix); match != nil {
+    path := keyPath(lines, lineIndex, matchedKey(prefix, match))
+    parent := server.lookupSchema(path[:len(path)-1])
+    if parent == nil {
+      return completions
+    }
+    properties := server.properties(parent)
+    keys := make([]string, 0, len(properties))
+    for key := range properties {
+      keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+      item := &CompletionItem{
+        Label:      key,
+        Kind:       kCompletionItemKindProperty,
+        InsertText: key + ": ",
+      }
+      if description := properties[key].Description; description != "" {
+        item.Documentation = &MarkupContent{Kind: kMarkupKindMarkdown,
+          Value: description}
+      }
+      completions.Items = append(completions.Items, item)
+    }
+  }
+  return completions
+}
+
+// Returns the edit setting the value of the key on line lineIndex of lines to
+// value, or nil if the line holds no key.
+func setValueEdit(lines []string, lineIndex int, value string) *TextEdit {
+  line := lines[lineIndex]
+  key := parseKeyLine(line)
+  if key == nil {
+    return nil
+  }
+  colon := key.column + strings.IndexByte(line[key.column:], ':')
+  valueStart := colon + 1
+  for valueStart < len(line) && line[valueStart] == ' ' {
+    valueStart++
+  }
+  _, valueEnd := tokenBounds(line, valueStart)
+  return &TextEdit{
+    Range: Range{
+      Start: Position{Line: lineIndex, Character: utf16Length(line[:colon+1])},
+      End:   Position{Line: lineIndex, Character: utf16Length(line[:valueEnd])},
+    },
+    NewText: " " + value,
+  }
+}
+
+// Returns the current value of the key on line, unquoted.
+func keyValue(line string, key *yamlKey) string {
+  value := line[key.column+len(key.key):]
+  value = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(value), ":"))
+  _, end := tokenBounds(value, 0)
+  return strings.Trim(value[:end], `"'`)
+}
+
+// Returns a quick fix for finding, or nil if there is none.
+func (server *Server) quickFix(finding *appspecvalidator.Finding,
+  lines []string) (string, *TextEdit) {
+  if finding.Line < 1 || finding.Line > len(lines) {
+    return "", nil
+  }
+  lineIndex := finding.Line - 1
+  key := parseKeyLine(lines[lineIndex])
+
+  if finding.Field == kApiVersionKey {
+    apiVersion := appspecvalidator.ExpectedApiVersion(finding.Kind)
+    if apiVersion == "" {
+      return "", nil
+    }
+    title := "Set apiVersion to " + apiVersion
+    if key != nil && key.key == kApiVersionKey && key.dashColumn < 0 {
+      return title, setValueEdit(lines, lineIndex, apiVersion)
+    }
+    if finding.Column != 1 {
+      return "", nil
+    }
+    // The apiVersion is missing, the finding is at the start of the object.
+    return title, &TextEdit{
+      Range: Range{
+        Start: Position{Line: lineIndex},
+        End:   Position{Line: lineIndex},
+      },
+      NewText: kApiVersionKey + ": " + apiVersion + "\n",
+    }
+  }
+
+  // Replace a value which is not allowed by the closest allowed one.
+  path := strings.Split(fieldIndexRegexp.ReplaceAllString(finding.Field,
+    "."+kListItem), ".")
+  if key == nil || key.key != path[len(path)-1] {
+    return "", nil
+  }
+  allowed := server.allowedValues(path, lines, lineIndex)
+  value := keyValue(lines[lineIndex], key)
+  for _, allowedValue := range allowed {
+    if value == allowedValue {
+      return "", nil
+    }
+  }
+  suggestion := appspecvalidator.SuggestField(value, allowed)
+  if suggestion == "" {
+    return "", nil
+  }
+  return fmt.Sprintf("Change %s to %s", key.key, suggestion),
+    setValueEdit(lines, lineIndex, suggestion)
+}
+
+// Returns the quick fixes for the findings within the range of the request.
+func (server *Server) codeActions(params *CodeActionParams) []*CodeAction {
+  actions := []*CodeAction{}
+  uri := params.TextDocument.Uri
+  lines, ok := server.documentLines(uri)
+  if !ok {
+    return actions
+  }
+  for _, finding := range server.findings(server.documents[uri]) {
+    lineIndex := finding.Line - 1
+    if lineIndex < params.Range.Start.Line ||
+      lineIndex > params.Range.End.Line {
+      continue
+    }
+    title, edit := server.quickFix(finding, lines)
+    if edit == nil {
+      continue
+    }
+    actions = append(actions, &CodeAction{
+      Title:       title,
+      Kind:        kCodeActionQuickFix,
+      Diagnostics: []*Diagnostic{findingDiagnostic(finding, lines)},
+      IsPreferred: true,
+      Edit: &WorkspaceEdit{
+        Changes: map[string][]*TextEdit{uri: []*TextEdit{edit}},
+      },
+    })
+  }
+  return actions
+}
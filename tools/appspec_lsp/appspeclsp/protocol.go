@@ -0,0 +1,256 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file implements the subset of the Language Server Protocol used by the
+// appspec language server, see
+// https://microsoft.github.io/language-server-protocol/specification.
+
+package appspeclsp
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "strconv"
+  "strings"
+)
+
+const (
+  kJsonRpcVersion      string = "2.0"
+  kContentLengthHeader string = "Content-Length"
+
+  // JSON-RPC error codes.
+  kErrorInvalidRequest int = -32600
+  kErrorMethodNotFound int = -32601
+  kErrorInvalidParams  int = -32602
+
+  // Text documents are always synced in full.
+  kTextDocumentSyncFull int = 1
+
+  kDiagnosticSeverityError   int = 1
+  kDiagnosticSeverityWarning int = 2
+
+  kCompletionItemKindProperty int = 10
+  kCompletionItemKindValue    int = 12
+
+  kMarkupKindMarkdown string = "markdown"
+  kCodeActionQuickFix string = "quickfix"
+)
+
+// rpcMessage is a JSON-RPC request, notification or response. Notifications
+// have no id.
+type rpcMessage struct {
+  Jsonrpc string           `json:"jsonrpc"`
+  Id      *json.RawMessage `json:"id,omitempty"`
+  Method  string           `json:"method,omitempty"`
+  Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+// rpcResponse is the response to a successful request. The result is always
+// present, null included.
+type rpcResponse struct {
+  Jsonrpc string           `json:"jsonrpc"`
+  Id      *json.RawMessage `json:"id"`
+  Result  interface{}      `json:"result"`
+}
+
+// rpcErrorResponse is the response to a failed request.
+type rpcErrorResponse struct {
+  Jsonrpc string           `json:"jsonrpc"`
+  Id      *json.RawMessage `json:"id"`
+  Error   *rpcError        `json:"error"`
+}
+
+type rpcError struct {
+  Code    int    `json:"code"`
+  Message string `json:"message"`
+}
+
+func (err *rpcError) Error() string {
+  return err.Message
+}
+
+// Reads the next message from reader. Each message is a JSON body preceded by
+// headers, of which only Content-Length is used.
+func readMessage(reader *bufio.Reader) (*rpcMessage, error) {
+  contentLength := -1
+  for {
+    header, err := reader.ReadString('\n')
+    if err != nil {
+      return nil, err
+    }
+    header = strings.TrimRight(header, "\r\n")
+    if header == "" {
+      break
+    }
+    nameValue := strings.SplitN(header, ":", 2)
+    if len(nameValue) == 2 &&
+      strings.EqualFold(strings.TrimSpace(nameValue[0]), kContentLengthHeader) {
+      contentLength, err = strconv.Atoi(strings.TrimSpace(nameValue[1]))
+      if err != nil {
+        return nil, fmt.Errorf("Invalid %s header %s.", kContentLengthHeader,
+          nameValue[1])
+      }
+    }
+  }
+  if contentLength < 0 {
+    return nil, errors.New("Message without " + kContentLengthHeader +
+      " header.")
+  }
+
+  body := make([]byte, contentLength)
+  if _, err := io.ReadFull(reader, body); err != nil {
+    return nil, err
+  }
+  message := &rpcMessage{}
+  if err := json.Unmarshal(body, message); err != nil {
+    return nil, fmt.Errorf("Invalid message. %v", err)
+  }
+  return message, nil
+}
+
+// Writes message to writer with its Content-Length header.
+func writeMessage(writer io.Writer, message interface{}) error {
+  body, err := json.Marshal(message)
+  if err != nil {
+    return err
+  }
+  _, err = fmt.Fprintf(writer, "%s: %d\r\n\r\n%s", kContentLengthHeader,
+    len(body), body)
+  return err
+}
+
+// The LSP structures used by the server. Fields the server does not need are
+// left out.
+
+type Position struct {
+  Line      int `json:"line"`
+  Character int `json:"character"`
+}
+
+type Range struct {
+  Start Position `json:"start"`
+  End   Position `json:"end"`
+}
+
+type TextDocumentIdentifier struct {
+  Uri string `json:"uri"`
+}
+
+type TextDocumentItem struct {
+  Uri        string `json:"uri"`
+  LanguageId string `json:"languageId"`
+  Version    int    `json:"version"`
+  Text       string `json:"text"`
+}
+
+type VersionedTextDocumentIdentifier struct {
+  Uri     string `json:"uri"`
+  Version int    `json:"version"`
+}
+
+type TextDocumentContentChangeEvent struct {
+  Text string `json:"text"`
+}
+
+type DidOpenTextDocumentParams struct {
+  TextDocument TextDocumentItem `json:"textDocument"`
+}
+
+type DidChangeTextDocumentParams struct {
+  TextDocument   VersionedTextDocumentIdentifier  `json:"textDocument"`
+  ContentChanges []TextDocumentContentChangeEvent `json:"contentChanges"`
+}
+
+type DidCloseTextDocumentParams struct {
+  TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+type TextDocumentPositionParams struct {
+  TextDocument TextDocumentIdentifier `json:"textDocument"`
+  Position     Position               `json:"position"`
+}
+
+type Diagnostic struct {
+  Range    Range  `json:"range"`
+  Severity int    `json:"severity"`
+  Code     string `json:"code,omitempty"`
+  Source   string `json:"source"`
+  Message  string `json:"message"`
+}
+
+type PublishDiagnosticsParams struct {
+  Uri         string        `json:"uri"`
+  Diagnostics []*Diagnostic `json:"diagnostics"`
+}
+
+type MarkupContent struct {
+  Kind  string `json:"kind"`
+  Value string `json:"value"`
+}
+
+type Hover struct {
+  Contents MarkupContent `json:"contents"`
+  Range    *Range        `json:"range,omitempty"`
+}
+
+type CompletionItem struct {
+  Label         string         `json:"label"`
+  Kind          int            `json:"kind"`
+  Detail        string         `json:"detail,omitempty"`
+  Documentation *MarkupContent `json:"documentation,omitempty"`
+  InsertText    string         `json:"insertText,omitempty"`
+}
+
+type CompletionList struct {
+  IsIncomplete bool              `json:"isIncomplete"`
+  Items        []*CompletionItem `json:"items"`
+}
+
+type CodeActionContext struct {
+  Diagnostics []*Diagnostic `json:"diagnostics"`
+}
+
+type CodeActionParams struct {
+  TextDocument TextDocumentIdentifier `json:"textDocument"`
+  Range        Range                  `json:"range"`
+  Context      CodeActionContext      `json:"context"`
+}
+
+type TextEdit struct {
+  Range   Range  `json:"range"`
+  NewText string `json:"newText"`
+}
+
+type WorkspaceEdit struct {
+  Changes map[string][]*TextEdit `json:"changes"`
+}
+
+type CodeAction struct {
+  Title       string         `json:"title"`
+  Kind        string         `json:"kind"`
+  Diagnostics []*Diagnostic  `json:"diagnostics,omitempty"`
+  IsPreferred bool           `json:"isPreferred,omitempty"`
+  Edit        *WorkspaceEdit `json:"edit"`
+}
+
+type CompletionOptions struct {
+  TriggerCharacters []string `json:"triggerCharacters,omitempty"`
+}
+
+type ServerCapabilities struct {
+  TextDocumentSync   int                `json:"textDocumentSync"`
+  HoverProvider      bool               `json:"hoverProvider"`
+  CompletionProvider *CompletionOptions `json:"completionProvider"`
+  CodeActionProvider bool               `json:"codeActionProvider"`
+}
+
+type ServerInfo struct {
+  Name string `json:"name"`
+}
+
+type InitializeResult struct {
+  Capabilities ServerCapabilities `json:"capabilities"`
+  ServerInfo   ServerInfo         `json:"serverInfo"`
+}
@@ -0,0 +1,278 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file implements the appspec language server. It keeps the text of the
+// open appspecs, validates them on every change and answers hover, completion
+// and code action requests.
+
+package appspeclsp
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "strings"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
+)
+
+const (
+  kServerName       string = "appspec-lsp"
+  kDiagnosticSource string = "appspec"
+)
+
+var (
+  // Returned by Run when the client exits without shutting the server down.
+  ErrExitWithoutShutdown = errors.New("Exit before shutdown.")
+)
+
+// Server is a language server for appspec files. It serves a single client.
+type Server struct {
+  validator *appspecvalidator.Validator
+  // Schema used for hover documentation and completion.
+  schema *appspecvalidator.Schema
+  // Text of the open documents, keyed by uri.
+  documents map[string]string
+  writer    io.Writer
+  // First error writing a notification to the client, which ends Run.
+  writeErr  error
+  shutdown  bool
+}
+
+// NewServer returns a Server which validates appspecs with validator.
+func NewServer(validator *appspecvalidator.Validator) *Server {
+  return &Server{
+    validator: validator,
+    schema:    appspecvalidator.GenerateSchema(),
+    documents: make(map[string]string),
+  }
+}
+
+// Run serves the client reading requests from reader and writing responses
+// to writer, until the client exits.
+func (server *Server) Run(reader io.Reader, writer io.Writer) error {
+  server.writer = writer
+  bufferedReader := bufio.NewReader(reader)
+  for {
+    message, err := readMessage(bufferedReader)
+    if err == io.EOF {
+      return ErrExitWithoutShutdown
+    }
+    if err != nil {
+      return err
+    }
+    if message.Method == "exit" {
+      if !server.shutdown {
+        return ErrExitWithoutShutdown
+      }
+      return nil
+    }
+
+    result, rpcErr := server.handle(message)
+    if server.writeErr != nil {
+      return server.writeErr
+    }
+    if message.Id == nil {
+      // Notifications have no response.
+      continue
+    }
+    if rpcErr != nil {
+      err = writeMessage(writer, &rpcErrorResponse{
+        Jsonrpc: kJsonRpcVersion,
+        Id:      message.Id,
+        Error:   rpcErr,
+      })
+    } else {
+      err = writeMessage(writer, &rpcResponse{
+        Jsonrpc: kJsonRpcVersion,
+        Id:      message.Id,
+        Result:  result,
+      })
+    }
+    if err != nil {
+      return err
+    }
+  }
+}
+
+// Decodes the params of a message into params.
+func decodeParams(message *rpcMessage, params interface{}) *rpcError {
+  if err := json.Unmarshal(message.Params, params); err != nil {
+    return &rpcError{Code: kErrorInvalidParams,
+      Message: fmt.Sprintf("Invalid params for %s. %v", message.Method, err)}
+  }
+  return nil
+}
+
+// Handles a request or notification and returns the result of a request.
+func (server *Server) handle(message *rpcMessage) (interface{}, *rpcError) {
+  if server.shutdown {
+    return nil, &rpcError{Code: kErrorInvalidRequest,
+      Message: "Server is shut down."}
+  }
+
+  switch message.Method {
+  case "initialize":
+    return &InitializeResult{
+      Capabilities: ServerCapabilities{
+        TextDocumentSync:   kTextDocumentSyncFull,
+        HoverProvider:      true,
+        CompletionProvider: &CompletionOptions{
+          TriggerCharacters: []string{":"},
+        },
+        CodeActionProvider: true,
+      },
+      ServerInfo: ServerInfo{Name: kServerName},
+    }, nil
+
+  case "shutdown":
+    server.shutdown = true
+    return nil, nil
+
+  case "textDocument/didOpen":
+    params := &DidOpenTextDocumentParams{}
+    if rpcErr := decodeParams(message, params); rpcErr != nil {
+      return nil, rpcErr
+    }
+    server.updateDocument(params.TextDocument.Uri, params.TextDocument.Text)
+    return nil, nil
+
+  case "textDocument/didChange":
+    params := &DidChangeTextDocumentParams{}
+    if rpcErr := decodeParams(message, params); rpcErr != nil {
+      return nil, rpcErr
+    }
+    if len(params.ContentChanges) == 0 {
+      return nil, nil
+    }
+    // With full sync, the last change holds the whole text.
+    text := params.ContentChanges[len(params.ContentChanges)-1].Text
+    server.updateDocument(params.TextDocument.Uri, text)
+    return nil, nil
+
+  case "textDocument/didClose":
+    params := &DidCloseTextDocumentParams{}
+    if rpcErr := decodeParams(message, params); rpcErr != nil {
+      return nil, rpcErr
+    }
+    delete(server.documents, params.TextDocument.Uri)
+    server.publishDiagnostics(params.TextDocument.Uri, []*Diagnostic{})
+    return nil, nil
+
+  case "textDocument/hover":
+    params := &TextDocumentPositionParams{}
+    if rpcErr := decodeParams(message, params); rpcErr != nil {
+      return nil, rpcErr
+    }
+    return server.hover(params), nil
+
+  case "textDocument/completion":
+    params := &TextDocumentPositionParams{}
+    if rpcErr := decodeParams(message, params); rpcErr != nil {
+      return nil, rpcErr
+    }
+    return server.complete(params), nil
+
+  case "textDocument/codeAction":
+    params := &CodeActionParams{}
+    if rpcErr := decodeParams(message, params); rpcErr != nil {
+      return nil, rpcErr
+    }
+    return server.codeActions(params), nil
+  }
+
+  if message.Id != nil {
+    return nil, &rpcError{Code: kErrorMethodNotFound,
+      Message: fmt.Sprintf("Method %s not supported.", message.Method)}
+  }
+  // Other notifications, e.g. initialized, need no handling.
+  return nil, nil
+}
+
+// Stores the new text of the document at uri and publishes its diagnostics.
+func (server *Server) updateDocument(uri string, text string) {
+  server.documents[uri] = text
+  server.publishDiagnostics(uri, server.diagnostics(text))
+}
+
+// Sends the diagnostics of the document at uri to the client.
+func (server *Server) publishDiagnostics(uri string,
+  diagnostics []*Diagnostic) {
+  if server.writeErr != nil {
+    return
+  }
+  server.writeErr = writeMessage(server.writer, &rpcMessage{
+    Jsonrpc: kJsonRpcVersion,
+    Method:  "textDocument/publishDiagnostics",
+    Params: mustMarshal(&PublishDiagnosticsParams{
+      Uri:         uri,
+      Diagnostics: diagnostics,
+    }),
+  })
+}
+
+// Returns value as JSON. Only used for the structures of this package, which
+// always marshal.
+func mustMarshal(value interface{}) json.RawMessage {
+  data, err := json.Marshal(value)
+  if err != nil {
+    panic(err)
+  }
+  return data
+}
+
+// Validates text and returns its findings.
+func (server *Server) findings(text string) appspecvalidator.Findings {
+  findings, err := server.validator.Validate(strings.NewReader(text))
+  if err != nil {
+    // Reading from a string does not fail.
+    return nil
+  }
+  return findings
+}
+
+// Returns the diagnostics of the appspec text.
+func (server *Server) diagnostics(text string) []*Diagnostic {
+  lines := splitLines(text)
+  diagnostics := make([]*Diagnostic, 0)
+  for _, finding := range server.findings(text) {
+    diagnostics = append(diagnostics, findingDiagnostic(finding, lines))
+  }
+  return diagnostics
+}
+
+// Returns the diagnostic reporting finding in the document made of lines.
+func findingDiagnostic(finding *appspecvalidator.Finding,
+  lines []string) *Diagnostic {
+  message := finding.Message
+  if finding.Field != "" {
+    message = finding.Field + ": " + message
+  }
+  severity := kDiagnosticSeverityError
+  if finding.Severity == appspecvalidator.SeverityWarning {
+    severity = kDiagnosticSeverityWarning
+  }
+  return &Diagnostic{
+    Range:    findingRange(finding, lines),
+    Severity: severity,
+    Code:     finding.Rule,
+    Source:   kDiagnosticSource,
+    Message:  message,
+  }
+}
+
+// Returns the range of the node a finding is about. Findings without a
+// position are reported at the start of the document.
+func findingRange(finding *appspecvalidator.Finding, lines []string) Range {
+  if finding.Line < 1 || finding.Line > len(lines) {
+    return Range{}
+  }
+  line := lines[finding.Line-1]
+  start, end := tokenBounds(line, runeByteOffset(line, finding.Column-1))
+  return Range{
+    Start: Position{Line: finding.Line - 1,
+      Character: utf16Length(line[:start])},
+    End: Position{Line: finding.Line - 1, Character: utf16Length(line[:end])},
+  }
+}
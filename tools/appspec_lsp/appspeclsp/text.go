@@ -0,0 +1,191 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file locates the appspec fields in the text of a document. An appspec
+// being edited is often not valid YAML, so fields are found from the
+// indentation of the lines rather than by parsing the document.
+
+package appspeclsp
+
+import (
+  "regexp"
+  "strings"
+  "unicode/utf16"
+  "unicode/utf8"
+)
+
+const (
+  kDocumentSeparator string = "---"
+  // Path element of the items of a list.
+  kListItem string = "[]"
+)
+
+var (
+  // Matches a line holding a key in block style, optionally as the first key
+  // of a list item.
+  keyLineRegexp = regexp.MustCompile(
+    `^( *)(- +)?([A-Za-z_][A-Za-z0-9_./-]*) *:( |$)`)
+  // Matches the start of a line which is being typed in place of a key.
+  partialKeyRegexp = regexp.MustCompile(
+    `^( *)(- +)?([A-Za-z_][A-Za-z0-9_./-]*)?$`)
+  // Matches the start of a line up to the value being typed after a key.
+  partialValueRegexp = regexp.MustCompile(
+    `^( *)(- +)?([A-Za-z_][A-Za-z0-9_./-]*) *: *(["']?)([^ "']*)$`)
+  // Matches the kind of an object.
+  kindLineRegexp = regexp.MustCompile(`^kind: *["']?([A-Za-z]+)`)
+)
+
+// Returns the lines of text, without line endings.
+func splitLines(text string) []string {
+  lines := strings.Split(text, "\n")
+  for i, line := range lines {
+    lines[i] = strings.TrimSuffix(line, "\r")
+  }
+  return lines
+}
+
+// Returns the byte offset in line of the rune at index runeIndex.
+func runeByteOffset(line string, runeIndex int) int {
+  offset := 0
+  for i := 0; i < runeIndex && offset < len(line); i++ {
+    _, size := utf8.DecodeRuneInString(line[offset:])
+    offset += size
+  }
+  return offset
+}
+
+// Returns the length of text in UTF-16 code units, in which LSP positions
+// count characters.
+func utf16Length(text string) int {
+  return len(utf16.Encode([]rune(text)))
+}
+
+// Returns the byte offset in line of the LSP character position character.
+func utf16ByteOffset(line string, character int) int {
+  units := 0
+  for offset, char := range line {
+    if units >= character {
+      return offset
+    }
+    units += len(utf16.Encode([]rune{char}))
+  }
+  return len(line)
+}
+
+// Returns the byte bounds of the YAML token starting at offset in line. A
+// quoted token ends with its quote, a plain one at a comment or the end of
+// the line.
+func tokenBounds(line string, offset int) (int, int) {
+  if offset >= len(line) {
+    return len(line), len(line)
+  }
+  if quote := line[offset]; quote == '"' || quote == '\'' {
+    end := strings.IndexByte(line[offset+1:], quote)
+    if end >= 0 {
+      return offset, offset + end + 2
+    }
+    return offset, len(line)
+  }
+  end := len(line)
+  if comment := strings.Index(line[offset:], " #"); comment >= 0 {
+    end = offset + comment
+  }
+  return offset, offset + len(strings.TrimRight(line[offset:end], " \t"))
+}
+
+// yamlKey is a key found on a line, see parseKeyLine.
+type yamlKey struct {
+  key string
+  // Column of the key, and of the dash before it if it starts a list item,
+  // or -1.
+  column     int
+  dashColumn int
+}
+
+// Returns the key the match of keyLineRegexp, partialKeyRegexp or
+// partialValueRegexp holds. The match must have the indentation, the dash
+// and the key as its first three groups.
+func matchedKey(line string, match []int) *yamlKey {
+  key := &yamlKey{column: match[3], dashColumn: -1}
+  if match[4] >= 0 {
+    key.dashColumn = match[4]
+    key.column = match[5]
+  }
+  if match[6] >= 0 {
+    key.key = line[match[6]:match[7]]
+  }
+  return key
+}
+
+// Returns the key on line, or nil if it holds none.
+func parseKeyLine(line string) *yamlKey {
+  match := keyLineRegexp.FindStringSubmatchIndex(line)
+  if match == nil {
+    return nil
+  }
+  return matchedKey(line, match)
+}
+
+// Returns the path of key, found on line lineIndex of lines, from the root of
+// its object. Keys are the elements of the path, and the items of lists are
+// kListItem.
+func keyPath(lines []string, lineIndex int, key *yamlKey) []string {
+  path := []string{key.key}
+  // The parent is the closest key above which is less indented than limit,
+  // or no more indented if limit is the dash of a list item.
+  limit := key.column
+  inList := false
+  if key.dashColumn >= 0 {
+    path = append([]string{kListItem}, path...)
+    limit = key.dashColumn
+    inList = true
+  }
+  for i := lineIndex - 1; i >= 0 && (inList || limit > 0); i-- {
+    if strings.HasPrefix(lines[i], kDocumentSeparator) {
+      break
+    }
+    parent := parseKeyLine(lines[i])
+    if parent == nil {
+      continue
+    }
+    if inList && parent.dashColumn == limit {
+      // Another item of the same list.
+      continue
+    }
+    if !inList && parent.dashColumn >= 0 && parent.column == limit {
+      // The first key of the list item the key belongs to.
+      path = append([]string{kListItem}, path...)
+      limit = parent.dashColumn
+      inList = true
+      continue
+    }
+    if parent.column < limit || inList && parent.column == limit {
+      path = append([]string{parent.key}, path...)
+      limit = parent.column
+      inList = false
+      if parent.dashColumn >= 0 {
+        path = append([]string{kListItem}, path...)
+        limit = parent.dashColumn
+        inList = true
+      }
+    }
+  }
+  return path
+}
+
+// Returns the kind of the object the line lineIndex of lines belongs to, or
+// "" if it is not known.
+func objectKind(lines []string, lineIndex int) string {
+  start := lineIndex
+  for start > 0 && !strings.HasPrefix(lines[start], kDocumentSeparator) {
+    start--
+  }
+  for i := start; i < len(lines); i++ {
+    if i > start && strings.HasPrefix(lines[i], kDocumentSeparator) {
+      break
+    }
+    if match := kindLineRegexp.FindStringSubmatch(lines[i]); match != nil {
+      return match[1]
+    }
+  }
+  return ""
+}
@@ -0,0 +1,441 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This package parses and validates the app.json metadata which is packaged
+// with the appspec of an app, and checks it against the appspec.
+
+package appmetadata
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "regexp"
+  "sort"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/field_path"
+)
+
+const (
+  kIdKeyWord                 string = "id"
+  kNameKeyWord               string = "name"
+  kVersionKeyWord            string = "version"
+  kDevVersionKeyWord         string = "dev_version"
+  kDescriptionKeyWord        string = "description"
+  kAccessRequirementsKeyWord string = "access_requirements"
+  kReadAccessKeyWord         string = "read_access"
+  kReadWriteAccessKeyWord    string = "read_write_access"
+  kManagementAccessKeyWord   string = "management_access"
+)
+
+var (
+  // A dev_version is one to three dot separated numbers, e.g. 1, 1.0 or 1.2.3.
+  devVersionRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,2}$`)
+
+  // The keys of the metadata in the order they are validated.
+  metadataKeys = []string{
+    kIdKeyWord,
+    kNameKeyWord,
+    kVersionKeyWord,
+    kDevVersionKeyWord,
+    kDescriptionKeyWord,
+    kAccessRequirementsKeyWord,
+  }
+  accessRequirementsKeys = []string{
+    kReadAccessKeyWord,
+    kReadWriteAccessKeyWord,
+    kManagementAccessKeyWord,
+  }
+)
+
+type AccessRequirements struct {
+  ReadAccess       *bool `json:"read_access"`
+  ReadWriteAccess  *bool `json:"read_write_access"`
+  ManagementAccess *bool `json:"management_access"`
+}
+
+// AppMetadata is the content of app.json.
+type AppMetadata struct {
+  Id      *int    `json:"id"`
+  Name    *string `json:"name"`
+  Version *int    `json:"version"`
+  // The developer version, which may be written as a number like 1.0 or a
+  // string like "1.2.3". It is kept as written.
+  DevVersion         *string             `json:"dev_version"`
+  Description        *string             `json:"description"`
+  AccessRequirements *AccessRequirements `json:"access_requirements"`
+}
+
+// HasReadAccess returns true if the app may read views.
+func (metadata *AppMetadata) HasReadAccess() bool {
+  access := metadata.AccessRequirements
+  return access != nil && (access.ReadAccess != nil && *access.ReadAccess ||
+    access.ReadWriteAccess != nil && *access.ReadWriteAccess)
+}
+
+// HasReadWriteAccess returns true if the app may write to views.
+func (metadata *AppMetadata) HasReadWriteAccess() bool {
+  access := metadata.AccessRequirements
+  return access != nil && access.ReadWriteAccess != nil &&
+    *access.ReadWriteAccess
+}
+
+// metadataRun holds the state of a single validation of an app.json.
+type metadataRun struct {
+  file string
+  data []byte
+  // Maps the field paths of app.json to the offset of their key.
+  offsets  map[string]int64
+  findings appspecvalidator.Findings
+}
+
+// Records a finding about the given field of app.json.
+func (run *metadataRun) addFinding(severity appspecvalidator.Severity,
+  field string, format string, args ...interface{}) {
+  offset, ok := run.offsets[field]
+  for !ok && field != "" {
+    field = fieldpath.Parent(field)
+    offset, ok = run.offsets[field]
+  }
+  run.addAtOffset(severity, field, offset, format, args...)
+}
+
+// Records a finding at the given offset of app.json.
+func (run *metadataRun) addAtOffset(severity appspecvalidator.Severity,
+  field string, offset int64, format string, args ...interface{}) {
+  line, column := lineAndColumn(run.data, offset)
+  run.findings = append(run.findings, &appspecvalidator.Finding{
+    Severity: severity,
+    File:     run.file,
+    Line:     line,
+    Column:   column,
+    Field:    field,
+    Message:  fmt.Sprintf(format, args...),
+  })
+}
+
+// Records an error about the given field of app.json.
+func (run *metadataRun) add(field string, format string,
+  args ...interface{}) {
+  run.addFinding(appspecvalidator.SeverityError, field, format, args...)
+}
+
+// Records a warning about the given field of app.json.
+func (run *metadataRun) warn(field string, format string,
+  args ...interface{}) {
+  run.addFinding(appspecvalidator.SeverityWarning, field, format, args...)
+}
+
+// Returns the 1 based line and column of offset in data.
+func lineAndColumn(data []byte, offset int64) (int, int) {
+  if offset > int64(len(data)) {
+    offset = int64(len(data))
+  }
+  line := 1 + bytes.Count(data[:offset], []byte("\n"))
+  column := int(offset) - bytes.LastIndexByte(data[:offset], '\n')
+  return line, column
+}
+
+// Records in offsets the offset of the key of every object field of the JSON
+// value read next from decoder, which is found at path.
+func recordKeyOffsets(decoder *json.Decoder, path string,
+  offsets map[string]int64) error {
+  token, err := decoder.Token()
+  if err != nil {
+    return err
+  }
+  delim, ok := token.(json.Delim)
+  if !ok {
+    return nil
+  }
+  switch delim {
+  case '{':
+    for decoder.More() {
+      keyToken, err := decoder.Token()
+      if err != nil {
+        return err
+      }
+      key, _ := keyToken.(string)
+      quotedKey, _ := json.Marshal(key)
+      keyPath := fieldpath.Join(path, key)
+      offsets[keyPath] = decoder.InputOffset() - int64(len(quotedKey))
+      if err = recordKeyOffsets(decoder, keyPath, offsets); err != nil {
+        return err
+      }
+    }
+  case '[':
+    for i := 0; decoder.More(); i++ {
+      elementPath := fieldpath.Index(path, i)
+      if err = recordKeyOffsets(decoder, elementPath, offsets); err != nil {
+        return err
+      }
+    }
+  }
+  // Consume the closing delimiter.
+  _, err = decoder.Token()
+  return err
+}
+
+// Decodes raw into value, using json.Number for numbers.
+func decodeRaw(raw json.RawMessage, value interface{}) error {
+  decoder := json.NewDecoder(bytes.NewReader(raw))
+  decoder.UseNumber()
+  return decoder.Decode(value)
+}
+
+// Decodes the integer field of app.json at path.
+func (run *metadataRun) decodeInt(raw json.RawMessage, path string) *int {
+  var number json.Number
+  // A JSON string holding a number also decodes into json.Number.
+  isString := len(raw) > 0 && raw[0] == '"'
+  if err := decodeRaw(raw, &number); err == nil && !isString {
+    if value, err := number.Int64(); err == nil {
+      intValue := int(value)
+      return &intValue
+    }
+  }
+  run.add(path, "Field %s must be an integer, got %s.", path, raw)
+  return nil
+}
+
+// Decodes the string field of app.json at path.
+func (run *metadataRun) decodeString(raw json.RawMessage,
+  path string) *string {
+  var value string
+  if err := decodeRaw(raw, &value); err != nil {
+    run.add(path, "Field %s must be a string, got %s.", path, raw)
+    return nil
+  }
+  return &value
+}
+
+// Decodes the boolean field of app.json at path.
+func (run *metadataRun) decodeBool(raw json.RawMessage, path string) *bool {
+  var value bool
+  if err := decodeRaw(raw, &value); err != nil {
+    run.add(path, "Field %s must be true or false, got %s.", path, raw)
+    return nil
+  }
+  return &value
+}
+
+// Decodes the version field of app.json at path, which may be a number or a
+// string.
+func (run *metadataRun) decodeVersion(raw json.RawMessage,
+  path string) *string {
+  var value interface{}
+  if err := decodeRaw(raw, &value); err == nil {
+    switch version := value.(type) {
+    case json.Number:
+      versionStr := version.String()
+      return &versionStr
+    case string:
+      return &version
+    }
+  }
+  run.add(path, "Field %s must be a number or a string, got %s.", path, raw)
+  return nil
+}
+
+// Decodes the JSON object at path into a map of its fields. Keys which are
+// not in knownKeys are reported.
+func (run *metadataRun) decodeObject(raw json.RawMessage, path string,
+  knownKeys []string) map[string]json.RawMessage {
+  var fields map[string]json.RawMessage
+  if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+    if path == "" {
+      run.add(path, "App metadata must be a JSON object.")
+    } else {
+      run.add(path, "Field %s must be an object.", path)
+    }
+    return nil
+  }
+
+  unknownKeys := make([]string, 0)
+  for key := range fields {
+    known := false
+    for _, knownKey := range knownKeys {
+      known = known || key == knownKey
+    }
+    if !known {
+      unknownKeys = append(unknownKeys, key)
+    }
+  }
+  sort.Strings(unknownKeys)
+  for _, key := range unknownKeys {
+    keyPath := fieldpath.Join(path, key)
+    suggestion := appspecvalidator.SuggestField(key, knownKeys)
+    if suggestion != "" {
+      run.warn(keyPath, "Unknown field %s, did you mean %s?", key, suggestion)
+    } else {
+      run.warn(keyPath, "Unknown field %s.", key)
+    }
+  }
+  return fields
+}
+
+// Decodes and validates the whole app.json.
+func (run *metadataRun) validateMetadata() *AppMetadata {
+  fields := run.decodeObject(run.data, "", metadataKeys)
+  if fields == nil {
+    return nil
+  }
+
+  metadata := &AppMetadata{}
+  for _, key := range metadataKeys {
+    raw, ok := fields[key]
+    if !ok {
+      run.add("", "Field %s missing.", key)
+      continue
+    }
+    switch key {
+    case kIdKeyWord:
+      metadata.Id = run.decodeInt(raw, key)
+      if metadata.Id != nil && *metadata.Id <= 0 {
+        run.add(key, "Field %s must be positive.", key)
+      }
+    case kNameKeyWord:
+      metadata.Name = run.decodeString(raw, key)
+      if metadata.Name != nil && *metadata.Name == "" {
+        run.add(key, "Field %s must not be empty.", key)
+      }
+    case kVersionKeyWord:
+      metadata.Version = run.decodeInt(raw, key)
+      if metadata.Version != nil && *metadata.Version <= 0 {
+        run.add(key, "Field %s must be positive.", key)
+      }
+    case kDevVersionKeyWord:
+      metadata.DevVersion = run.decodeVersion(raw, key)
+      if metadata.DevVersion != nil &&
+        !devVersionRegexp.MatchString(*metadata.DevVersion) {
+        run.add(key, "Invalid %s %s, expected a version like 1.0 or 1.2.3.",
+          key, *metadata.DevVersion)
+      }
+    case kDescriptionKeyWord:
+      metadata.Description = run.decodeString(raw, key)
+      if metadata.Description != nil && *metadata.Description == "" {
+        run.add(key, "Field %s must not be empty.", key)
+      }
+    case kAccessRequirementsKeyWord:
+      metadata.AccessRequirements = run.validateAccessRequirements(raw, key)
+    }
+  }
+  return metadata
+}
+
+// Decodes and validates the access_requirements of app.json found at path.
+func (run *metadataRun) validateAccessRequirements(raw json.RawMessage,
+  path string) *AccessRequirements {
+  fields := run.decodeObject(raw, path, accessRequirementsKeys)
+  if fields == nil {
+    return nil
+  }
+  access := &AccessRequirements{}
+  for _, key := range accessRequirementsKeys {
+    keyPath := fieldpath.Join(path, key)
+    raw, ok := fields[key]
+    if !ok {
+      run.add(path, "Field %s missing.", keyPath)
+      continue
+    }
+    value := run.decodeBool(raw, keyPath)
+    switch key {
+    case kReadAccessKeyWord:
+      access.ReadAccess = value
+    case kReadWriteAccessKeyWord:
+      access.ReadWriteAccess = value
+    case kManagementAccessKeyWord:
+      access.ManagementAccess = value
+    }
+  }
+  return access
+}
+
+// Validates that the access requirements of the metadata allow what the
+// objects of the appspec need.
+func (run *metadataRun) crossCheck(metadata *AppMetadata,
+  documents []*appspecvalidator.Document) {
+  readWritePath := fieldpath.Join(kAccessRequirementsKeyWord,
+    kReadWriteAccessKeyWord)
+  readPath := fieldpath.Join(kAccessRequirementsKeyWord, kReadAccessKeyWord)
+  for _, document := range documents {
+    // The cleanup job removes what the app has written when the app is
+    // uninstalled.
+    if document.IsCleanupJob() && !metadata.HasReadWriteAccess() {
+      run.add(readWritePath, "The appspec has the cleanup Job %s, which "+
+        "needs %s.", document.Name(), kReadWriteAccessKeyWord)
+    }
+
+    spec := document.AppSpec.Spec
+    if spec == nil || spec.Template == nil ||
+      spec.Template.TemplateSpec == nil {
+      continue
+    }
+    for _, volume := range spec.Template.TemplateSpec.Volumes {
+      if volume == nil || !volume.IsStatic() || metadata.HasReadAccess() {
+        continue
+      }
+      volumeName := ""
+      if volume.Name != nil {
+        volumeName = *volume.Name
+      }
+      run.add(readPath, "The %s %s mounts a view through the static volume "+
+        "%s, which needs %s or %s.", document.Kind(), document.Name(),
+        volumeName, kReadAccessKeyWord, kReadWriteAccessKeyWord)
+    }
+  }
+}
+
+// Validate parses and validates the app metadata read from reader. fileName
+// is only used to report the position of the findings. If documents is not
+// nil, the metadata is also checked against those objects of the appspec. The
+// error is set only if the metadata could not be read.
+func Validate(reader io.Reader, fileName string,
+  documents []*appspecvalidator.Document) (*AppMetadata,
+  appspecvalidator.Findings, error) {
+  data, err := ioutil.ReadAll(reader)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  run := &metadataRun{
+    file:    fileName,
+    data:    data,
+    offsets: map[string]int64{"": 0},
+  }
+  decoder := json.NewDecoder(bytes.NewReader(data))
+  err = recordKeyOffsets(decoder, "", run.offsets)
+  if err == nil && decoder.More() {
+    err = fmt.Errorf("unexpected data after the top level value")
+  }
+  if err != nil {
+    offset := decoder.InputOffset()
+    if syntaxErr, ok := err.(*json.SyntaxError); ok {
+      offset = syntaxErr.Offset
+    }
+    run.addAtOffset(appspecvalidator.SeverityError, "", offset,
+      "Error in parsing app metadata. %v", err)
+    return nil, run.findings, nil
+  }
+
+  metadata := run.validateMetadata()
+  if metadata != nil && documents != nil {
+    run.crossCheck(metadata, documents)
+  }
+  return metadata, run.findings, nil
+}
+
+// ValidateFile is like Validate but reads the app metadata from the file at
+// path.
+func ValidateFile(path string, documents []*appspecvalidator.Document) (
+  *AppMetadata, appspecvalidator.Findings, error) {
+  metadataFile, err := os.Open(path)
+  if err != nil {
+    return nil, nil, err
+  }
+  defer metadataFile.Close()
+  return Validate(metadataFile, path, documents)
+}
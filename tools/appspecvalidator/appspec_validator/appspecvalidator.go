@@ -5,47 +5,48 @@
 package appspecvalidator
 
 import (
-  "errors"
   "fmt"
+  "io"
   "os"
-  
-  "gopkg.in/yaml.v2"
+  "reflect"
+  "regexp"
+  "strconv"
+  "strings"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/field_path"
+  "gopkg.in/yaml.v3"
 )
 
 type Pair struct {
   appSpecKind, appSpecName interface{}
 }
 
+// These are never modified, so they are safe to share between concurrent
+// validations.
 var (
-  uniqueAppSpecObject    map[interface{}]bool
-  nodePortEnvVarMap      map[string]int
-  binarySIMap            map[string]bool
-  decimalSIMap           map[string]bool
-  cleanupJobEncountered  bool
-  uiNodePortEncountered  bool
-  uiNodePortEnvVar       string
-)
-
-func init() {
-  uiNodePortEncountered = false
-  cleanupJobEncountered = false
-  uniqueAppSpecObject = make(map[interface{}]bool)
-  nodePortEnvVarMap = make(map[string]int)
-  binarySIMap = map[string]bool{
-    "ki": true,
-    "Mi": true,
-    "Gi": true,
-    "Ti": true,
+  // Maps the binary suffixes of resource quantities to their power of 2.
+  binarySIMap = map[string]int{
+    "Ki": 10,
+    "Mi": 20,
+    "Gi": 30,
+    "Ti": 40,
+    "Pi": 50,
+    "Ei": 60,
   }
-  decimalSIMap = map[string]bool{
-    "m": true,
-    "" : true,
-    "K": true,
-    "M": true,
-    "G": true,
-    "T": true,
+  // Maps the decimal suffixes of resource quantities to their power of 10.
+  decimalSIMap = map[string]int{
+    "n": -9,
+    "u": -6,
+    "m": -3,
+    "":  0,
+    "k": 3,
+    "M": 6,
+    "G": 9,
+    "T": 12,
+    "P": 15,
+    "E": 18,
   }
-}
+)
 
 const (
   kCohesityTagKeyWord    string = "cohesityTag"
@@ -55,45 +56,214 @@ const (
   kVolumeTypeDynamic     string = "dynamic"
   kCohesityEnvKeyWord    string = "cohesityEnv"
   kBinarySIFormat        string = "BinarySI"
-  kDecimalSIFormal       string = "DecimalSI"
+  kDecimalSIFormat       string = "DecimalSI"
+  kDecimalExpFormat      string = "DecimalExponent"
+
+  // The document of the findings about the appspec as a whole.
+  kNoDocument int = -1
+
+  kResourceCpu              string = "cpu"
+  kResourceMemory           string = "memory"
+  kResourceEphemeralStorage string = "ephemeral-storage"
 )
 
+// The resources a container can request, in the order they are validated.
+var resourceNames = []string{
+  kResourceCpu,
+  kResourceMemory,
+  kResourceEphemeralStorage,
+}
+
 type VolumeMounts struct {
   Name      *string `yaml:"name"`
   MountPath *string `yaml:"mountPath"`
 }
 
 type Requests struct {
-  Cpu    *string `yaml:"cpu,omitempty"`
-  Memory *string `yaml:"memory,omitempty"`
+  Cpu              *string `yaml:"cpu,omitempty"`
+  Memory           *string `yaml:"memory,omitempty"`
+  EphemeralStorage *string `yaml:"ephemeral-storage,omitempty"`
 }
 
 type Resources struct {
-  Requests *Requests `yaml:"requests"`
+  Requests *Requests `yaml:"requests,omitempty"`
+  // Limits name the same resources as requests.
+  Limits *Requests `yaml:"limits,omitempty"`
+}
+
+// KeySelector selects a key of a ConfigMap or Secret of the appspec.
+type KeySelector struct {
+  Name     *string `yaml:"name"`
+  Key      *string `yaml:"key"`
+  Optional *bool   `yaml:"optional,omitempty"`
+}
+
+type EnvVarSource struct {
+  ConfigMapKeyRef *KeySelector `yaml:"configMapKeyRef,omitempty"`
+  SecretKeyRef    *KeySelector `yaml:"secretKeyRef,omitempty"`
 }
 
 type Env struct {
-  Name  *string `yaml:"name"`
-  Value *string `yaml:"value"`
+  Name *string `yaml:"name"`
+  // Exactly one of value and valueFrom is set.
+  Value     *string       `yaml:"value,omitempty"`
+  ValueFrom *EnvVarSource `yaml:"valueFrom,omitempty"`
+}
+
+// ObjectReference names a ConfigMap or Secret of the appspec.
+type ObjectReference struct {
+  Name     *string `yaml:"name"`
+  Optional *bool   `yaml:"optional,omitempty"`
+}
+
+// EnvFromSource sets a variable in the environment of a container for every
+// key of a ConfigMap or Secret.
+type EnvFromSource struct {
+  Prefix       *string          `yaml:"prefix,omitempty"`
+  ConfigMapRef *ObjectReference `yaml:"configMapRef,omitempty"`
+  SecretRef    *ObjectReference `yaml:"secretRef,omitempty"`
+}
+
+// IntOrString holds a field which can be either a number or a name, such as
+// the port of a probe. Exactly one of IntVal and StrVal is set.
+type IntOrString struct {
+  IntVal *int
+  StrVal *string
+}
+
+func (value *IntOrString) UnmarshalYAML(node *yaml.Node) error {
+  if node.Kind == yaml.ScalarNode && node.ShortTag() == "!!int" {
+    var intVal int
+    if err := node.Decode(&intVal); err != nil {
+      return err
+    }
+    value.IntVal = &intVal
+    return nil
+  }
+  var strVal string
+  if err := node.Decode(&strVal); err != nil {
+    return err
+  }
+  value.StrVal = &strVal
+  return nil
+}
+
+func (value IntOrString) MarshalYAML() (interface{}, error) {
+  if value.IntVal != nil {
+    return *value.IntVal, nil
+  }
+  if value.StrVal != nil {
+    return *value.StrVal, nil
+  }
+  return nil, nil
+}
+
+func (value *IntOrString) String() string {
+  if value.IntVal != nil {
+    return strconv.Itoa(*value.IntVal)
+  }
+  if value.StrVal != nil {
+    return *value.StrVal
+  }
+  return ""
+}
+
+type ContainerPort struct {
+  Name          *string `yaml:"name,omitempty"`
+  ContainerPort *int    `yaml:"containerPort"`
+  HostPort      *int    `yaml:"hostPort,omitempty"`
+  Protocol      *string `yaml:"protocol,omitempty"`
+}
+
+type ExecAction struct {
+  Command []string `yaml:"command"`
+}
+
+type HttpGetAction struct {
+  Path   *string      `yaml:"path,omitempty"`
+  Port   *IntOrString `yaml:"port"`
+  Scheme *string      `yaml:"scheme,omitempty"`
+}
+
+type TcpSocketAction struct {
+  Port *IntOrString `yaml:"port"`
+}
+
+type Probe struct {
+  Exec                *ExecAction      `yaml:"exec,omitempty"`
+  HttpGet             *HttpGetAction   `yaml:"httpGet,omitempty"`
+  TcpSocket           *TcpSocketAction `yaml:"tcpSocket,omitempty"`
+  InitialDelaySeconds *int             `yaml:"initialDelaySeconds,omitempty"`
+  PeriodSeconds       *int             `yaml:"periodSeconds,omitempty"`
+  TimeoutSeconds      *int             `yaml:"timeoutSeconds,omitempty"`
+  SuccessThreshold    *int             `yaml:"successThreshold,omitempty"`
+  FailureThreshold    *int             `yaml:"failureThreshold,omitempty"`
+}
+
+type Capabilities struct {
+  Add  []string `yaml:"add,omitempty"`
+  Drop []string `yaml:"drop,omitempty"`
+}
+
+type SecurityContext struct {
+  RunAsUser                *int          `yaml:"runAsUser,omitempty"`
+  RunAsGroup               *int          `yaml:"runAsGroup,omitempty"`
+  RunAsNonRoot             *bool         `yaml:"runAsNonRoot,omitempty"`
+  Privileged               *bool         `yaml:"privileged,omitempty"`
+  AllowPrivilegeEscalation *bool         `yaml:"allowPrivilegeEscalation,omitempty"`
+  ReadOnlyRootFilesystem   *bool         `yaml:"readOnlyRootFilesystem,omitempty"`
+  Capabilities             *Capabilities `yaml:"capabilities,omitempty"`
 }
 
 type ContainerSpec struct {
-  Name         *string         `yaml:"name"`
-  Image        *string         `yaml:"image"`
-  Resources    *Resources      `yaml:"resources,omitempty"`
-  VolumeMounts []*VolumeMounts `yaml:"volumeMounts,omitempty"`
-  Env          []*Env          `yaml:"env,omitempty"`
+  Name            *string          `yaml:"name"`
+  Image           *string          `yaml:"image"`
+  ImagePullPolicy *string          `yaml:"imagePullPolicy,omitempty"`
+  Command         []string         `yaml:"command,omitempty"`
+  Args            []string         `yaml:"args,omitempty"`
+  Ports           []*ContainerPort `yaml:"ports,omitempty"`
+  Resources       *Resources       `yaml:"resources,omitempty"`
+  VolumeMounts    []*VolumeMounts  `yaml:"volumeMounts,omitempty"`
+  EnvFrom         []*EnvFromSource `yaml:"envFrom,omitempty"`
+  Env             []*Env           `yaml:"env,omitempty"`
+  LivenessProbe   *Probe           `yaml:"livenessProbe,omitempty"`
+  ReadinessProbe  *Probe           `yaml:"readinessProbe,omitempty"`
+  SecurityContext *SecurityContext `yaml:"securityContext,omitempty"`
+}
+
+// KeyToPath projects a key of a ConfigMap or Secret to a file of a volume.
+type KeyToPath struct {
+  Key  *string `yaml:"key"`
+  Path *string `yaml:"path"`
+}
+
+type ConfigMapVolumeSource struct {
+  Name     *string      `yaml:"name"`
+  Items    []*KeyToPath `yaml:"items,omitempty"`
+  Optional *bool        `yaml:"optional,omitempty"`
+}
+
+type SecretVolumeSource struct {
+  SecretName *string      `yaml:"secretName"`
+  Items      []*KeyToPath `yaml:"items,omitempty"`
+  Optional   *bool        `yaml:"optional,omitempty"`
 }
 
+// VolumeSpec is either a Cohesity volume, given by its volumeType, or a
+// volume holding the keys of a ConfigMap or Secret of the appspec.
 type VolumeSpec struct {
-  Name       *string `yaml:"name"`
-  FsType     *string `yaml:"fsType"`
-  Type       *string `yaml:"volumeType"`
-  VolumeName *string `yaml:"volumeName"`
+  Name       *string                `yaml:"name"`
+  FsType     *string                `yaml:"fsType,omitempty"`
+  Type       *string                `yaml:"volumeType,omitempty"`
+  VolumeName *string                `yaml:"volumeName,omitempty"`
+  ConfigMap  *ConfigMapVolumeSource `yaml:"configMap,omitempty"`
+  Secret     *SecretVolumeSource    `yaml:"secret,omitempty"`
 }
 
 type Labels struct {
   App *string `yaml:"app"`
+  // Any labels other than app.
+  Other map[string]string `yaml:",inline"`
 }
 
 type Metadata struct {
@@ -102,13 +272,23 @@ type Metadata struct {
   CohesityTag *string `yaml:"cohesityTag,omitempty"`
 }
 
+type MatchExpression struct {
+  Key      *string  `yaml:"key"`
+  Operator *string  `yaml:"operator"`
+  Values   []string `yaml:"values,omitempty"`
+}
+
 type Selector struct {
-  MatchLabels *Labels `yaml:"matchLabels"`
+  MatchLabels      *Labels            `yaml:"matchLabels,omitempty"`
+  MatchExpressions []*MatchExpression `yaml:"matchExpressions,omitempty"`
+  // A Service lists the labels it selects directly under its selector.
+  Labels map[string]string `yaml:",inline"`
 }
 
 type TemplateSpec struct {
-  Containers []*ContainerSpec `yaml:"containers"`
-  Volumes    []*VolumeSpec    `yaml:"volumes,omitempty"`
+  Containers    []*ContainerSpec `yaml:"containers"`
+  Volumes       []*VolumeSpec    `yaml:"volumes,omitempty"`
+  RestartPolicy *string          `yaml:"restartPolicy,omitempty"`
 }
 
 type Template struct {
@@ -117,11 +297,14 @@ type Template struct {
 }
 
 type Ports struct {
-  Port        *int    `yaml:"port"`
-  Protocol    *string `yaml:"protocol"`
-  Name        *string `yaml:"name"`
-  CohesityTag *string `yaml:"cohesityTag,omitempty"`
-  CohesityEnv *string `yaml:"cohesityEnv,omitempty"`
+  Port     *int    `yaml:"port"`
+  Protocol *string `yaml:"protocol"`
+  Name     *string `yaml:"name"`
+  // The port of the selected pods the traffic goes to, by number or by the
+  // name of a container port. It is port if not set.
+  TargetPort  *IntOrString `yaml:"targetPort,omitempty"`
+  CohesityTag *string      `yaml:"cohesityTag,omitempty"`
+  CohesityEnv *string      `yaml:"cohesityEnv,omitempty"`
 }
 
 type Replicas struct {
@@ -131,14 +314,30 @@ type Replicas struct {
   Max   *int `yaml:"max,omitempty"`
 }
 
+// RollingUpdate bounds the pods a Deployment adds and removes at a time while
+// it is updated. Each bound is a number of pods or a percentage of the
+// replicas, e.g. 25%.
+type RollingUpdate struct {
+  MaxUnavailable *IntOrString `yaml:"maxUnavailable,omitempty"`
+  MaxSurge       *IntOrString `yaml:"maxSurge,omitempty"`
+}
+
+type DeploymentStrategy struct {
+  Type          *string        `yaml:"type,omitempty"`
+  RollingUpdate *RollingUpdate `yaml:"rollingUpdate,omitempty"`
+}
+
 type Spec struct {
-  Replicas    *Replicas `yaml:"replicas,omitempty"`
-  ServiceName *string   `yaml:"serviceName,omitempty"`
-  Selector    *Selector `yaml:"selector,omitempty"`
-  Type        *string   `yaml:"type,omitempty"`
-  ClusterIp   *string   `yaml:"clusterIp,omitempty"`
-  Ports       []*Ports  `yaml:"ports,omitempty"`
-  Template    *Template `yaml:"template,omitempty"`
+  Replicas              *Replicas           `yaml:"replicas,omitempty"`
+  ServiceName           *string             `yaml:"serviceName,omitempty"`
+  Strategy              *DeploymentStrategy `yaml:"strategy,omitempty"`
+  BackoffLimit          *int                `yaml:"backoffLimit,omitempty"`
+  ActiveDeadlineSeconds *int                `yaml:"activeDeadlineSeconds,omitempty"`
+  Selector              *Selector           `yaml:"selector,omitempty"`
+  Type                  *string             `yaml:"type,omitempty"`
+  ClusterIp             *string             `yaml:"clusterIp,omitempty"`
+  Ports                 []*Ports            `yaml:"ports,omitempty"`
+  Template              *Template           `yaml:"template,omitempty"`
 }
 
 type AppSpec struct {
@@ -146,254 +345,792 @@ type AppSpec struct {
   Kind       *string   `yaml:"kind"`
   Metadata   *Metadata `yaml:"metadata"`
   Spec       *Spec     `yaml:"spec"`
+  // The data of a ConfigMap or Secret, which have no spec. The values of the
+  // data of a Secret are base64 encoded, those of its stringData are not.
+  Data       map[string]string `yaml:"data,omitempty"`
+  StringData map[string]string `yaml:"stringData,omitempty"`
+  // Type of a Secret.
+  Type *string `yaml:"type,omitempty"`
+}
+
+// Document is a single object of an appspec along with the YAML it was
+// decoded from.
+type Document struct {
+  // Zero based index of the document in the appspec.
+  Index   int
+  AppSpec *AppSpec
+  // Root node of the document.
+  Node *yaml.Node
+  // Maps the field paths of the document to their nodes.
+  nodes map[string]*yaml.Node
+  // Maps the field paths of the document to the lint rules ignored there by
+  // comments.
+  ignores map[string]map[string]bool
+}
+
+// Kind returns the kind of the object, or "" if it is not set.
+func (document *Document) Kind() string {
+  if document.AppSpec.Kind == nil {
+    return ""
+  }
+  return *document.AppSpec.Kind
+}
+
+// Name returns the name of the object, or "" if it is not set.
+func (document *Document) Name() string {
+  metadata := document.AppSpec.Metadata
+  if metadata == nil || metadata.Name == nil {
+    return ""
+  }
+  return *metadata.Name
+}
+
+// Pair returns the kind and name of the object, which identify it within an
+// appspec.
+func (document *Document) Pair() Pair {
+  return Pair{document.Kind(), document.Name()}
+}
+
+// IsWorkload returns true if the object runs pods from a template.
+func (document *Document) IsWorkload() bool {
+  return kindOf(document.Kind()).Workload
+}
+
+// IsCleanupJob returns true if the object is a Job tagged as the cleanup job
+// of the app.
+func (document *Document) IsCleanupJob() bool {
+  metadata := document.AppSpec.Metadata
+  return document.Kind() == "Job" && metadata != nil &&
+    metadata.CohesityTag != nil && *metadata.CohesityTag == kCohesityCleanupTag
+}
+
+// IsConfig returns true if the object holds configuration for the containers,
+// i.e. it is a ConfigMap or a Secret.
+func (document *Document) IsConfig() bool {
+  return kindOf(document.Kind()).Config
+}
+
+// Containers returns the containers of the pod template of a workload, or nil
+// if the object has none. The container at index i is at the field
+// spec.template.spec.containers[i].
+func (document *Document) Containers() []*ContainerSpec {
+  spec := document.AppSpec.Spec
+  if !document.IsWorkload() || spec == nil || spec.Template == nil ||
+    spec.Template.TemplateSpec == nil {
+    return nil
+  }
+  return spec.Template.TemplateSpec.Containers
+}
+
+// IsStatic returns true if the volume is a static volume, i.e. it refers to
+// an existing view by its volumeName.
+func (volume *VolumeSpec) IsStatic() bool {
+  return volume.Type != nil && *volume.Type == kVolumeTypeStatic
+}
+
+// IsUi returns true if the port is tagged as the node port serving the UI of
+// the app.
+func (port *Ports) IsUi() bool {
+  return port.CohesityTag != nil && *port.CohesityTag == kCohesityUiNodePortTag
+}
+
+// Count returns the number of pods to run on a cluster of the given number of
+// nodes: either the fixed count, or share pods per node bounded by min and
+// max. Without replicas, a single pod is run.
+func (replicas *Replicas) Count(nodes int) int {
+  if replicas == nil {
+    return 1
+  }
+  if replicas.Fixed != nil {
+    return *replicas.Fixed
+  }
+  count := 1
+  if replicas.Share != nil {
+    count = *replicas.Share * nodes
+  }
+  if replicas.Min != nil && count < *replicas.Min {
+    count = *replicas.Min
+  }
+  if replicas.Max != nil && count > *replicas.Max {
+    count = *replicas.Max
+  }
+  return count
+}
+
+// Severity tells whether a finding makes the appspec invalid.
+type Severity string
+
+const (
+  // SeverityError findings make the appspec invalid.
+  SeverityError Severity = "error"
+  // SeverityWarning findings point out likely mistakes but the appspec is
+  // still accepted.
+  SeverityWarning Severity = "warning"
+)
+
+// Finding describes a single violation found while validating an appspec.
+type Finding struct {
+  Severity Severity `json:"severity"`
+  // Path of the appspec file, if known.
+  File string `json:"file,omitempty"`
+  // Line and column of the offending node in the appspec file. They are zero
+  // if the position is unknown.
+  Line   int `json:"line,omitempty"`
+  Column int `json:"column,omitempty"`
+  // Zero based index of the YAML document the finding belongs to, or -1 if
+  // the finding is about the appspec as a whole.
+  Document int `json:"document"`
+  // Kind and name of the object, if known.
+  Kind string `json:"kind,omitempty"`
+  Name string `json:"name,omitempty"`
+  // Path of the offending field within the document, e.g.
+  // spec.template.spec.containers[0].image.
+  Field string `json:"field,omitempty"`
+  // Description of the violation.
+  Message string `json:"message"`
+  // Id of the lint rule reporting the finding, if any.
+  Rule string `json:"rule,omitempty"`
+}
+
+// Location returns the position of the finding as file:line:column, the
+// format understood by editors and CI annotations. If the position is not
+// known, the document index, or the file for a finding about the appspec as a
+// whole, is returned instead.
+func (finding *Finding) Location() string {
+  if finding.Line == 0 && finding.Document == kNoDocument &&
+    finding.File != "" {
+    return finding.File
+  }
+  if finding.Line == 0 {
+    return fmt.Sprintf("document %d", finding.Document)
+  }
+  return fmt.Sprintf("%s:%d:%d", finding.File, finding.Line, finding.Column)
+}
+
+func (finding *Finding) Error() string {
+  errMsg := finding.Location()
+  if finding.Field != "" {
+    errMsg += " " + finding.Field
+  }
+  errMsg += ": "
+  if finding.Severity == SeverityWarning {
+    errMsg += "warning: "
+  }
+  errMsg += finding.Message
+  if finding.Kind != "" {
+    errMsg += fmt.Sprintf(" (%s %s)", finding.Kind, finding.Name)
+  }
+  if finding.Rule != "" {
+    errMsg += " [" + finding.Rule + "]"
+  }
+  return errMsg
+}
+
+// Findings is the list of all violations found in an appspec.
+type Findings []*Finding
+
+func (findings Findings) Error() string {
+  errMsgs := make([]string, 0, len(findings))
+  for _, finding := range findings {
+    errMsgs = append(errMsgs, finding.Error())
+  }
+  return strings.Join(errMsgs, "\n")
+}
+
+// HasErrors returns true if any of the findings makes the appspec invalid.
+func (findings Findings) HasErrors() bool {
+  for _, finding := range findings {
+    if finding.Severity == SeverityError {
+      return true
+    }
+  }
+  return false
+}
+
+// Validator parses and validates appspecs. The state of a validation is kept
+// per run, so a single Validator can be used to validate any number of
+// appspecs, including concurrently from multiple goroutines.
+type Validator struct {
+  // Maximum cpu and memory a single container may request. If not set, larger
+  // requests than defaultMaxCpu and defaultMaxMemory are only warned about.
+  MaxCpu    *Quantity
+  MaxMemory *Quantity
+  // If set, keys which are not part of the AppSpec model are reported instead
+  // of being ignored.
+  Strict bool
+  // If set, each object is also validated against the JSON Schema returned by
+  // GenerateSchema.
+  SchemaCheck bool
+  // If set, the cpu and memory requested by all the workloads together must
+  // fit in the budget.
+  Budget *Budget
+  // If not nil, the images shipped with the app, e.g. as returned by
+  // LoadImages. Every container must run one of them.
+  Images []*ShippedImage
+  // If not nil, the lint rules it enables are run, e.g. with the config
+  // returned by LoadLintConfigFile.
+  Lint *LintConfig
+}
+
+// NewValidator returns a Validator.
+func NewValidator() *Validator {
+  return &Validator{}
+}
+
+// validationRun holds the state of a single validation of an appspec.
+// document, kind and name identify the object currently being validated and
+// nodes maps the field paths of that object to their YAML nodes.
+type validationRun struct {
+  validator *Validator
+  file      string
+  document  int
+  kind      string
+  name      string
+  nodes     map[string]*yaml.Node
+  findings  Findings
+
+  // All the documents decoded so far.
+  documents []*Document
+
+  // State spanning all the documents of the appspec.
+  uniqueAppSpecObject   map[Pair]bool
+  nodePortEnvVarMap     map[string]int
+  cleanupJobEncountered bool
+  uiNodePortEncountered bool
+  uiNodePortEnvVar      string
+  // The normalized references of the images run by the containers.
+  usedImages map[string]bool
+  // The first container running an image of each repository.
+  repositoryUses map[string]*imageUse
+  // The ConfigMaps and Secrets referred to by the containers.
+  usedConfigs map[Pair]bool
+}
+
+// Returns a validationRun for the appspec read from the file fileName.
+func newValidationRun(validator *Validator, fileName string) *validationRun {
+  return &validationRun{
+    validator:           validator,
+    file:                fileName,
+    uniqueAppSpecObject: make(map[Pair]bool),
+    nodePortEnvVarMap:   make(map[string]int),
+    usedImages:          make(map[string]bool),
+    repositoryUses:      make(map[string]*imageUse),
+    usedConfigs:         make(map[Pair]bool),
+  }
+}
+
+// Makes document the current object, which the findings are reported against.
+func (run *validationRun) setDocument(document *Document) {
+  run.document = document.Index
+  run.kind = document.Kind()
+  run.name = document.Name()
+  run.nodes = document.nodes
+}
+
+// Makes the appspec as a whole the subject of the findings, rather than one of
+// its objects.
+func (run *validationRun) setNoDocument() {
+  run.document = kNoDocument
+  run.kind = ""
+  run.name = ""
+  run.nodes = nil
+}
+
+// Records a violation of the given field of the current object. The finding
+// is positioned at the field, or at its closest ancestor present in the
+// document if the field itself is missing.
+func (run *validationRun) add(field string, format string,
+  args ...interface{}) {
+  run.addFinding(SeverityError, field, format, args...)
+}
+
+// Records a warning about the given field of the current object.
+func (run *validationRun) warn(field string, format string,
+  args ...interface{}) {
+  run.addFinding(SeverityWarning, field, format, args...)
+}
+
+// Records a finding of the given severity about the given field of the
+// current object, and returns it.
+func (run *validationRun) addFinding(severity Severity, field string,
+  format string, args ...interface{}) *Finding {
+  finding := &Finding{
+    Severity: severity,
+    File:     run.file,
+    Document: run.document,
+    Kind:     run.kind,
+    Name:     run.name,
+    Field:    field,
+    Message:  fmt.Sprintf(format, args...),
+  }
+  if node := run.lookupNode(field); node != nil {
+    finding.Line = node.Line
+    finding.Column = node.Column
+  }
+  run.findings = append(run.findings, finding)
+  return finding
+}
+
+// Records a finding at the given line of the current document. It is used for
+// errors reported by the YAML decoder which only carry a line number.
+func (run *validationRun) addAtLine(line int, format string,
+  args ...interface{}) {
+  finding := &Finding{
+    Severity: SeverityError,
+    File:     run.file,
+    Line:     line,
+    Document: run.document,
+    Kind:     run.kind,
+    Name:     run.name,
+    Message:  fmt.Sprintf(format, args...),
+  }
+  if line > 0 {
+    finding.Column = 1
+    // Attribute the finding to the deepest field on that line, if any.
+    for path, node := range run.nodes {
+      if node.Line == line && len(path) >= len(finding.Field) {
+        if len(path) == len(finding.Field) && path > finding.Field {
+          continue
+        }
+        finding.Field = path
+        finding.Column = node.Column
+      }
+    }
+  }
+  run.findings = append(run.findings, finding)
+}
+
+// Returns the node of the given field path, or of its closest ancestor if the
+// field is not present in the current document.
+func (run *validationRun) lookupNode(field string) *yaml.Node {
+  for {
+    if node, ok := run.nodes[field]; ok {
+      return node
+    }
+    if field == "" {
+      return nil
+    }
+    field = fieldpath.Parent(field)
+  }
+}
+
+// Records the nodes of the document rooted at node in nodes, keyed by their
+// field path.
+func indexNodes(node *yaml.Node, path string, nodes map[string]*yaml.Node) {
+  nodes[path] = node
+  switch node.Kind {
+  case yaml.MappingNode:
+    for i := 0; i+1 < len(node.Content); i += 2 {
+      indexNodes(node.Content[i+1], fieldpath.Join(path, node.Content[i].Value),
+        nodes)
+    }
+  case yaml.SequenceNode:
+    for i, child := range node.Content {
+      indexNodes(child, fieldpath.Index(path, i), nodes)
+    }
+  }
+}
+
+// Matches the line number prefix of errors reported by the YAML decoder.
+var yamlErrorLineRegexp = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// Splits an error reported by the YAML decoder into its line number and
+// message. The line is zero if the error does not carry one.
+func splitYamlError(errMsg string) (int, string) {
+  match := yamlErrorLineRegexp.FindStringSubmatch(errMsg)
+  if match == nil {
+    return 0, errMsg
+  }
+  line, _ := strconv.Atoi(match[1])
+  return line, match[2]
 }
 
 // Validates the metadata of the AppSpec.
-func validateMetadata(appSpecMetadata *Metadata, kind *string) error {
+func (run *validationRun) validateMetadata(appSpecMetadata *Metadata,
+  kind string, path string) {
   // If there's a cohesity tag in metadata, then it must say 'cleanup' and kind
   // can only be "Job".
   if appSpecMetadata.CohesityTag != nil {
+    tagPath := path + "." + kCohesityTagKeyWord
     tagString := *appSpecMetadata.CohesityTag
     if tagString != kCohesityCleanupTag {
-      errMsg := fmt.Sprintf("Invalid tag %s, expected %s.", tagString,
+      run.add(tagPath, "Invalid tag %s, expected %s.", tagString,
         kCohesityCleanupTag)
-      return errors.New(errMsg)
+      return
     }
-    if *kind != "Job" {
-      errMsg := fmt.Sprintf("Invalid kind %s for tag %s, expected Job.", *kind,
+    if kind != "Job" {
+      run.add(tagPath, "Invalid kind %s for tag %s, expected Job.", kind,
         kCohesityCleanupTag)
-      return errors.New(errMsg)
+      return
     }
-    if cleanupJobEncountered {
-      errMsg := "At most one cleanup job supported."
-      return errors.New(errMsg)
+    if run.cleanupJobEncountered {
+      run.add(tagPath, "At most one cleanup job supported.")
+      return
     }
-    cleanupJobEncountered = true
+    run.cleanupJobEncountered = true
   }
-  return nil
 }
 
 // Validates the volumeMounts spec of the AppSpec.
-func validateVolumeMounts(volumeMounts []*VolumeMounts) error {
-  for _, volumeMount := range volumeMounts {
+func (run *validationRun) validateVolumeMounts(volumeMounts []*VolumeMounts,
+  path string) {
+  for i, volumeMount := range volumeMounts {
+    mountPath := fieldpath.Index(path, i)
+    if volumeMount == nil {
+      run.add(mountPath, "VolumeMount empty.")
+      continue
+    }
     if volumeMount.Name == nil {
-      return errors.New("VolumeMount name missing.")
+      run.add(mountPath+".name", "VolumeMount name missing.")
     }
     if volumeMount.MountPath == nil {
-      return errors.New("VolumeMount mountPath missing.")
+      run.add(mountPath+".mountPath", "VolumeMount mountPath missing.")
     }
   }
-  return nil
 }
 
-// Validates resources quantities like cpu and memory.
-func validateResourceQuantity(quantityStr string) error {
-
-  var suffix string
-  if quantityStr == "" {
-    return errors.New("Empty resource quantity.")
+// Validates the quantity of the given resource like cpu and memory. Returns
+// the parsed quantity, or nil if it is invalid.
+func (run *validationRun) validateResourceQuantity(resource string,
+  quantityStr string, path string) *Quantity {
+  quantity, err := ParseQuantity(quantityStr)
+  if err != nil {
+    run.add(path, "%v", err)
+    return nil
   }
-  // Get the position of the suffix which is the first non digit.
-  suffixPos := -1
-  for i, char := range quantityStr {
-    val := char - '0'
-    if !(val >= 0 && val <= 9) {
-      suffixPos = i
-      break
+  if quantity.Sign() < 0 {
+    run.add(path, "Resource quantity %s must not be negative.", quantityStr)
+    return nil
+  }
+
+  switch resource {
+  case kResourceCpu:
+    // The smallest amount of cpu that can be requested is 1m.
+    if !quantity.IsWholeMilli() {
+      run.add(path, "Cpu quantity %s is finer than 1m.", quantityStr)
+      return nil
+    }
+  case kResourceMemory, kResourceEphemeralStorage:
+    // Memory is counted in bytes, so "100m" is a tenth of a byte and not 100
+    // megabytes.
+    if !quantity.IsWhole() {
+      run.add(path, "Quantity %s of %s is not a whole number of bytes, use "+
+        "M or Mi for megabytes.", quantityStr, resource)
+      return nil
     }
   }
+  return quantity
+}
 
-  if suffixPos == -1 {
-    // No suffix in this case, which is valid too. But rewrite suffix_pos to
-    // the string length as it is used to get the substring which provides the
-    // value.
-    suffix = ""
-    suffixPos = len(quantityStr)
-  } else {
-    suffix = quantityStr[suffixPos:len(quantityStr)]
+// Validates that the requested quantity of the resource is within the
+// maximum configured in the Validator, or the sanity limits if none is.
+func (run *validationRun) validateResourceCap(resource string,
+  quantity *Quantity, path string) {
+  var maxQuantity, defaultMaxQuantity *Quantity
+  switch resource {
+  case kResourceCpu:
+    maxQuantity, defaultMaxQuantity = run.validator.MaxCpu, defaultMaxCpu
+  case kResourceMemory:
+    maxQuantity, defaultMaxQuantity = run.validator.MaxMemory,
+      defaultMaxMemory
+  default:
+    return
   }
 
-  // Search for the suffix in both Binary and Decimal multiplier maps
-  _, isSuffixBinary := binarySIMap[suffix]
-  _, isSuffixDecimal := decimalSIMap[suffix]
+  if maxQuantity != nil {
+    if quantity.Cmp(maxQuantity) > 0 {
+      run.add(path, "Resource quantity %s exceeds the maximum %s of %s.",
+        quantity, resource, maxQuantity)
+    }
+  } else if quantity.Cmp(defaultMaxQuantity) > 0 {
+    run.warn(path, "Resource quantity %s is larger than %s, which is "+
+      "unlikely to fit a node.", quantity, defaultMaxQuantity)
+  }
+}
 
-  if isSuffixBinary || isSuffixDecimal {
-    return nil
-  } else {
-    return errors.New("Invalid resource quantity " + quantityStr)
+// Returns the quantities of requests keyed by resource name. Resources which
+// are not set are left out.
+func (requests *Requests) quantityStrings() map[string]*string {
+  quantities := make(map[string]*string)
+  if requests == nil {
+    return quantities
   }
+  for resource, quantityStr := range map[string]*string{
+    kResourceCpu:              requests.Cpu,
+    kResourceMemory:           requests.Memory,
+    kResourceEphemeralStorage: requests.EphemeralStorage,
+  } {
+    if quantityStr != nil {
+      quantities[resource] = quantityStr
+    }
+  }
+  return quantities
 }
 
 // Validates container resources.
-func validateContainerResources(resources *Resources) error {
-  // The caller must check for requests to be valid before calling this method.
-  if resources.Requests.Cpu != nil {
-    err := validateResourceQuantity(*resources.Requests.Cpu)
-    if err != nil {
-      return err
+func (run *validationRun) validateContainerResources(resources *Resources,
+  path string) {
+  requests := make(map[string]*Quantity)
+  requestStrings := resources.Requests.quantityStrings()
+  for _, resource := range resourceNames {
+    quantityStr, ok := requestStrings[resource]
+    if !ok {
+      continue
+    }
+    requestPath := path + ".requests." + resource
+    quantity := run.validateResourceQuantity(resource, *quantityStr,
+      requestPath)
+    if quantity != nil {
+      requests[resource] = quantity
+      run.validateResourceCap(resource, quantity, requestPath)
     }
   }
-  if resources.Requests.Memory != nil {
-    err := validateResourceQuantity(*resources.Requests.Memory)
-    if err != nil {
-      return err
+
+  // A container may never use more than its limit, so the limit must be at
+  // least what it requests.
+  limitStrings := resources.Limits.quantityStrings()
+  for _, resource := range resourceNames {
+    quantityStr, ok := limitStrings[resource]
+    if !ok {
+      continue
+    }
+    limitPath := path + ".limits." + resource
+    limit := run.validateResourceQuantity(resource, *quantityStr, limitPath)
+    if limit == nil {
+      continue
+    }
+    if request, ok := requests[resource]; ok && limit.Cmp(request) < 0 {
+      run.add(limitPath, "Limit %s is less than the request %s.", limit,
+        request)
     }
   }
-  return nil
 }
 
 // Validates the volume specs of the AppSpec.
-func validateVolumes(volumes []*VolumeSpec) error {
-
-  for _, volume := range volumes {
+func (run *validationRun) validateVolumes(volumes []*VolumeSpec,
+  path string) {
+
+  for i, volume := range volumes {
+    volumePath := fieldpath.Index(path, i)
+    if volume == nil {
+      run.add(volumePath, "Volume empty.")
+      continue
+    }
     if volume.Name == nil {
-      return errors.New("Volume name missing.")
+      run.add(volumePath+".name", "Volume name missing.")
+    }
+    if volume.ConfigMap != nil || volume.Secret != nil {
+      run.validateConfigVolume(volume, volumePath)
+      continue
     }
     if volume.FsType == nil {
-      return errors.New("Volume fsType missing.")
+      run.add(volumePath+".fsType", "Volume fsType missing.")
     }
     if volume.Type == nil {
-      return errors.New("Volume volumeType missing.")
-    }
-    if *volume.Type == kVolumeTypeStatic && volume.VolumeName == nil {
-      return errors.New("Static volume volumeName missing.")
+      run.add(volumePath+".volumeType", "Volume volumeType missing.")
+    } else if *volume.Type == kVolumeTypeStatic && volume.VolumeName == nil {
+      run.add(volumePath+".volumeName",
+        "Static volume volumeName missing.")
     }
   }
-  return nil
 }
 
 //  Validates the containter specs of the AppSpec.
-func validateContainers(containers []*ContainerSpec) error {
-  var err error
-  for _, container := range containers {
+func (run *validationRun) validateContainers(
+  containers []*ContainerSpec, path string) {
+  for i, container := range containers {
+    containerPath := fieldpath.Index(path, i)
+    if container == nil {
+      run.add(containerPath, "Container empty.")
+      continue
+    }
     if container.Name == nil {
-      return errors.New("Container name missing.")
+      run.add(containerPath+".name", "Container name missing.")
     }
     if container.Image == nil {
-      return errors.New("Container image missing.")
+      run.add(containerPath+".image", "Container image missing.")
+    } else {
+      run.validateImage(*container.Image, containerPath+".image")
     }
 
     // If containers have volume mounts, they need to be validated.
     if container.VolumeMounts != nil {
-      err = validateVolumeMounts(container.VolumeMounts)
-      if err != nil {
-        return err
-      }
+      run.validateVolumeMounts(container.VolumeMounts,
+        containerPath+".volumeMounts")
     }
     if container.Resources != nil {
-      err = validateContainerResources(container.Resources)
-      if err != nil {
-        return err
-      }
+      run.validateContainerResources(container.Resources,
+        containerPath+".resources")
     }
+    run.validateContainerFields(container, containerPath)
+    run.validateContainerEnv(container, containerPath)
   }
-  return nil
 }
 
 // Validate all components of a given object spec.
-func validateSpec(appSpecObject *AppSpec) error {
-  var err error
-  replicaSpec := appSpecObject.Spec.Replicas
-  if replicaSpec != nil {
-    if replicaSpec.Fixed == nil && replicaSpec.Share == nil {
-      return errors.New("Replica specification incorrect.")
-    }
-    if replicaSpec.Fixed != nil {
-      if replicaSpec.Max != nil || replicaSpec.Min != nil ||
-        replicaSpec.Share != nil {
-        return errors.New("Replica specification incorrect.")
-      }
-    }
+func (run *validationRun) validateSpec(appSpecObject *AppSpec) {
+  if appSpecObject.Spec == nil {
+    run.add("spec", "Spec missing.")
+    return
   }
 
-  if appSpecObject.Spec.Template == nil {
-    return errors.New("Spec Template missing.")
+  run.validateReplicas(appSpecObject.Spec.Replicas, "spec.replicas")
+  run.validateKindFields(appSpecObject.Spec)
+  if kindOf(run.kind).RunToCompletion {
+    run.validateJob(appSpecObject)
   }
 
-  if appSpecObject.Spec.Template.TemplateSpec == nil {
-    return errors.New("Template Specification missing.")
+  if appSpecObject.Spec.Template == nil {
+    run.add("spec.template", "Spec Template missing.")
+    return
   }
 
-  if appSpecObject.Spec.Template.TemplateSpec.Containers == nil {
-    return errors.New("Template Containers missing.")
+  if appSpecObject.Spec.Template.Metadata != nil {
+    run.validateTemplateMetadata(appSpecObject.Spec.Template.Metadata,
+      "spec.template.metadata")
   }
 
-  containers := appSpecObject.Spec.Template.TemplateSpec.Containers
+  if appSpecObject.Spec.Template.TemplateSpec == nil {
+    run.add("spec.template.spec", "Template Specification missing.")
+    return
+  }
 
-  err = validateContainers(containers)
-  if err != nil {
-    return err
+  templateSpec := appSpecObject.Spec.Template.TemplateSpec
+  if templateSpec.Containers == nil {
+    run.add("spec.template.spec.containers",
+      "Template Containers missing.")
+  } else {
+    run.validateContainers(templateSpec.Containers,
+      "spec.template.spec.containers")
   }
 
-  if appSpecObject.Spec.Template.TemplateSpec.Volumes != nil {
-    err = validateVolumes(appSpecObject.Spec.Template.TemplateSpec.Volumes)
-    if err != nil {
-      return err
-    }
+  if templateSpec.Volumes != nil {
+    run.validateVolumes(templateSpec.Volumes,
+      "spec.template.spec.volumes")
   }
-  return nil
+
+  run.validateVolumeReferences(templateSpec, "spec.template.spec")
+  run.validateRestartPolicy(templateSpec.RestartPolicy,
+    "spec.template.spec.restartPolicy")
 }
 
-// Validates the service spec of the AppSpec.
-func validateService(appSpecObject *AppSpec) error {
+// Validates that the volumeMounts of the containers refer to the volumes of
+// the pod template and that every volume is mounted by some container.
+func (run *validationRun) validateVolumeReferences(templateSpec *TemplateSpec,
+  path string) {
+  // Maps the name of each volume to whether it is mounted.
+  volumeMounted := make(map[string]bool)
+  for i, volume := range templateSpec.Volumes {
+    if volume == nil || volume.Name == nil {
+      continue
+    }
+    if _, ok := volumeMounted[*volume.Name]; ok {
+      run.add(fieldpath.Index(path+".volumes", i)+".name",
+        "Volume name %s is not unique.", *volume.Name)
+    }
+    volumeMounted[*volume.Name] = false
+  }
 
-  if appSpecObject.Metadata == nil {
-    return errors.New("Service metadata missing.")
+  for i, container := range templateSpec.Containers {
+    if container == nil {
+      continue
+    }
+    containerPath := fieldpath.Index(path+".containers", i)
+    mountPaths := make(map[string]bool)
+    for j, volumeMount := range container.VolumeMounts {
+      if volumeMount == nil {
+        continue
+      }
+      mountPath := fieldpath.Index(containerPath+".volumeMounts", j)
+      if volumeMount.Name != nil {
+        if _, ok := volumeMounted[*volumeMount.Name]; ok {
+          volumeMounted[*volumeMount.Name] = true
+        } else {
+          run.add(mountPath+".name", "VolumeMount %s does not refer to a "+
+            "volume declared in %s.volumes.", *volumeMount.Name, path)
+        }
+      }
+      if volumeMount.MountPath != nil {
+        if mountPaths[*volumeMount.MountPath] {
+          run.add(mountPath+".mountPath", "VolumeMount mountPath %s is "+
+            "mounted more than once in the container.",
+            *volumeMount.MountPath)
+        }
+        mountPaths[*volumeMount.MountPath] = true
+      }
+    }
   }
 
-  if appSpecObject.Metadata.Name == nil {
-    return errors.New("Service metadata name missing.")
+  for i, volume := range templateSpec.Volumes {
+    if volume == nil || volume.Name == nil {
+      continue
+    }
+    if !volumeMounted[*volume.Name] {
+      run.warn(fieldpath.Index(path+".volumes", i)+".name",
+        "Volume %s is not mounted by any container.", *volume.Name)
+      // Only warn once for duplicate names.
+      volumeMounted[*volume.Name] = true
+    }
   }
+}
+
+// Validates the service spec of the AppSpec.
+func (run *validationRun) validateService(appSpecObject *AppSpec) {
 
   if appSpecObject.Metadata.Labels == nil {
-    return errors.New("Service metadata labels missing.")
+    run.add("metadata.labels", "Service metadata labels missing.")
   }
 
   if appSpecObject.Spec == nil {
-    return errors.New("Service spec missing.")
+    run.add("spec", "Service spec missing.")
+    return
   }
 
-  if appSpecObject.Spec.Type != nil {
-    if *appSpecObject.Spec.Type != "NodePort" &&
-      *appSpecObject.Spec.Type != "ClusterIP" {
-      return errors.New("Service Spec Type invalid." +
-        "Only NodePort and ClusterIP are allowed.")
-    }
-  } else {
-    return errors.New("Service Spec Type is missing.")
+  if appSpecObject.Spec.Type == nil {
+    run.add("spec.type", "Service Spec Type is missing.")
+  } else if *appSpecObject.Spec.Type != kServiceTypeNodePort &&
+    *appSpecObject.Spec.Type != kServiceTypeClusterIp {
+    run.add("spec.type", "Service Spec Type invalid. "+
+      "Only NodePort and ClusterIP are allowed.")
   }
 
-  if *appSpecObject.Spec.Type == "NodePort" {
+  run.validateServicePorts(appSpecObject.Spec.Ports)
+
+  if appSpecObject.Spec.Type != nil &&
+    *appSpecObject.Spec.Type == kServiceTypeNodePort {
 
     if appSpecObject.Spec.Ports == nil {
-      errMsg := "Port must be specified if the service is of type NodePort."
-      return errors.New(errMsg)
+      run.add("spec.ports",
+        "Port must be specified if the service is of type NodePort.")
     }
 
     var hasUiTag bool = false
 
-    for _, entry := range appSpecObject.Spec.Ports {
+    for i, entry := range appSpecObject.Spec.Ports {
+      portPath := fieldpath.Index("spec.ports", i)
+      if entry == nil {
+        continue
+      }
       // Check whether the nodeports in this service have the UI tag.  Not that
       // the UI node port could also be tagged to be passed as an environment
       // variable.
+      isUiPort := false
       if entry.CohesityTag != nil {
+        tagPath := portPath + "." + kCohesityTagKeyWord
         // We only support the 'ui' tag at present.
         tagStr := entry.CohesityTag
         if *tagStr != kCohesityUiNodePortTag {
-          errMsg := fmt.Sprintf("Invalid nodeport tag: expected %s, "+
-            "got %s.", kCohesityUiNodePortTag, *tagStr)
-          return errors.New(errMsg)
-        }
-
-        if hasUiTag {
-          return errors.New("Only one ui tag is supported.")
-        }
-        if uiNodePortEncountered {
-          return errors.New("At most one UI node port supported.")
+          run.add(tagPath, "Invalid nodeport tag: expected %s, got %s.",
+            kCohesityUiNodePortTag, *tagStr)
+        } else if hasUiTag {
+          run.add(tagPath, "Only one ui tag is supported.")
+        } else if run.uiNodePortEncountered {
+          run.add(tagPath, "At most one UI node port supported.")
+        } else {
+          run.uiNodePortEncountered = true
+          hasUiTag = true
+          isUiPort = true
         }
-        uiNodePortEncountered = true
-
-        hasUiTag = true
       }
       // If a nodePort has cohesityEnv tag, that means the value of that tag
       // is an environment variable that needs to be passed to all the pods.
@@ -401,162 +1138,229 @@ func validateService(appSpecObject *AppSpec) error {
       // environment variables specified in the tag must be unique across all
       // nodePorts.
       if entry.CohesityEnv != nil {
+        envPath := portPath + "." + kCohesityEnvKeyWord
         // Check the validity and uniqueness of tag value which is to be used
         // as the environment variable.
         envStr := entry.CohesityEnv
-        if envStr == nil {
-          return errors.New("CohesityEnv empty.")
-        }
-        _, ok := nodePortEnvVarMap[*envStr]
-
-        if *envStr == "" || ok || uiNodePortEnvVar == *envStr {
-          errMsg := fmt.Sprintf("CohesityEnv: " + *envStr +
-            " is not unique in the appspec.")
-          return errors.New(errMsg)
-        }
-
-        if hasUiTag {
-          uiNodePortEnvVar = *envStr
+        _, ok := run.nodePortEnvVarMap[*envStr]
+
+        if *envStr == "" {
+          run.add(envPath, "CohesityEnv empty.")
+        } else if ok || run.uiNodePortEnvVar == *envStr {
+          run.add(envPath, "CohesityEnv: %s is not unique in the "+
+            "appspec.", *envStr)
+        } else if isUiPort {
+          run.uiNodePortEnvVar = *envStr
         } else {
-          nodePortEnvVarMap[*envStr] = 0
+          run.nodePortEnvVarMap[*envStr] = 0
         }
       }
     }
   }
 
-  if *appSpecObject.Spec.Type == "ClusterIp" {
-    if appSpecObject.Spec.ClusterIp != nil {
-      if *appSpecObject.Spec.ClusterIp != "none" {
-        return errors.New("ClusterIp if specified, can only be set to none.")
-      }
+  if appSpecObject.Spec.Type != nil &&
+    *appSpecObject.Spec.Type == kServiceTypeClusterIp {
+    if appSpecObject.Spec.ClusterIp != nil &&
+      !appSpecObject.Spec.IsHeadless() {
+      run.add("spec.clusterIp", "ClusterIp if specified, can only be set "+
+        "to %s.", kClusterIpNone)
     }
+    run.validateClusterIpPorts(appSpecObject.Spec.Ports)
+  } else if appSpecObject.Spec.Type != nil &&
+    appSpecObject.Spec.ClusterIp != nil {
+    run.add("spec.clusterIp", "ClusterIp can only be set for a Service of "+
+      "type %s.", kServiceTypeClusterIp)
   }
 
   if appSpecObject.Spec.Selector == nil {
-    return errors.New("Service spec selector missing.")
+    run.add("spec.selector", "Service spec selector missing.")
   }
-  return nil
 }
 
 // Validates an individual AppSpec object.
-func validateAppSpec(appSpecObject *AppSpec) error {
-  var err error
+func (run *validationRun) validateAppSpec(appSpecObject *AppSpec) {
   appSpecMetadata := appSpecObject.Metadata
 
   if appSpecMetadata == nil {
-    return errors.New("AppSpecObject metadata missing.")
+    run.add("metadata", "AppSpecObject metadata missing.")
+    return
   }
 
   if appSpecMetadata.Name == nil {
-    return errors.New("AppSpecObject metadata name missing.")
+    run.add("metadata.name", "AppSpecObject metadata name missing.")
+    return
   }
 
   appSpecName := *appSpecMetadata.Name
 
   if appSpecObject.Kind == nil {
-    errMsg := fmt.Sprintf("AppSpecObject kind is missing. Name %s",appSpecName)
-    return errors.New(errMsg)
+    run.add("kind", "AppSpecObject kind is missing.")
+    return
   }
 
   appSpecKind := *appSpecObject.Kind
-  apiVersion  := *appSpecObject.ApiVersion
 
   if appSpecObject.ApiVersion == nil {
-    errMsg := fmt.Sprintf("Apiversion missing.Kind: %s. Name: %s", appSpecKind, appSpecName)
-    return errors.New(errMsg)
-  }
-
-  if appSpecKind == "StatefulSet" || appSpecKind == "ReplicaSet" {
-    if apiVersion != "apps/v1" {
-      errMsg := fmt.Sprintf("Incorrect api version.Kind: %s. Name: %s", appSpecKind, appSpecName)
-      return errors.New(errMsg)
+    run.add("apiVersion", "Apiversion missing.")
+  } else {
+    apiVersion := *appSpecObject.ApiVersion
+    expectedApiVersion := ExpectedApiVersion(appSpecKind)
+    if expectedApiVersion != "" && apiVersion != expectedApiVersion {
+      run.add("apiVersion", "Incorrect api version %s, expected %s.",
+        apiVersion, expectedApiVersion)
     }
   }
 
-  if appSpecKind == "Service" && apiVersion != "v1" {
-    errMsg := fmt.Sprintf("Incorrect api version. Object kind: %s. Name: %s", appSpecKind, appSpecName)
-    return errors.New(errMsg)
-  }
+  appSpecObj := Pair{appSpecKind, appSpecName}
 
-  if appSpecKind == "Job" && apiVersion != "batch/v1" {
-    errMsg := fmt.Sprintf("Incorrect api version. Object kind: %s. Name: %s", appSpecKind, appSpecName)
-    return errors.New(errMsg)
+  if _, ok := run.uniqueAppSpecObject[appSpecObj]; ok {
+    run.add("metadata.name", "No two AppSpecObjects of same kind "+
+      "can have same name.")
   }
 
-  appSpecObj := Pair{appSpecKind, appSpecName}
+  run.uniqueAppSpecObject[appSpecObj] = true
 
-  if _, ok := uniqueAppSpecObject[appSpecObj]; ok {
-    errMsg := fmt.Sprintf("No two AppSpecObjects of same kind "+
-      "can have same name. kind: %s. Name: %s", appSpecKind, appSpecName)
-    return errors.New(errMsg)
+  features := kindOf(appSpecKind)
+  if !features.Config {
+    run.validateNoConfigData(appSpecObject)
   }
 
-  uniqueAppSpecObject[appSpecObj] = true
-
-  if appSpecKind == "StatefulSet" || appSpecKind == "Job" ||
-    appSpecKind == "ReplicaSet" {
-    err = validateMetadata(appSpecMetadata, &appSpecKind)
-    if err != nil {
-      errMsg := fmt.Sprint(err)
-      errMsg = errMsg + fmt.Sprintf("Kind: %s. Name %s",appSpecKind,appSpecName)
-      return err
-    }
-    err = validateSpec(appSpecObject)
-    if err != nil {
-      errMsg := fmt.Sprintf("Kind: %s. Name %s",appSpecKind,appSpecName)
-      errMsg = fmt.Sprint(err) + errMsg
-      return err
-    }
+  if features.Workload {
+    run.validateMetadata(appSpecMetadata, appSpecKind, "metadata")
+    run.validateSpec(appSpecObject)
   } else if appSpecKind == "Service" {
-    err = validateService(appSpecObject)
-    if err != nil {
-      errMsg := fmt.Sprintf("Kind: %s. Name %s",appSpecKind,appSpecName)
-      errMsg = fmt.Sprint(err) + errMsg
-      return err
-    }
+    run.validateService(appSpecObject)
+  } else if features.Config {
+    run.validateMetadata(appSpecMetadata, appSpecKind, "metadata")
+    run.validateConfig(appSpecObject)
   } else {
-    errMsg := "Object kind is not one of StatefulSet, Job, " +
-      "ReplicaSet, Service." + fmt.Sprintf("Kind: %s. Name %s",appSpecKind,appSpecName)
-    return errors.New(errMsg)
+    run.add("kind", "Object kind %s is not one of %s.", appSpecKind,
+      strings.Join(SupportedKinds(), ", "))
   }
-  return nil
 }
 
-// ParseAndValidateAppSpec takes the user input appspec, parses and validates it.
+// Validate parses and validates every document of the appspec read from
+// reader. It does not stop at the first violation, it returns the findings for
+// all the documents in the appspec. The error is set only if the appspec could
+// not be read.
+func (validator *Validator) Validate(reader io.Reader) (Findings, error) {
+  _, findings, err := validator.validate(reader, "")
+  return findings, err
+}
 
-func ParseAndValidateAppSpec(InputAppSpecFile string) error {
+// ValidateFile is like Validate but reads the appspec from the file at path.
+// The findings are reported against path.
+func (validator *Validator) ValidateFile(path string) (Findings, error) {
+  _, findings, err := validator.ParseAndValidateFile(path)
+  return findings, err
+}
 
-  appSpecFile, err := os.Open(InputAppSpecFile)
+// ParseAndValidateFile is like ValidateFile but also returns the objects of
+// the appspec, so that callers can check them further. Objects which could
+// not be decoded at all are left out.
+func (validator *Validator) ParseAndValidateFile(path string) ([]*Document,
+  Findings, error) {
+  appSpecFile, err := os.Open(path)
   if err != nil {
-    return err
+    return nil, nil, err
   }
-  dec := yaml.NewDecoder(appSpecFile)
+  defer appSpecFile.Close()
+  return validator.validate(appSpecFile, path)
+}
 
-  appSpecObjects := make(map[interface{}]interface{})
+// Parses and validates every document of the appspec read from reader.
+// fileName is only used to report the position of the findings.
+func (validator *Validator) validate(reader io.Reader,
+  fileName string) ([]*Document, Findings, error) {
+  dec := yaml.NewDecoder(reader)
 
-  for dec.Decode(&appSpecObjects) == nil {
-    var appSpec AppSpec
-    appSpecObject, err := yaml.Marshal(appSpecObjects)
-    if err != nil {
-      errMsg := "Error in marshalling appspec." + fmt.Sprint(err)
-      return errors.New(errMsg)
+  run := newValidationRun(validator, fileName)
+
+  for document := 0; ; document++ {
+    run.document = document
+    run.kind = ""
+    run.name = ""
+    run.nodes = make(map[string]*yaml.Node)
+
+    var documentNode yaml.Node
+    err := dec.Decode(&documentNode)
+    if err == io.EOF {
+      break
     }
-    fmt.Printf(string(appSpecObject))
-    err = yaml.Unmarshal([]byte(string(appSpecObject)), &appSpec)
     if err != nil {
-      errMsg := "Error in unmarshalling appspec." + fmt.Sprint(err)
-      return errors.New(errMsg)
+      // The decoder can not recover from a syntax error, so the rest of the
+      // appspec can not be validated.
+      line, errMsg := splitYamlError(err.Error())
+      run.addAtLine(line, "Error in parsing appspec. %s", errMsg)
+      break
+    }
+    if len(documentNode.Content) == 0 {
+      continue
     }
+    indexNodes(documentNode.Content[0], "", run.nodes)
 
-    err = validateAppSpec(&appSpec)
+    appSpec := &AppSpec{}
+    err = documentNode.Decode(appSpec)
     if err != nil {
-      errMsg := "Error in validating appspec." + fmt.Sprint(err)
-      return errors.New(errMsg)
+      typeErr, ok := err.(*yaml.TypeError)
+      if !ok {
+        run.add("", "Error in unmarshalling appspec. %v", err)
+        continue
+      }
+      // A type error still leaves the rest of the object decoded, so keep
+      // validating it.
+      for _, typeErrMsg := range typeErr.Errors {
+        line, errMsg := splitYamlError(typeErrMsg)
+        run.addAtLine(line, "Error in unmarshalling appspec. %s", errMsg)
+      }
     }
 
-    for key := range appSpecObjects {
-      delete(appSpecObjects, key)
+    appSpecDocument := &Document{
+      Index:   document,
+      AppSpec: appSpec,
+      Node:    documentNode.Content[0],
+      nodes:   run.nodes,
+      ignores: ignoreComments(&documentNode),
+    }
+    run.documents = append(run.documents, appSpecDocument)
+    run.setDocument(appSpecDocument)
+    if validator.Strict {
+      run.validateKnownFields(appSpecDocument.Node, reflect.TypeOf(appSpec),
+        "")
     }
+    if validator.SchemaCheck {
+      run.validateSchema(appSpecDocument.Node)
+    }
+    run.validateAppSpec(appSpec)
+  }
+
+  // Once all the objects are known, check the references between them.
+  run.validateReferences()
+  run.validateBudget()
+  run.validateShippedImages()
+  run.validateLintRules()
+  return run.documents, run.findings, nil
+}
+
+// CollectAppSpecFindings takes the user input appspec, parses and validates
+// every object in it. Unlike ParseAndValidateAppSpec it does not stop at the
+// first violation, it returns the findings for all the documents in the
+// appspec. The error is set only if the appspec could not be read.
+func CollectAppSpecFindings(InputAppSpecFile string) (Findings, error) {
+  return NewValidator().ValidateFile(InputAppSpecFile)
+}
+
+// ParseAndValidateAppSpec takes the user input appspec, parses and validates it.
+// If the appspec is invalid the returned error is of type Findings and lists
+// every finding, including warnings.
+
+func ParseAndValidateAppSpec(InputAppSpecFile string) error {
+  findings, err := CollectAppSpecFindings(InputAppSpecFile)
+  if err != nil {
+    return err
+  }
+  if findings.HasErrors() {
+    return findings
   }
   return nil
 }
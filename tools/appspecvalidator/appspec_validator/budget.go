@@ -0,0 +1,148 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file checks the cpu and memory requested by all the workloads of an
+// app against the budget of the cluster it is installed on. An app whose
+// requests do not fit is rejected at install time. A budget file looks like:
+//
+//   nodes: 3
+//   cpu: 8
+//   memory: 16Gi
+//   severity: warning
+
+package appspecvalidator
+
+import (
+  "fmt"
+  "io"
+  "math/big"
+  "os"
+
+  "gopkg.in/yaml.v3"
+)
+
+// Budget is the most cpu and memory the workloads of an app may request
+// together on a cluster of Nodes nodes.
+type Budget struct {
+  Nodes int
+  // Either may be nil, in which case that resource is not limited.
+  Cpu    *Quantity
+  Memory *Quantity
+  // Severity of the findings reported when the budget is exceeded.
+  Severity Severity
+}
+
+// budgetFile is the content of a budget file.
+type budgetFile struct {
+  Nodes    *int    `yaml:"nodes"`
+  Cpu      *string `yaml:"cpu"`
+  Memory   *string `yaml:"memory"`
+  Severity *string `yaml:"severity"`
+}
+
+// NewBudget returns a budget for a single node without any limit, whose
+// findings are errors.
+func NewBudget() *Budget {
+  return &Budget{Nodes: 1, Severity: SeverityError}
+}
+
+// ParseBudget parses a budget file read from reader.
+func ParseBudget(reader io.Reader) (*Budget, error) {
+  var file budgetFile
+  dec := yaml.NewDecoder(reader)
+  dec.KnownFields(true)
+  if err := dec.Decode(&file); err != nil && err != io.EOF {
+    return nil, fmt.Errorf("Invalid budget. %v", err)
+  }
+
+  budget := NewBudget()
+  if file.Nodes != nil {
+    if *file.Nodes < 1 {
+      return nil, fmt.Errorf("Invalid budget. nodes must be at least 1, "+
+        "got %d.", *file.Nodes)
+    }
+    budget.Nodes = *file.Nodes
+  }
+  var err error
+  if file.Cpu != nil {
+    if budget.Cpu, err = ParseQuantity(*file.Cpu); err != nil {
+      return nil, fmt.Errorf("Invalid budget cpu. %v", err)
+    }
+  }
+  if file.Memory != nil {
+    if budget.Memory, err = ParseQuantity(*file.Memory); err != nil {
+      return nil, fmt.Errorf("Invalid budget memory. %v", err)
+    }
+  }
+  if file.Severity != nil {
+    severity := Severity(*file.Severity)
+    if severity != SeverityError && severity != SeverityWarning {
+      return nil, fmt.Errorf("Invalid budget severity %s, expected %s or %s.",
+        *file.Severity, SeverityError, SeverityWarning)
+    }
+    budget.Severity = severity
+  }
+  return budget, nil
+}
+
+// LoadBudgetFile parses the budget file at path.
+func LoadBudgetFile(path string) (*Budget, error) {
+  budgetFile, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer budgetFile.Close()
+  return ParseBudget(budgetFile)
+}
+
+// Checks the total of a resource requested by the workloads against its
+// budget. The finding is reported against the workload requesting the most of
+// the resource, given by the request function.
+func (run *validationRun) validateBudgetResource(resource string,
+  budget *Quantity, counts []*WorkloadReplicas,
+  request func(count *WorkloadReplicas) *big.Rat,
+  format func(value *big.Rat) string) {
+  if budget == nil {
+    return
+  }
+  total := new(big.Rat)
+  var largest *WorkloadReplicas
+  for _, count := range counts {
+    if count.Cleanup {
+      continue
+    }
+    total.Add(total, request(count))
+    if largest == nil || request(count).Cmp(request(largest)) > 0 {
+      largest = count
+    }
+  }
+  if largest == nil || total.Cmp(budget.value) <= 0 {
+    return
+  }
+
+  for _, document := range run.documents {
+    if document.Kind() == largest.Kind && document.Name() == largest.Name {
+      run.setDocument(document)
+      break
+    }
+  }
+  run.addFinding(run.validator.Budget.Severity, "spec.replicas",
+    "The workloads request %s %s in total on %d node(s), more than the "+
+      "budget of %s. %s %s requests the most, %s.", format(total), resource,
+    run.validator.Budget.Nodes, budget, largest.Kind, largest.Name,
+    format(request(largest)))
+}
+
+// Checks the cpu and memory requested by all the workloads against the
+// budget of the Validator.
+func (run *validationRun) validateBudget() {
+  budget := run.validator.Budget
+  if budget == nil {
+    return
+  }
+  counts := ReplicaCounts(run.documents, budget.Nodes)
+  run.validateBudgetResource(kResourceCpu, budget.Cpu, counts,
+    func(count *WorkloadReplicas) *big.Rat { return count.Cpu }, FormatCpu)
+  run.validateBudgetResource(kResourceMemory, budget.Memory, counts,
+    func(count *WorkloadReplicas) *big.Rat { return count.Memory },
+    FormatMemory)
+}
@@ -0,0 +1,408 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file validates the ConfigMaps and Secrets of an appspec, and the
+// references the containers of its workloads make to them through env,
+// envFrom and volumes. A reference to a missing ConfigMap or key keeps the
+// pod from starting, unless the reference is optional.
+
+package appspecvalidator
+
+import (
+  "encoding/base64"
+  "path"
+  "regexp"
+  "sort"
+  "strings"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/field_path"
+)
+
+const (
+  kSecretTypeOpaque string = "Opaque"
+
+  // Limits on the keys and on the total size of the data of a ConfigMap or
+  // Secret.
+  kMaxConfigKeyLength int = 253
+  kMaxConfigDataSize  int = 1 << 20
+)
+
+var (
+  // Matches a key of the data of a ConfigMap or Secret.
+  configKeyRegexp = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+  // Matches the name of an environment variable, or a prefix of one.
+  envNameRegexp = regexp.MustCompile(kEnvNamePattern)
+)
+
+// IsEnvName returns true if name is a valid name of an environment variable.
+func IsEnvName(name string) bool {
+  return envNameRegexp.MatchString(name)
+}
+
+// Returns the keys of data in order.
+func sortedKeys(data map[string]string) []string {
+  keys := make([]string, 0, len(data))
+  for key := range data {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+// Keys returns the keys of a ConfigMap or Secret in order.
+func (appSpecObject *AppSpec) Keys() []string {
+  keys := make(map[string]string)
+  for key := range appSpecObject.Data {
+    keys[key] = ""
+  }
+  for key := range appSpecObject.StringData {
+    keys[key] = ""
+  }
+  return sortedKeys(keys)
+}
+
+// Returns true if the ConfigMap or Secret has the given key.
+func (appSpecObject *AppSpec) hasKey(key string) bool {
+  _, inData := appSpecObject.Data[key]
+  _, inStringData := appSpecObject.StringData[key]
+  return inData || inStringData
+}
+
+// Validates that an object which is not a ConfigMap or Secret has none of
+// their fields.
+func (run *validationRun) validateNoConfigData(appSpecObject *AppSpec) {
+  fields := []string{"data", "stringData", "type"}
+  set := []bool{appSpecObject.Data != nil, appSpecObject.StringData != nil,
+    appSpecObject.Type != nil}
+  for i, field := range fields {
+    if set[i] {
+      run.add(field, "Only a ConfigMap or Secret has %s.", field)
+    }
+  }
+}
+
+// Validates a key of the data of a ConfigMap or Secret.
+func (run *validationRun) validateConfigKey(key string, path string) {
+  if len(key) > kMaxConfigKeyLength || !configKeyRegexp.MatchString(key) ||
+    key == "." || key == ".." {
+    run.add(path, "Invalid key %s, expected at most %d letters, digits, "+
+      "'-', '_' and '.'.", key, kMaxConfigKeyLength)
+  }
+}
+
+// Validates a ConfigMap or Secret.
+func (run *validationRun) validateConfig(appSpecObject *AppSpec) {
+  kind := *appSpecObject.Kind
+  isSecret := kind == "Secret"
+  if appSpecObject.Spec != nil {
+    run.add("spec", "%s has no spec, its keys are listed under data.", kind)
+  }
+  if !isSecret {
+    if appSpecObject.StringData != nil {
+      run.add("stringData", "Only a Secret has stringData, the data of a "+
+        "ConfigMap is not encoded.")
+    }
+    if appSpecObject.Type != nil {
+      run.add("type", "Only a Secret has a type.")
+    }
+  } else if appSpecObject.Type != nil &&
+    *appSpecObject.Type != kSecretTypeOpaque {
+    run.add("type", "Invalid Secret type %s, only %s is supported.",
+      *appSpecObject.Type, kSecretTypeOpaque)
+  }
+
+  size := 0
+  for _, key := range sortedKeys(appSpecObject.Data) {
+    keyPath := fieldpath.Join("data", key)
+    value := appSpecObject.Data[key]
+    run.validateConfigKey(key, keyPath)
+    if isSecret {
+      decoded, err := base64.StdEncoding.DecodeString(value)
+      if err != nil {
+        run.add(keyPath, "Secret data %s is not base64 encoded, plain values "+
+          "go under stringData.", key)
+      }
+      size += len(key) + len(decoded)
+    } else {
+      size += len(key) + len(value)
+    }
+  }
+  for _, key := range sortedKeys(appSpecObject.StringData) {
+    keyPath := fieldpath.Join("stringData", key)
+    run.validateConfigKey(key, keyPath)
+    if _, ok := appSpecObject.Data[key]; ok {
+      run.warn(keyPath, "Key %s is set in both data and stringData, the "+
+        "value of stringData is used.", key)
+    }
+    size += len(key) + len(appSpecObject.StringData[key])
+  }
+
+  if size > kMaxConfigDataSize {
+    run.add("data", "%s data has %d bytes, more than the limit of %d.", kind,
+      size, kMaxConfigDataSize)
+  } else if len(appSpecObject.Data) == 0 &&
+    len(appSpecObject.StringData) == 0 {
+    run.warn("data", "%s has no data.", kind)
+  }
+}
+
+// Validates the items of a volume of a ConfigMap or Secret, which project
+// some of its keys to the given files of the volume.
+func (run *validationRun) validateKeyPaths(items []*KeyToPath,
+  itemsPath string) {
+  paths := make(map[string]bool)
+  for i, item := range items {
+    itemPath := fieldpath.Index(itemsPath, i)
+    if item == nil {
+      run.add(itemPath, "Item empty.")
+      continue
+    }
+    if item.Key == nil {
+      run.add(itemPath+".key", "Item key missing.")
+    }
+    if item.Path == nil {
+      run.add(itemPath+".path", "Item path missing.")
+      continue
+    }
+    filePath := *item.Path
+    if filePath == "" || path.IsAbs(filePath) ||
+      strings.Contains("/"+filePath+"/", "/../") {
+      run.add(itemPath+".path", "Item path %s must be relative to the "+
+        "volume and must not contain '..'.", filePath)
+    } else if paths[path.Clean(filePath)] {
+      run.add(itemPath+".path", "Item path %s is not unique in the volume.",
+        filePath)
+    }
+    paths[path.Clean(filePath)] = true
+  }
+}
+
+// Validates a volume holding the keys of a ConfigMap or Secret.
+func (run *validationRun) validateConfigVolume(volume *VolumeSpec,
+  volumePath string) {
+  if volume.Type != nil || volume.FsType != nil || volume.VolumeName != nil {
+    run.add(volumePath, "Volume of a ConfigMap or Secret can not have "+
+      "volumeType, fsType or volumeName.")
+  }
+  if volume.ConfigMap != nil && volume.Secret != nil {
+    run.add(volumePath, "Volume can not hold both a ConfigMap and a Secret.")
+  }
+  if volume.ConfigMap != nil {
+    if volume.ConfigMap.Name == nil {
+      run.add(volumePath+".configMap.name", "Volume configMap name missing.")
+    }
+    run.validateKeyPaths(volume.ConfigMap.Items, volumePath+".configMap.items")
+  }
+  if volume.Secret != nil {
+    if volume.Secret.SecretName == nil {
+      run.add(volumePath+".secret.secretName",
+        "Volume secret secretName missing.")
+    }
+    run.validateKeyPaths(volume.Secret.Items, volumePath+".secret.items")
+  }
+}
+
+// Validates a reference from the env of a container to a key of a ConfigMap
+// or Secret.
+func (run *validationRun) validateKeySelector(selector *KeySelector,
+  field string, path string) {
+  if selector.Name == nil {
+    run.add(path+".name", "Env valueFrom %s name missing.", field)
+  }
+  if selector.Key == nil {
+    run.add(path+".key", "Env valueFrom %s key missing.", field)
+  }
+}
+
+// Validates the env and envFrom of a container.
+func (run *validationRun) validateContainerEnv(container *ContainerSpec,
+  path string) {
+  for i, env := range container.Env {
+    envPath := fieldpath.Index(path+".env", i)
+    if env == nil {
+      run.add(envPath, "Env empty.")
+      continue
+    }
+    if env.Name == nil {
+      run.add(envPath+".name", "Env name missing.")
+    }
+    if env.ValueFrom == nil {
+      continue
+    }
+    if env.Value != nil {
+      run.add(envPath, "Env can not have both value and valueFrom.")
+    }
+    source := env.ValueFrom
+    if (source.ConfigMapKeyRef != nil) == (source.SecretKeyRef != nil) {
+      run.add(envPath+".valueFrom", "Env valueFrom must have exactly one of "+
+        "configMapKeyRef and secretKeyRef.")
+    }
+    if source.ConfigMapKeyRef != nil {
+      run.validateKeySelector(source.ConfigMapKeyRef, "configMapKeyRef",
+        envPath+".valueFrom.configMapKeyRef")
+    }
+    if source.SecretKeyRef != nil {
+      run.validateKeySelector(source.SecretKeyRef, "secretKeyRef",
+        envPath+".valueFrom.secretKeyRef")
+    }
+  }
+
+  for i, envFrom := range container.EnvFrom {
+    envFromPath := fieldpath.Index(path+".envFrom", i)
+    if envFrom == nil {
+      run.add(envFromPath, "EnvFrom empty.")
+      continue
+    }
+    if (envFrom.ConfigMapRef != nil) == (envFrom.SecretRef != nil) {
+      run.add(envFromPath, "EnvFrom must have exactly one of configMapRef "+
+        "and secretRef.")
+    }
+    if envFrom.ConfigMapRef != nil && envFrom.ConfigMapRef.Name == nil {
+      run.add(envFromPath+".configMapRef.name",
+        "EnvFrom configMapRef name missing.")
+    }
+    if envFrom.SecretRef != nil && envFrom.SecretRef.Name == nil {
+      run.add(envFromPath+".secretRef.name", "EnvFrom secretRef name missing.")
+    }
+    if envFrom.Prefix != nil && *envFrom.Prefix != "" &&
+      !IsEnvName(*envFrom.Prefix) {
+      run.add(envFromPath+".prefix", "Invalid envFrom prefix %s, expected "+
+        "letters, digits and underscores, not starting with a digit.",
+        *envFrom.Prefix)
+    }
+  }
+}
+
+// Returns the severity of a reference to a missing ConfigMap, Secret or key.
+// The pod starts without them if the reference is optional.
+func referenceSeverity(optional *bool) Severity {
+  if optional != nil && *optional {
+    return SeverityWarning
+  }
+  return SeverityError
+}
+
+// Returns the ConfigMap or Secret named by a reference at path, or nil if it
+// is not in the appspec.
+func (run *validationRun) lookupConfig(configs map[Pair]*Document,
+  kind string, name *string, optional *bool, path string) *Document {
+  if name == nil {
+    return nil
+  }
+  config, ok := configs[Pair{kind, *name}]
+  if !ok {
+    run.addFinding(referenceSeverity(optional), path, "%s %s is not in the "+
+      "appspec.", kind, *name)
+    return nil
+  }
+  run.usedConfigs[config.Pair()] = true
+  return config
+}
+
+// Validates that the ConfigMap or Secret config, if any, has the key
+// referred to at path.
+func (run *validationRun) validateConfigKeyRef(config *Document, key *string,
+  optional *bool, path string) {
+  if config == nil || key == nil || config.AppSpec.hasKey(*key) {
+    return
+  }
+  run.addFinding(referenceSeverity(optional), path, "%s %s has no key %s.",
+    config.Kind(), config.Name(), *key)
+}
+
+// Validates a reference from env to a key of a ConfigMap or Secret.
+func (run *validationRun) validateKeyRef(configs map[Pair]*Document,
+  kind string, selector *KeySelector, path string) {
+  config := run.lookupConfig(configs, kind, selector.Name, selector.Optional,
+    path+".name")
+  run.validateConfigKeyRef(config, selector.Key, selector.Optional,
+    path+".key")
+}
+
+// Validates a volume of a ConfigMap or Secret and the keys it projects.
+func (run *validationRun) validateVolumeRef(configs map[Pair]*Document,
+  kind string, name *string, items []*KeyToPath, optional *bool,
+  path string, nameField string) {
+  config := run.lookupConfig(configs, kind, name, optional,
+    path+"."+nameField)
+  for i, item := range items {
+    if item != nil {
+      run.validateConfigKeyRef(config, item.Key, optional,
+        fieldpath.Index(path+".items", i)+".key")
+    }
+  }
+}
+
+// Validates that the ConfigMaps, Secrets and keys the containers and volumes
+// of a workload refer to are in the appspec.
+func (run *validationRun) validateConfigReferences(document *Document,
+  configs map[Pair]*Document) {
+  const path = "spec.template.spec"
+  spec := document.AppSpec.Spec
+  if spec == nil || spec.Template == nil ||
+    spec.Template.TemplateSpec == nil {
+    return
+  }
+  templateSpec := spec.Template.TemplateSpec
+
+  for i, container := range templateSpec.Containers {
+    if container == nil {
+      continue
+    }
+    containerPath := fieldpath.Index(path+".containers", i)
+    for j, env := range container.Env {
+      if env == nil || env.ValueFrom == nil {
+        continue
+      }
+      sourcePath := fieldpath.Index(containerPath+".env", j) + ".valueFrom"
+      if selector := env.ValueFrom.ConfigMapKeyRef; selector != nil {
+        run.validateKeyRef(configs, "ConfigMap", selector,
+          sourcePath+".configMapKeyRef")
+      }
+      if selector := env.ValueFrom.SecretKeyRef; selector != nil {
+        run.validateKeyRef(configs, "Secret", selector,
+          sourcePath+".secretKeyRef")
+      }
+    }
+    for j, envFrom := range container.EnvFrom {
+      if envFrom == nil {
+        continue
+      }
+      envFromPath := fieldpath.Index(containerPath+".envFrom", j)
+      if ref := envFrom.ConfigMapRef; ref != nil {
+        run.lookupConfig(configs, "ConfigMap", ref.Name, ref.Optional,
+          envFromPath+".configMapRef.name")
+      }
+      if ref := envFrom.SecretRef; ref != nil {
+        run.lookupConfig(configs, "Secret", ref.Name, ref.Optional,
+          envFromPath+".secretRef.name")
+      }
+    }
+  }
+
+  for i, volume := range templateSpec.Volumes {
+    if volume == nil {
+      continue
+    }
+    volumePath := fieldpath.Index(path+".volumes", i)
+    if source := volume.ConfigMap; source != nil {
+      run.validateVolumeRef(configs, "ConfigMap", source.Name, source.Items,
+        source.Optional, volumePath+".configMap", "name")
+    }
+    if source := volume.Secret; source != nil {
+      run.validateVolumeRef(configs, "Secret", source.SecretName,
+        source.Items, source.Optional, volumePath+".secret", "secretName")
+    }
+  }
+}
+
+// Warns about the ConfigMaps and Secrets no workload refers to.
+func (run *validationRun) validateUnusedConfigs() {
+  for _, document := range run.documents {
+    if document.IsConfig() && !run.usedConfigs[document.Pair()] {
+      run.setDocument(document)
+      run.warn("metadata.name", "%s %s is not used by any container.",
+        document.Kind(), document.Name())
+    }
+  }
+}
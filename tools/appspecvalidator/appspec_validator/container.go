@@ -0,0 +1,287 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file validates the container fields beyond name, image, resources and
+// volumeMounts: command, ports, probes, securityContext and imagePullPolicy.
+
+package appspecvalidator
+
+import (
+  "regexp"
+  "strconv"
+  "strings"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/field_path"
+)
+
+const (
+  kMinPort int = 1
+  kMaxPort int = 65535
+
+  // Port names are IANA service names of at most 15 characters.
+  kMaxPortNameLength int = 15
+
+  kProtocolTcp  string = "TCP"
+  kProtocolUdp  string = "UDP"
+  kProtocolSctp string = "SCTP"
+
+  kImagePullPolicyAlways       string = "Always"
+  kImagePullPolicyIfNotPresent string = "IfNotPresent"
+  kImagePullPolicyNever        string = "Never"
+
+  kHttpSchemeHttp  string = "HTTP"
+  kHttpSchemeHttps string = "HTTPS"
+)
+
+var (
+  // Matches an IANA service name: lowercase alphanumerics and dashes, with at
+  // least one letter and no leading, trailing or doubled dash.
+  portNameRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+  portNameLetter = regexp.MustCompile(`[a-z]`)
+
+  // Matches a capability name as Kubernetes expects it, i.e. without the
+  // CAP_ prefix.
+  capabilityRegexp = regexp.MustCompile(`^[A-Z][A-Z_]*$`)
+)
+
+// Returns true if port is a valid port number.
+func isValidPort(port int) bool {
+  return port >= kMinPort && port <= kMaxPort
+}
+
+// Returns true if name is a valid port name.
+func isValidPortName(name string) bool {
+  return len(name) <= kMaxPortNameLength && portNameRegexp.MatchString(name) &&
+    portNameLetter.MatchString(name)
+}
+
+// Validates the fields of a container which are optional in the appspec.
+func (run *validationRun) validateContainerFields(container *ContainerSpec,
+  path string) {
+  if container.Command != nil && len(container.Command) == 0 {
+    run.add(path+".command", "Container command is empty.")
+  }
+
+  if container.ImagePullPolicy != nil {
+    switch *container.ImagePullPolicy {
+    case kImagePullPolicyIfNotPresent, kImagePullPolicyNever:
+    case kImagePullPolicyAlways:
+      // The images are shipped with the app, they are not in a registry.
+      run.warn(path+".imagePullPolicy", "ImagePullPolicy %s pulls the image "+
+        "from a registry, but app images are shipped with the app. Use %s.",
+        kImagePullPolicyAlways, kImagePullPolicyIfNotPresent)
+    default:
+      run.add(path+".imagePullPolicy", "Invalid imagePullPolicy %s, expected "+
+        "one of %s, %s, %s.", *container.ImagePullPolicy,
+        kImagePullPolicyAlways, kImagePullPolicyIfNotPresent,
+        kImagePullPolicyNever)
+    }
+  }
+
+  run.validateContainerPorts(container.Ports, path+".ports")
+  if container.LivenessProbe != nil {
+    run.validateProbe(container.LivenessProbe, container, true,
+      path+".livenessProbe")
+  }
+  if container.ReadinessProbe != nil {
+    run.validateProbe(container.ReadinessProbe, container, false,
+      path+".readinessProbe")
+  }
+  if container.SecurityContext != nil {
+    run.validateSecurityContext(container.SecurityContext,
+      path+".securityContext")
+  }
+}
+
+// Validates the ports of a container.
+func (run *validationRun) validateContainerPorts(ports []*ContainerPort,
+  path string) {
+  names := make(map[string]bool)
+  numbers := make(map[string]bool)
+  for i, port := range ports {
+    portPath := fieldpath.Index(path, i)
+    if port == nil {
+      run.add(portPath, "Container port empty.")
+      continue
+    }
+
+    protocol := kProtocolTcp
+    if port.Protocol != nil {
+      protocol = *port.Protocol
+      if protocol != kProtocolTcp && protocol != kProtocolUdp &&
+        protocol != kProtocolSctp {
+        run.add(portPath+".protocol", "Invalid protocol %s, expected one of "+
+          "%s, %s, %s.", protocol, kProtocolTcp, kProtocolUdp, kProtocolSctp)
+      }
+    }
+
+    if port.ContainerPort == nil {
+      run.add(portPath+".containerPort", "Container port containerPort "+
+        "missing.")
+    } else if !isValidPort(*port.ContainerPort) {
+      run.add(portPath+".containerPort", "Container port %d out of range "+
+        "%d-%d.", *port.ContainerPort, kMinPort, kMaxPort)
+    } else {
+      key := strconv.Itoa(*port.ContainerPort) + "/" + protocol
+      if numbers[key] {
+        run.add(portPath+".containerPort", "Container port %s is not "+
+          "unique in the container.", key)
+      }
+      numbers[key] = true
+    }
+
+    if port.HostPort != nil && !isValidPort(*port.HostPort) {
+      run.add(portPath+".hostPort", "Host port %d out of range %d-%d.",
+        *port.HostPort, kMinPort, kMaxPort)
+    }
+
+    if port.Name != nil {
+      if !isValidPortName(*port.Name) {
+        run.add(portPath+".name", "Invalid port name %s, expected at most %d "+
+          "lowercase letters, digits and dashes with at least one letter.",
+          *port.Name, kMaxPortNameLength)
+      } else if names[*port.Name] {
+        run.add(portPath+".name", "Port name %s is not unique in the "+
+          "container.", *port.Name)
+      }
+      names[*port.Name] = true
+    }
+  }
+}
+
+// Returns true if port refers to one of the ports declared by the container,
+// either by name or by number.
+func containerHasPort(container *ContainerSpec, port *IntOrString) bool {
+  for _, containerPort := range container.Ports {
+    if containerPort == nil {
+      continue
+    }
+    if port.IntVal != nil && containerPort.ContainerPort != nil &&
+      *port.IntVal == *containerPort.ContainerPort {
+      return true
+    }
+    if port.StrVal != nil && containerPort.Name != nil &&
+      *port.StrVal == *containerPort.Name {
+      return true
+    }
+  }
+  return false
+}
+
+// Validates the port a probe connects to.
+func (run *validationRun) validateProbePort(port *IntOrString,
+  container *ContainerSpec, path string) {
+  if port == nil {
+    run.add(path, "Probe port missing.")
+    return
+  }
+  if port.IntVal != nil && !isValidPort(*port.IntVal) {
+    run.add(path, "Probe port %d out of range %d-%d.", *port.IntVal, kMinPort,
+      kMaxPort)
+    return
+  }
+  if !containerHasPort(container, port) {
+    run.add(path, "Probe port %s is not declared in the ports of the "+
+      "container.", port)
+  }
+}
+
+// Validates a liveness or readiness probe of container.
+func (run *validationRun) validateProbe(probe *Probe, container *ContainerSpec,
+  liveness bool, path string) {
+  handlers := 0
+  if probe.Exec != nil {
+    handlers++
+    if len(probe.Exec.Command) == 0 {
+      run.add(path+".exec.command", "Probe exec command missing.")
+    }
+  }
+  if probe.HttpGet != nil {
+    handlers++
+    httpGetPath := path + ".httpGet"
+    run.validateProbePort(probe.HttpGet.Port, container, httpGetPath+".port")
+    if probe.HttpGet.Path != nil &&
+      !strings.HasPrefix(*probe.HttpGet.Path, "/") {
+      run.add(httpGetPath+".path", "Probe path %s must start with /.",
+        *probe.HttpGet.Path)
+    }
+    if probe.HttpGet.Scheme != nil &&
+      *probe.HttpGet.Scheme != kHttpSchemeHttp &&
+      *probe.HttpGet.Scheme != kHttpSchemeHttps {
+      run.add(httpGetPath+".scheme", "Invalid probe scheme %s, expected %s "+
+        "or %s.", *probe.HttpGet.Scheme, kHttpSchemeHttp, kHttpSchemeHttps)
+    }
+  }
+  if probe.TcpSocket != nil {
+    handlers++
+    run.validateProbePort(probe.TcpSocket.Port, container,
+      path+".tcpSocket.port")
+  }
+  if handlers != 1 {
+    run.add(path, "Probe must have exactly one of exec, httpGet and "+
+      "tcpSocket.")
+  }
+
+  if probe.InitialDelaySeconds != nil && *probe.InitialDelaySeconds < 0 {
+    run.add(path+".initialDelaySeconds", "Probe initialDelaySeconds must not "+
+      "be negative.")
+  }
+  fields := []string{"periodSeconds", "timeoutSeconds", "successThreshold",
+    "failureThreshold"}
+  values := []*int{probe.PeriodSeconds, probe.TimeoutSeconds,
+    probe.SuccessThreshold, probe.FailureThreshold}
+  for i, value := range values {
+    if value != nil && *value < 1 {
+      run.add(path+"."+fields[i], "Probe %s must be at least 1.", fields[i])
+    }
+  }
+  // A liveness probe only decides whether to restart the container, so a
+  // single success is all that can be required.
+  if liveness && probe.SuccessThreshold != nil && *probe.SuccessThreshold > 1 {
+    run.add(path+".successThreshold", "Liveness probe successThreshold must "+
+      "be 1.")
+  }
+}
+
+// Validates the securityContext of a container.
+func (run *validationRun) validateSecurityContext(
+  securityContext *SecurityContext, path string) {
+  if securityContext.RunAsUser != nil && *securityContext.RunAsUser < 0 {
+    run.add(path+".runAsUser", "RunAsUser must not be negative.")
+  }
+  if securityContext.RunAsGroup != nil && *securityContext.RunAsGroup < 0 {
+    run.add(path+".runAsGroup", "RunAsGroup must not be negative.")
+  }
+  if securityContext.RunAsNonRoot != nil && *securityContext.RunAsNonRoot &&
+    securityContext.RunAsUser != nil && *securityContext.RunAsUser == 0 {
+    run.add(path+".runAsUser", "RunAsUser 0 is root, which runAsNonRoot "+
+      "forbids.")
+  }
+  if securityContext.Privileged != nil && *securityContext.Privileged &&
+    securityContext.AllowPrivilegeEscalation != nil &&
+    !*securityContext.AllowPrivilegeEscalation {
+    run.add(path+".allowPrivilegeEscalation", "AllowPrivilegeEscalation "+
+      "can not be false for a privileged container.")
+  }
+
+  if securityContext.Capabilities == nil {
+    return
+  }
+  run.validateCapabilities(securityContext.Capabilities.Add,
+    path+".capabilities.add")
+  run.validateCapabilities(securityContext.Capabilities.Drop,
+    path+".capabilities.drop")
+}
+
+// Validates a list of capabilities to add or drop.
+func (run *validationRun) validateCapabilities(capabilities []string,
+  path string) {
+  for i, capability := range capabilities {
+    capabilityPath := fieldpath.Index(path, i)
+    if strings.HasPrefix(capability, "CAP_") {
+      run.add(capabilityPath, "Capability %s must be given without the "+
+        "CAP_ prefix.", capability)
+    } else if !capabilityRegexp.MatchString(capability) {
+      run.add(capabilityPath, "Invalid capability %s.", capability)
+    }
+  }
+}
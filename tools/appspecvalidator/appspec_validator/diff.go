@@ -0,0 +1,151 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file writes the changes made to an appspec as a unified diff.
+
+package appspecvalidator
+
+import (
+  "fmt"
+  "strings"
+)
+
+const (
+  // Number of unchanged lines shown around each change.
+  kDiffContextLines int = 3
+)
+
+// diffLine is a line of a diff, prefixed by ' ', '-' or '+'.
+type diffLine struct {
+  op   byte
+  text string
+}
+
+// Returns the lines of text. A final line ending does not start a line.
+func diffLines(text string) []string {
+  if text == "" {
+    return nil
+  }
+  return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Returns the edit script turning oldLines into newLines, computed from their
+// longest common subsequence. Appspecs are small, so the quadratic table is
+// fine.
+func editScript(oldLines []string, newLines []string) []diffLine {
+  // common[i][j] is the length of the longest common subsequence of
+  // oldLines[i:] and newLines[j:].
+  common := make([][]int, len(oldLines)+1)
+  for i := range common {
+    common[i] = make([]int, len(newLines)+1)
+  }
+  for i := len(oldLines) - 1; i >= 0; i-- {
+    for j := len(newLines) - 1; j >= 0; j-- {
+      if oldLines[i] == newLines[j] {
+        common[i][j] = common[i+1][j+1] + 1
+      } else if common[i+1][j] >= common[i][j+1] {
+        common[i][j] = common[i+1][j]
+      } else {
+        common[i][j] = common[i][j+1]
+      }
+    }
+  }
+
+  script := make([]diffLine, 0, len(oldLines)+len(newLines))
+  i, j := 0, 0
+  for i < len(oldLines) || j < len(newLines) {
+    switch {
+    case i < len(oldLines) && j < len(newLines) && oldLines[i] == newLines[j]:
+      script = append(script, diffLine{' ', oldLines[i]})
+      i++
+      j++
+    case j == len(newLines) ||
+      i < len(oldLines) && common[i+1][j] >= common[i][j+1]:
+      script = append(script, diffLine{'-', oldLines[i]})
+      i++
+    default:
+      script = append(script, diffLine{'+', newLines[j]})
+      j++
+    }
+  }
+  return script
+}
+
+// Returns the range of a hunk in the format of unified diff headers.
+func hunkRange(start int, count int) string {
+  if count == 0 {
+    // An empty range is given by the line before it.
+    return fmt.Sprintf("%d,0", start-1)
+  }
+  if count == 1 {
+    return fmt.Sprintf("%d", start)
+  }
+  return fmt.Sprintf("%d,%d", start, count)
+}
+
+// UnifiedDiff returns the unified diff turning oldText, the content of the
+// file oldName, into newText, the content of newName. It returns "" if the
+// texts are the same.
+func UnifiedDiff(oldName string, newName string, oldText string,
+  newText string) string {
+  if oldText == newText {
+    return ""
+  }
+  script := editScript(diffLines(oldText), diffLines(newText))
+
+  var diff strings.Builder
+  fmt.Fprintf(&diff, "--- %s\n+++ %s\n", oldName, newName)
+  for start := 0; start < len(script); {
+    // Find the next change and the hunk around it.
+    for start < len(script) && script[start].op == ' ' {
+      start++
+    }
+    if start == len(script) {
+      break
+    }
+    hunkStart := start - kDiffContextLines
+    if hunkStart < 0 {
+      hunkStart = 0
+    }
+    // Extend the hunk while the next change is close enough to share
+    // context lines with the previous one.
+    lastChange := start
+    for i := start; i < len(script); i++ {
+      if script[i].op != ' ' {
+        lastChange = i
+      } else if i-lastChange > 2*kDiffContextLines {
+        break
+      }
+    }
+    hunkEnd := lastChange + 1 + kDiffContextLines
+    if hunkEnd > len(script) {
+      hunkEnd = len(script)
+    }
+
+    // Line numbers of the start of the hunk in both texts.
+    oldLine, newLine := 1, 1
+    for _, line := range script[:hunkStart] {
+      if line.op != '+' {
+        oldLine++
+      }
+      if line.op != '-' {
+        newLine++
+      }
+    }
+    oldCount, newCount := 0, 0
+    for _, line := range script[hunkStart:hunkEnd] {
+      if line.op != '+' {
+        oldCount++
+      }
+      if line.op != '-' {
+        newCount++
+      }
+    }
+    fmt.Fprintf(&diff, "@@ -%s +%s @@\n", hunkRange(oldLine, oldCount),
+      hunkRange(newLine, newCount))
+    for _, line := range script[hunkStart:hunkEnd] {
+      fmt.Fprintf(&diff, "%c%s\n", line.op, line.text)
+    }
+    start = hunkEnd
+  }
+  return diff.String()
+}
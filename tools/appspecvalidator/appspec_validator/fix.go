@@ -0,0 +1,376 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file implements the automatic fixes of appspec mistakes which have
+// exactly one correct answer. The fixes are found and built on the YAML node
+// tree of each object, then applied as edits at the positions of the nodes,
+// so the comments, key order and formatting of the appspec are kept.
+
+package appspecvalidator
+
+import (
+  "bytes"
+  "fmt"
+  "regexp"
+  "sort"
+  "strings"
+  "unicode/utf8"
+
+  "gopkg.in/yaml.v3"
+)
+
+var (
+  // Matches a byte quantity field of a container, the only quantities whose
+  // suffix is fixed.
+  quantityFieldRegexp = regexp.MustCompile(
+    `\.resources\.(requests|limits)\.(memory|ephemeral-storage)$`)
+  // Splits a quantity into its number and its suffix.
+  quantitySuffixRegexp = regexp.MustCompile(`^([^A-Za-z]*)([A-Za-z]+)$`)
+)
+
+// Fix describes a fix applied to an appspec.
+type Fix struct {
+  // Path of the appspec file, if known.
+  File string
+  // Line and column of the fixed node in the original appspec.
+  Line   int
+  Column int
+  // Zero based index of the YAML document of the fixed object.
+  Document int
+  // Kind and name of the fixed object, if known.
+  Kind string
+  Name string
+  // Path of the fixed field within the document.
+  Field string
+  // Description of the fix.
+  Description string
+
+  edit *textEdit
+}
+
+func (fix *Fix) String() string {
+  str := fmt.Sprintf("%s:%d:%d %s: %s", fix.File, fix.Line, fix.Column,
+    fix.Field, fix.Description)
+  if fix.Kind != "" {
+    str += fmt.Sprintf(" (%s %s)", fix.Kind, fix.Name)
+  }
+  return str
+}
+
+// textEdit replaces length bytes at the given line and column of the appspec
+// with text. Insertions have a length of zero.
+type textEdit struct {
+  // One based line, and one based column in runes, as YAML nodes have.
+  line   int
+  column int
+  length int
+  text   string
+}
+
+// Returns the length in bytes of the scalar token starting at offset in line.
+// A quoted scalar ends with its quote, a plain one at a comment or the end of
+// the line.
+func scalarLength(line string, offset int) int {
+  if offset >= len(line) {
+    return 0
+  }
+  if quote := line[offset]; quote == '"' || quote == '\'' {
+    if end := strings.IndexByte(line[offset+1:], quote); end >= 0 {
+      return end + 2
+    }
+    return len(line) - offset
+  }
+  end := len(line)
+  if comment := strings.Index(line[offset:], " #"); comment >= 0 {
+    end = offset + comment
+  }
+  return len(strings.TrimRight(line[offset:end], " \t\r"))
+}
+
+// Returns the byte offset in line of the one based column column.
+func columnOffset(line string, column int) int {
+  offset := 0
+  for i := 1; i < column && offset < len(line); i++ {
+    _, size := utf8.DecodeRuneInString(line[offset:])
+    offset += size
+  }
+  return offset
+}
+
+// Returns the value of node as it is written in YAML, keeping the quotes of
+// node if it has any.
+func quotedValue(node *yaml.Node, value string) string {
+  switch {
+  case node.Style&yaml.DoubleQuotedStyle != 0:
+    return `"` + value + `"`
+  case node.Style&yaml.SingleQuotedStyle != 0:
+    return "'" + value + "'"
+  }
+  return value
+}
+
+// fixRun holds the state of a single fixing of an appspec.
+type fixRun struct {
+  file  string
+  lines []string
+  fixes []*Fix
+}
+
+// Sets the scalar node of field of document to value.
+func (run *fixRun) setScalar(document *Document, field string, node *yaml.Node,
+  value string, description string) {
+  line := ""
+  if node.Line <= len(run.lines) {
+    line = run.lines[node.Line-1]
+  }
+  offset := columnOffset(line, node.Column)
+  edit := &textEdit{
+    line:   node.Line,
+    column: node.Column,
+    length: scalarLength(line, offset),
+    text:   quotedValue(node, value),
+  }
+  node.Value = value
+  run.addFix(document, field, node, description, edit)
+}
+
+// Inserts the key and value nodes as an entry of mapping before the entry
+// whose key node is before. The entry is written as lines indented like
+// before.
+func (run *fixRun) insertEntry(document *Document, field string,
+  mapping *yaml.Node, before *yaml.Node, key *yaml.Node, value *yaml.Node,
+  description string) {
+  entry := &yaml.Node{Kind: yaml.MappingNode,
+    Content: []*yaml.Node{key, value}}
+  var buffer bytes.Buffer
+  encoder := yaml.NewEncoder(&buffer)
+  encoder.SetIndent(2)
+  // Encoding mappings of plain scalars into memory does not fail.
+  encoder.Encode(entry)
+  encoder.Close()
+
+  indent := strings.Repeat(" ", before.Column-1)
+  text := ""
+  for _, line := range strings.SplitAfter(buffer.String(), "\n") {
+    if line != "" {
+      text += indent + line
+    }
+  }
+
+  for i := 0; i < len(mapping.Content); i += 2 {
+    if mapping.Content[i] == before {
+      content := append([]*yaml.Node{}, mapping.Content[:i]...)
+      content = append(content, key, value)
+      mapping.Content = append(content, mapping.Content[i:]...)
+      break
+    }
+  }
+  run.addFix(document, field, before, description,
+    &textEdit{line: before.Line, column: 1, text: text})
+}
+
+// Records a fix of field of document at the position of node.
+func (run *fixRun) addFix(document *Document, field string, node *yaml.Node,
+  description string, edit *textEdit) {
+  run.fixes = append(run.fixes, &Fix{
+    File:        run.file,
+    Line:        node.Line,
+    Column:      node.Column,
+    Document:    document.Index,
+    Kind:        document.Kind(),
+    Name:        document.Name(),
+    Field:       field,
+    Description: description,
+    edit:        edit,
+  })
+}
+
+// Sets the apiVersion of the object to the one its kind requires.
+func (run *fixRun) fixApiVersion(document *Document) {
+  apiVersion := ExpectedApiVersion(document.Kind())
+  if apiVersion == "" || document.Node.Kind != yaml.MappingNode ||
+    document.Node.Style&yaml.FlowStyle != 0 {
+    return
+  }
+  description := "Set apiVersion to " + apiVersion + "."
+  node, ok := document.nodes["apiVersion"]
+  if ok && node.Kind == yaml.ScalarNode && node.Tag != "!!null" {
+    if node.Value != apiVersion {
+      run.setScalar(document, "apiVersion", node, apiVersion, description)
+    }
+    return
+  }
+  if ok || len(document.Node.Content) == 0 {
+    // An empty apiVersion has no node to edit in place.
+    return
+  }
+  run.insertEntry(document, "apiVersion", document.Node,
+    document.Node.Content[0],
+    &yaml.Node{Kind: yaml.ScalarNode, Value: "apiVersion"},
+    &yaml.Node{Kind: yaml.ScalarNode, Value: apiVersion}, description)
+}
+
+// Adds the selector of a workload which has none, matching the labels of its
+// template. A Job does not need a selector.
+func (run *fixRun) fixSelector(document *Document) {
+  if !kindOf(document.Kind()).RequiresSelector {
+    return
+  }
+  spec, ok := document.nodes["spec"]
+  if !ok || spec.Kind != yaml.MappingNode || spec.Style&yaml.FlowStyle != 0 {
+    return
+  }
+  if _, ok := document.nodes["spec.selector"]; ok {
+    return
+  }
+  labels, ok := document.nodes["spec.template.metadata.labels"]
+  if !ok || labels.Kind != yaml.MappingNode || len(labels.Content) == 0 {
+    return
+  }
+
+  matchLabels := &yaml.Node{Kind: yaml.MappingNode}
+  for i := 0; i+1 < len(labels.Content); i += 2 {
+    key, value := labels.Content[i], labels.Content[i+1]
+    if key.Kind != yaml.ScalarNode || value.Kind != yaml.ScalarNode {
+      return
+    }
+    // Labels are strings, so have them quoted if they look like numbers.
+    matchLabels.Content = append(matchLabels.Content,
+      &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.Value},
+      &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value.Value})
+  }
+  // Add the selector before the template, where it is usually written.
+  before := spec.Content[0]
+  for i := 0; i < len(spec.Content); i += 2 {
+    if spec.Content[i].Value == "template" {
+      before = spec.Content[i]
+    }
+  }
+  run.insertEntry(document, "spec.selector", spec, before,
+    &yaml.Node{Kind: yaml.ScalarNode, Value: "selector"},
+    &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+      &yaml.Node{Kind: yaml.ScalarNode, Value: "matchLabels"},
+      matchLabels,
+    }},
+    "Add the selector matching the template labels "+
+      formatLabels(labelsOfNode(labels))+".")
+}
+
+// Returns the labels held by the mapping node.
+func labelsOfNode(node *yaml.Node) map[string]string {
+  labels := make(map[string]string)
+  for i := 0; i+1 < len(node.Content); i += 2 {
+    labels[node.Content[i].Value] = node.Content[i+1].Value
+  }
+  return labels
+}
+
+// Returns the valid suffixes a quantity suffix written in the wrong case may
+// stand for. A one letter suffix may also be a binary suffix missing its i,
+// e.g. K may stand for k or Ki.
+func quantitySuffixCandidates(suffix string) []string {
+  var candidates []string
+  for validSuffix := range binarySIMap {
+    if strings.EqualFold(suffix, validSuffix) ||
+      strings.EqualFold(suffix+"i", validSuffix) {
+      candidates = append(candidates, validSuffix)
+    }
+  }
+  for validSuffix := range decimalSIMap {
+    if validSuffix != "" && strings.EqualFold(suffix, validSuffix) {
+      candidates = append(candidates, validSuffix)
+    }
+  }
+  sort.Strings(candidates)
+  return candidates
+}
+
+// Corrects the case of the binary suffix of memory and ephemeral-storage
+// quantities, e.g. ki to Ki. A suffix is only corrected if it can stand for a
+// single valid suffix, so 1K, which may be 1k or 1Ki, is left alone. Cpu
+// quantities are never fixed, since m and M, or mi and Mi, differ by a factor
+// of a billion there.
+func (run *fixRun) fixQuantitySuffixes(document *Document) {
+  fields := make([]string, 0)
+  for field := range document.nodes {
+    if quantityFieldRegexp.MatchString(field) {
+      fields = append(fields, field)
+    }
+  }
+  sort.Strings(fields)
+  for _, field := range fields {
+    node := document.nodes[field]
+    if node.Kind != yaml.ScalarNode {
+      continue
+    }
+    if _, err := ParseQuantity(node.Value); err == nil {
+      continue
+    }
+    match := quantitySuffixRegexp.FindStringSubmatch(node.Value)
+    if match == nil {
+      continue
+    }
+    candidates := quantitySuffixCandidates(match[2])
+    if len(candidates) != 1 {
+      continue
+    }
+    suffix := candidates[0]
+    value := match[1] + suffix
+    // Memory is a whole number of bytes, a fix must not make it fractional.
+    if quantity, err := ParseQuantity(value); err != nil ||
+      !quantity.IsWhole() {
+      continue
+    }
+    run.setScalar(document, field, node, value,
+      fmt.Sprintf("Change the suffix %s to %s.", match[2], suffix))
+  }
+}
+
+// Applies the edits of the fixes to the lines of the appspec and returns the
+// fixed appspec.
+func (run *fixRun) apply() []byte {
+  edits := make([]*textEdit, 0, len(run.fixes))
+  for _, fix := range run.fixes {
+    edits = append(edits, fix.edit)
+  }
+  // Apply the edits from the end, so that the positions of the others hold.
+  sort.SliceStable(edits, func(i, j int) bool {
+    if edits[i].line != edits[j].line {
+      return edits[i].line > edits[j].line
+    }
+    return edits[i].column > edits[j].column
+  })
+  lines := append([]string{}, run.lines...)
+  for _, edit := range edits {
+    line := lines[edit.line-1]
+    offset := columnOffset(line, edit.column)
+    lines[edit.line-1] = line[:offset] + edit.text +
+      line[offset+edit.length:]
+  }
+  return []byte(strings.Join(lines, "\n"))
+}
+
+// FixAppSpec applies the fixes of the mistakes which have exactly one correct
+// answer to the appspec data:
+//   - a wrong or missing apiVersion for the kind of the object;
+//   - a missing selector of a workload other than a Job, which is derived from
+//     the labels of its template;
+//   - a binary memory or ephemeral-storage suffix in the wrong case, e.g. ki
+//     instead of Ki, when it can only stand for one suffix.
+// It returns the fixed appspec and the applied fixes. fileName is only used
+// to report the position of the fixes.
+func FixAppSpec(data []byte, fileName string) ([]byte, []*Fix, error) {
+  documents, _, err := NewValidator().validate(bytes.NewReader(data), fileName)
+  if err != nil {
+    return nil, nil, err
+  }
+  run := &fixRun{file: fileName, lines: strings.Split(string(data), "\n")}
+  for _, document := range documents {
+    run.fixApiVersion(document)
+    run.fixSelector(document)
+    run.fixQuantitySuffixes(document)
+  }
+  if len(run.fixes) == 0 {
+    return data, nil, nil
+  }
+  return run.apply(), run.fixes, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file tests the automatic fixes of quantity suffixes.
+
+package appspecvalidator
+
+import (
+  "fmt"
+  "strings"
+  "testing"
+)
+
+// Returns a Job whose container has the given resources, indented under
+// resources.
+func jobWithResources(resources string) string {
+  return `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: job
+spec:
+  template:
+    spec:
+      restartPolicy: Never
+      containers:
+      - name: job
+        image: job:1.0
+        resources:
+` + resources
+}
+
+func TestFixAppSpecQuantitySuffixes(t *testing.T) {
+  tests := []struct {
+    name      string
+    resources string
+    // The fixed resources, or "" if nothing is fixed.
+    fixed string
+  }{
+    {
+      name:      "memory",
+      resources: "          requests:\n            memory: 1mi\n",
+      fixed:     "          requests:\n            memory: 1Mi\n",
+    },
+    {
+      name:      "memory all caps",
+      resources: "          limits:\n            memory: 2KI\n",
+      fixed:     "          limits:\n            memory: 2Ki\n",
+    },
+    {
+      name: "ephemeral-storage",
+      resources: "          requests:\n" +
+        "            ephemeral-storage: 10gi\n",
+      fixed: "          requests:\n" +
+        "            ephemeral-storage: 10Gi\n",
+    },
+    {
+      name:      "quoted memory",
+      resources: "          requests:\n            memory: \"512mi\"\n",
+      fixed:     "          requests:\n            memory: \"512Mi\"\n",
+    },
+    {
+      // mi and Mi differ by a factor of a billion for cpu.
+      name:      "cpu",
+      resources: "          requests:\n            cpu: 1mi\n",
+    },
+    {
+      name:      "cpu limit",
+      resources: "          limits:\n            cpu: 1KI\n",
+    },
+    {
+      // K may be k or Ki.
+      name:      "ambiguous K",
+      resources: "          requests:\n            memory: 1K\n",
+    },
+    {
+      // g may be G or Gi.
+      name:      "ambiguous g",
+      resources: "          requests:\n            memory: 1g\n",
+    },
+    {
+      // 0.1Ki is not a whole number of bytes.
+      name:      "fractional bytes",
+      resources: "          requests:\n            memory: 0.1ki\n",
+    },
+    {
+      name:      "valid",
+      resources: "          requests:\n            memory: 1Mi\n",
+    },
+  }
+  for _, test := range tests {
+    data := []byte(jobWithResources(test.resources))
+    fixedData, fixes, err := FixAppSpec(data, "spec.yaml")
+    if err != nil {
+      t.Errorf("%s: FixAppSpec failed: %v", test.name, err)
+      continue
+    }
+    if test.fixed == "" {
+      if len(fixes) != 0 || string(fixedData) != string(data) {
+        t.Errorf("%s: expected no fix, got %v:\n%s", test.name, fixes,
+          fixedData)
+      }
+      continue
+    }
+    if len(fixes) != 1 {
+      t.Errorf("%s: expected 1 fix, got %v", test.name, fixes)
+      continue
+    }
+    if expected := jobWithResources(test.fixed); string(fixedData) !=
+      expected {
+      t.Errorf("%s: fixed appspec is\n%s\nexpected\n%s", test.name,
+        fixedData, expected)
+    }
+    if !strings.HasPrefix(fixes[0].Field, kContainersPath+"[0].resources.") {
+      t.Errorf("%s: fix of unexpected field %s", test.name, fixes[0].Field)
+    }
+  }
+}
+
+func TestQuantitySuffixCandidates(t *testing.T) {
+  tests := map[string]string{
+    "mi": "[Mi]",
+    "KI": "[Ki]",
+    "K":  "[Ki k]",
+    "g":  "[G Gi]",
+    "x":  "[]",
+  }
+  for suffix, expected := range tests {
+    candidates := fmt.Sprint(quantitySuffixCandidates(suffix))
+    if candidates != expected {
+      t.Errorf("quantitySuffixCandidates(%q) = %s, expected %s", suffix,
+        candidates, expected)
+    }
+  }
+}
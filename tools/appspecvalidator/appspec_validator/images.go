@@ -0,0 +1,322 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file checks that every image the containers of an appspec run is
+// shipped with the app. Images are shipped as the tarballs written by
+// docker save, which list the images they hold in manifest.json, or in the
+// repositories file for older versions of docker.
+
+package appspecvalidator
+
+import (
+  "archive/tar"
+  "bufio"
+  "bytes"
+  "compress/gzip"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+)
+
+const (
+  kImageManifestFile     string = "manifest.json"
+  kImageRepositoriesFile string = "repositories"
+  kDefaultImageTag       string = "latest"
+
+  // Offset and magic of the ustar header of tar archives.
+  kTarMagicOffset int    = 257
+  kTarMagic       string = "ustar"
+)
+
+var (
+  // The registry and namespace docker assumes for short image names.
+  defaultImagePrefixes = []string{"docker.io/", "index.docker.io/",
+    "library/"}
+
+  // ErrNotImageTarball is returned for a tar archive which was not written by
+  // docker save.
+  ErrNotImageTarball = errors.New("Not a docker save tarball.")
+)
+
+// ShippedImage is an image saved in a tarball shipped with the app.
+type ShippedImage struct {
+  // Reference of the image, e.g. view-browser:latest.
+  Ref string
+  // Path of the tarball.
+  File string
+}
+
+// invalidManifestError is returned for a tar archive whose manifest.json or
+// repositories file is not the one docker save writes, e.g. an app bundle.
+type invalidManifestError struct {
+  path string
+  file string
+  err  error
+}
+
+func (err *invalidManifestError) Error() string {
+  return fmt.Sprintf("%s: Invalid %s. %v", err.path, err.file, err.err)
+}
+
+// imageUse is the first container found running an image of a repository.
+type imageUse struct {
+  document *Document
+  // Path of the image field of the container.
+  field string
+  image string
+}
+
+// imageManifest is an entry of the manifest.json of a docker save tarball.
+type imageManifest struct {
+  RepoTags []string `json:"RepoTags"`
+}
+
+// NormalizeImageRef returns the reference of an image in the form docker save
+// writes it: with a tag, latest by default, and without the default registry.
+// References by digest are returned as is.
+func NormalizeImageRef(ref string) string {
+  if strings.Contains(ref, "@") {
+    return ref
+  }
+  for _, prefix := range defaultImagePrefixes {
+    ref = strings.TrimPrefix(ref, prefix)
+  }
+  if strings.LastIndex(ref, ":") <= strings.LastIndex(ref, "/") {
+    ref += ":" + kDefaultImageTag
+  }
+  return ref
+}
+
+// Returns the repository of a normalized image reference, i.e. the reference
+// without its tag.
+func imageRepository(ref string) string {
+  return ref[:strings.LastIndex(ref, ":")]
+}
+
+// Returns true if the file starting with header is a tar archive.
+func isTarHeader(header []byte) bool {
+  return len(header) >= kTarMagicOffset+len(kTarMagic) &&
+    string(header[kTarMagicOffset:kTarMagicOffset+len(kTarMagic)]) ==
+      kTarMagic
+}
+
+// Returns a reader of the tar archive in the file, which may be gzipped, or
+// nil if the file is not a tar archive.
+func tarReader(file io.Reader) (*tar.Reader, error) {
+  reader := bufio.NewReader(file)
+  if magic, _ := reader.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+    gzipReader, err := gzip.NewReader(reader)
+    if err != nil {
+      return nil, err
+    }
+    reader = bufio.NewReader(gzipReader)
+  }
+  header, _ := reader.Peek(kTarMagicOffset + len(kTarMagic))
+  if !isTarHeader(header) {
+    return nil, nil
+  }
+  return tar.NewReader(reader), nil
+}
+
+// ReadImageTarball returns the images saved in the docker save tarball at
+// path, which may be gzipped.
+func ReadImageTarball(path string) ([]*ShippedImage, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  archive, err := tarReader(file)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %v", path, err)
+  }
+  if archive == nil {
+    return nil, fmt.Errorf("%s is not a tar archive.", path)
+  }
+
+  var manifests []*imageManifest
+  repositories := make(map[string]map[string]string)
+  hasManifest := false
+  for {
+    header, err := archive.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    var target interface{}
+    switch filepath.Clean(header.Name) {
+    case kImageManifestFile:
+      target = &manifests
+    case kImageRepositoriesFile:
+      target = &repositories
+    default:
+      continue
+    }
+    data, err := ioutil.ReadAll(archive)
+    if err != nil {
+      return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    if err := json.Unmarshal(data, target); err != nil {
+      return nil, &invalidManifestError{path: path, file: header.Name,
+        err: err}
+    }
+    hasManifest = true
+  }
+  if !hasManifest {
+    return nil, ErrNotImageTarball
+  }
+
+  // The same image is usually listed by both files.
+  refs := make(map[string]bool)
+  for _, manifest := range manifests {
+    if manifest == nil {
+      continue
+    }
+    for _, repoTag := range manifest.RepoTags {
+      refs[NormalizeImageRef(repoTag)] = true
+    }
+  }
+  for repository, tags := range repositories {
+    for tag := range tags {
+      refs[NormalizeImageRef(repository+":"+tag)] = true
+    }
+  }
+  sortedRefs := make([]string, 0, len(refs))
+  for ref := range refs {
+    sortedRefs = append(sortedRefs, ref)
+  }
+  sort.Strings(sortedRefs)
+  images := make([]*ShippedImage, 0, len(sortedRefs))
+  for _, ref := range sortedRefs {
+    images = append(images, &ShippedImage{Ref: ref, File: path})
+  }
+  return images, nil
+}
+
+// Returns true if the file at path is a tar archive, which may be gzipped.
+func isTarFile(path string) bool {
+  file, err := os.Open(path)
+  if err != nil {
+    return false
+  }
+  defer file.Close()
+  archive, err := tarReader(file)
+  return err == nil && archive != nil
+}
+
+// LoadImages returns the images saved in the given docker save tarballs. A
+// directory, such as the package directory of an app, stands for all the
+// docker save tarballs under it, whatever their names. The other files under
+// it, including tar archives which are not docker save tarballs, are skipped.
+func LoadImages(paths []string) ([]*ShippedImage, error) {
+  images := []*ShippedImage{}
+  for _, path := range paths {
+    info, err := os.Stat(path)
+    if err != nil {
+      return nil, err
+    }
+    if !info.IsDir() {
+      tarballImages, err := ReadImageTarball(path)
+      if err == ErrNotImageTarball {
+        return nil, fmt.Errorf("%s is not a docker save tarball, it has no "+
+          "%s or %s.", path, kImageManifestFile, kImageRepositoriesFile)
+      }
+      if err != nil {
+        return nil, err
+      }
+      images = append(images, tarballImages...)
+      continue
+    }
+    err = filepath.Walk(path, func(file string, info os.FileInfo,
+      err error) error {
+      if err != nil || !info.Mode().IsRegular() || !isTarFile(file) {
+        return err
+      }
+      // Other tar archives, like app bundles, may be in the directory too.
+      tarballImages, err := ReadImageTarball(file)
+      if _, ok := err.(*invalidManifestError); ok ||
+        err == ErrNotImageTarball {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      images = append(images, tarballImages...)
+      return nil
+    })
+    if err != nil {
+      return nil, err
+    }
+  }
+  return images, nil
+}
+
+// Checks that the image of the current container, given at path, is one of
+// the images of the Validator.
+func (run *validationRun) validateImage(image string, path string) {
+  images := run.validator.Images
+  if images == nil || image == "" {
+    return
+  }
+  ref := NormalizeImageRef(image)
+  if strings.Contains(ref, "@") {
+    run.warn(path, "Image %s is referenced by digest, which docker save "+
+      "does not record. It can not be matched with the shipped images.",
+      image)
+    return
+  }
+  run.usedImages[ref] = true
+  if _, ok := run.repositoryUses[imageRepository(ref)]; !ok {
+    run.repositoryUses[imageRepository(ref)] = &imageUse{
+      document: run.documents[len(run.documents)-1],
+      field:    path,
+      image:    image,
+    }
+  }
+
+  var tags []string
+  for _, shipped := range images {
+    if shipped.Ref == ref {
+      return
+    }
+    if imageRepository(shipped.Ref) == imageRepository(ref) {
+      tags = append(tags, strings.TrimPrefix(shipped.Ref,
+        imageRepository(ref)+":"))
+    }
+  }
+  if len(tags) > 0 {
+    run.add(path, "Image %s is not shipped with the app. %s is shipped "+
+      "with the tag(s) %s.", image, imageRepository(ref),
+      strings.Join(tags, ", "))
+  } else {
+    run.add(path, "Image %s is not shipped with the app.", image)
+  }
+}
+
+// Reports the images of the Validator which no container runs. The warning
+// about an image is reported at a container running another tag of its
+// repository, if any, and against the appspec as a whole otherwise.
+func (run *validationRun) validateShippedImages() {
+  for _, shipped := range run.validator.Images {
+    if run.usedImages[shipped.Ref] {
+      continue
+    }
+    use, ok := run.repositoryUses[imageRepository(shipped.Ref)]
+    if !ok {
+      run.setNoDocument()
+      run.warn("", "Image %s shipped in %s is not used by any container.",
+        shipped.Ref, shipped.File)
+      continue
+    }
+    run.setDocument(use.document)
+    run.warn(use.field, "Image %s shipped in %s is not used by any "+
+      "container, this one runs %s.", shipped.Ref, shipped.File, use.image)
+  }
+}
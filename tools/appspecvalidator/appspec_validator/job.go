@@ -0,0 +1,211 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file validates how the pods of workloads are restarted and retried, in
+// particular for the cleanup Job, and reports when the Jobs of an app run.
+//
+// The cleanup Job is not created when the app is installed. It is run when
+// the app is uninstalled, to clean up what the app leaves behind.
+
+package appspecvalidator
+
+import (
+  "fmt"
+  "io"
+  "strings"
+)
+
+const (
+  kRestartPolicyAlways    string = "Always"
+  kRestartPolicyOnFailure string = "OnFailure"
+  kRestartPolicyNever     string = "Never"
+  // The number of retries of a Job which does not set backoffLimit.
+  kDefaultBackoffLimit int = 6
+)
+
+// Validates the spec fields of the current Job.
+func (run *validationRun) validateJob(appSpecObject *AppSpec) {
+  spec := appSpecObject.Spec
+  if spec.BackoffLimit != nil && *spec.BackoffLimit < 0 {
+    run.add("spec.backoffLimit", "BackoffLimit must not be negative, got %d.",
+      *spec.BackoffLimit)
+  }
+  if spec.ActiveDeadlineSeconds != nil && *spec.ActiveDeadlineSeconds < 1 {
+    run.add("spec.activeDeadlineSeconds", "ActiveDeadlineSeconds must be at "+
+      "least 1, got %d.", *spec.ActiveDeadlineSeconds)
+  }
+
+  metadata := appSpecObject.Metadata
+  if metadata == nil || metadata.CohesityTag == nil ||
+    *metadata.CohesityTag != kCohesityCleanupTag {
+    return
+  }
+  if spec.ActiveDeadlineSeconds == nil {
+    run.warn("spec.activeDeadlineSeconds", "The cleanup Job has no "+
+      "activeDeadlineSeconds, so a cleanup which hangs holds up the "+
+      "uninstall of the app.")
+  }
+}
+
+// Validates the metadata of the pod template of the current workload, given
+// at path. Cohesity tags belong to the metadata of the object itself.
+func (run *validationRun) validateTemplateMetadata(metadata *Metadata,
+  path string) {
+  if metadata.CohesityTag == nil {
+    return
+  }
+  tagPath := path + "." + kCohesityTagKeyWord
+  if *metadata.CohesityTag == kCohesityCleanupTag {
+    run.add(tagPath, "The %s tag must be set in the metadata of the Job, not "+
+      "of its template, or the Job is not run as the cleanup Job.",
+      kCohesityCleanupTag)
+  } else {
+    run.add(tagPath, "CohesityTag is not supported in the metadata of a "+
+      "template.")
+  }
+}
+
+// Validates the restart policy of the pods of the current workload, given at
+// path. The pods of a Job run to completion, the others keep running. A Job
+// must set its restart policy, since Kubernetes defaults it to Always, which
+// it rejects for a Job.
+func (run *validationRun) validateRestartPolicy(restartPolicy *string,
+  path string) {
+  if restartPolicy == nil {
+    if kindOf(run.kind).RunToCompletion {
+      run.add(path, "Restart policy missing, a %s must set %s or %s.",
+        run.kind, kRestartPolicyOnFailure, kRestartPolicyNever)
+    }
+    return
+  }
+  switch *restartPolicy {
+  case kRestartPolicyAlways:
+    if kindOf(run.kind).RunToCompletion {
+      run.add(path, "Restart policy %s is not supported for a %s, expected "+
+        "%s or %s.", *restartPolicy, run.kind, kRestartPolicyOnFailure,
+        kRestartPolicyNever)
+    }
+  case kRestartPolicyOnFailure, kRestartPolicyNever:
+    if !kindOf(run.kind).RunToCompletion {
+      run.add(path, "Restart policy %s is not supported for a %s, only %s "+
+        "is.", *restartPolicy, run.kind, kRestartPolicyAlways)
+    }
+  default:
+    run.add(path, "Invalid restart policy %s, expected one of %s, %s, %s.",
+      *restartPolicy, kRestartPolicyAlways, kRestartPolicyOnFailure,
+      kRestartPolicyNever)
+  }
+}
+
+// JobRun tells how the pod of a Job is retried until it completes.
+type JobRun struct {
+  Name string
+  // The restart policy of its pod, or "" if the Job sets none.
+  RestartPolicy string
+  // The number of retries before the Job fails.
+  BackoffLimit int
+  // The most seconds the Job may run, or nil if it is not limited.
+  ActiveDeadlineSeconds *int
+}
+
+// Lifecycle tells what happens to the objects of an app when it is installed
+// and uninstalled.
+type Lifecycle struct {
+  // The objects created when the app is installed, as kind and name.
+  Installed []string
+  // The Jobs run when the app is installed.
+  InstallJobs []*JobRun
+  // The Job run when the app is uninstalled, or nil if there is none.
+  Cleanup *JobRun
+}
+
+// Returns how the Job in document is run.
+func jobRun(document *Document) *JobRun {
+  job := &JobRun{
+    Name:         document.Name(),
+    BackoffLimit: kDefaultBackoffLimit,
+  }
+  spec := document.AppSpec.Spec
+  if spec == nil {
+    return job
+  }
+  if spec.BackoffLimit != nil {
+    job.BackoffLimit = *spec.BackoffLimit
+  }
+  job.ActiveDeadlineSeconds = spec.ActiveDeadlineSeconds
+  if spec.Template != nil && spec.Template.TemplateSpec != nil &&
+    spec.Template.TemplateSpec.RestartPolicy != nil {
+    job.RestartPolicy = *spec.Template.TemplateSpec.RestartPolicy
+  }
+  return job
+}
+
+// AppLifecycle returns the lifecycle of the app of a valid appspec.
+func AppLifecycle(documents []*Document) *Lifecycle {
+  lifecycle := &Lifecycle{}
+  for _, document := range documents {
+    if document.IsCleanupJob() {
+      lifecycle.Cleanup = jobRun(document)
+      continue
+    }
+    lifecycle.Installed = append(lifecycle.Installed,
+      document.Kind()+" "+document.Name())
+    if kindOf(document.Kind()).RunToCompletion {
+      lifecycle.InstallJobs = append(lifecycle.InstallJobs, jobRun(document))
+    }
+  }
+  return lifecycle
+}
+
+// Returns how the Job is retried, as a sentence.
+func (job *JobRun) retries() string {
+  if job.RestartPolicy == "" {
+    return "It sets no restartPolicy, so Kubernetes does not run it."
+  }
+  restart := "a failed pod is replaced by a new one"
+  if job.RestartPolicy == kRestartPolicyOnFailure {
+    restart = "a failed container is restarted in its pod"
+  }
+  retries := fmt.Sprintf("Until it completes, %s (restartPolicy %s), up to "+
+    "%d time(s) (backoffLimit)", restart, job.RestartPolicy, job.BackoffLimit)
+  if job.ActiveDeadlineSeconds != nil {
+    retries += fmt.Sprintf(", for at most %ds (activeDeadlineSeconds)",
+      *job.ActiveDeadlineSeconds)
+  } else {
+    retries += ", without a deadline"
+  }
+  return retries + "."
+}
+
+// WriteLifecycleReport writes what happens to the objects of the app when it
+// is installed and uninstalled, and when and how its Jobs run.
+func WriteLifecycleReport(writer io.Writer, lifecycle *Lifecycle) error {
+  installed := "nothing"
+  if len(lifecycle.Installed) > 0 {
+    installed = strings.Join(lifecycle.Installed, ", ")
+  }
+  lines := []string{
+    "Lifecycle:",
+    fmt.Sprintf("  Install: creates %s.", installed),
+  }
+  for _, job := range lifecycle.InstallJobs {
+    lines = append(lines, fmt.Sprintf("    Job %s runs once, when the app "+
+      "is installed. %s", job.Name, job.retries()))
+  }
+  if lifecycle.Cleanup == nil {
+    lines = append(lines, "  Uninstall: the app has no cleanup Job, "+
+      "nothing runs when it is uninstalled.")
+  } else {
+    job := lifecycle.Cleanup
+    lines = append(lines, fmt.Sprintf("  Uninstall: runs the cleanup Job "+
+      "%s.", job.Name),
+      fmt.Sprintf("    Job %s runs once, when the app is uninstalled. It is "+
+        "not created when the app is installed. %s", job.Name,
+        job.retries()))
+  }
+  for _, line := range lines {
+    if _, err := fmt.Fprintln(writer, line); err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,240 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file lists the kinds of objects an appspec may have, with the
+// apiVersion and the spec fields each kind allows, and validates the fields
+// which only some kinds have.
+
+package appspecvalidator
+
+import (
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+const (
+  kStrategyRollingUpdate string = "RollingUpdate"
+  kStrategyRecreate      string = "Recreate"
+
+  kMaxUnavailableKeyWord string = "maxUnavailable"
+  kMaxSurgeKeyWord       string = "maxSurge"
+)
+
+// KindFeatures describes a kind of object: its apiVersion, what objects of
+// that kind are and which fields of the spec they may set.
+type KindFeatures struct {
+  ApiVersion string
+  // The object runs pods from a template.
+  Workload bool
+  // The object holds configuration for the containers, and has no spec.
+  Config bool
+  // The workload runs one pod per node, instead of a number of replicas.
+  PodPerNode bool
+  // The workload runs its pod to completion once, instead of keeping it
+  // running. It may set backoffLimit and activeDeadlineSeconds.
+  RunToCompletion bool
+  // Each pod of the workload gets its own claims of the dynamic volumes,
+  // which are created once and outlive the workload.
+  ClaimPerPod bool
+
+  // The spec fields the kind allows, beyond the template.
+  Replicas    bool
+  ServiceName bool
+  Strategy    bool
+  // The workload must declare a selector, it is not generated for it.
+  RequiresSelector bool
+}
+
+// The kinds of objects an appspec may have. These are never modified.
+var kinds = map[string]*KindFeatures{
+  "StatefulSet": &KindFeatures{
+    ApiVersion:       "apps/v1",
+    Workload:         true,
+    ClaimPerPod:      true,
+    Replicas:         true,
+    ServiceName:      true,
+    RequiresSelector: true,
+  },
+  "ReplicaSet": &KindFeatures{
+    ApiVersion:       "apps/v1",
+    Workload:         true,
+    Replicas:         true,
+    RequiresSelector: true,
+  },
+  "Deployment": &KindFeatures{
+    ApiVersion:       "apps/v1",
+    Workload:         true,
+    Replicas:         true,
+    Strategy:         true,
+    RequiresSelector: true,
+  },
+  "DaemonSet": &KindFeatures{
+    ApiVersion:       "apps/v1",
+    Workload:         true,
+    PodPerNode:       true,
+    RequiresSelector: true,
+  },
+  "Job": &KindFeatures{
+    ApiVersion:      "batch/v1",
+    Workload:        true,
+    RunToCompletion: true,
+  },
+  "Service": &KindFeatures{
+    ApiVersion: "v1",
+  },
+  "ConfigMap": &KindFeatures{
+    ApiVersion: "v1",
+    Config:     true,
+  },
+  "Secret": &KindFeatures{
+    ApiVersion: "v1",
+    Config:     true,
+  },
+}
+
+var (
+  // Matches a bound of a rolling update given as a percentage.
+  percentRegexp = regexp.MustCompile(`^[0-9]+%$`)
+)
+
+// Returns the features of kind. An unsupported kind has none.
+func kindOf(kind string) *KindFeatures {
+  if features, ok := kinds[kind]; ok {
+    return features
+  }
+  return &KindFeatures{}
+}
+
+// LookupKind returns the features of kind, and whether an appspec may have
+// objects of that kind. An unsupported kind has none.
+func LookupKind(kind string) (KindFeatures, bool) {
+  features, ok := kinds[kind]
+  if !ok {
+    return KindFeatures{}, false
+  }
+  return *features, true
+}
+
+// ExpectedApiVersion returns the apiVersion objects of the given kind must
+// have, or "" if the kind is not supported in an appspec.
+func ExpectedApiVersion(kind string) string {
+  return kindOf(kind).ApiVersion
+}
+
+// SupportedKinds returns the kinds of objects an appspec may have, sorted.
+func SupportedKinds() []string {
+  supported := make([]string, 0, len(kinds))
+  for kind := range kinds {
+    supported = append(supported, kind)
+  }
+  sort.Strings(supported)
+  return supported
+}
+
+// Replicas returns the number of pods the workload runs on a cluster of the
+// given number of nodes.
+func (document *Document) Replicas(nodes int) int {
+  if kindOf(document.Kind()).PodPerNode {
+    return nodes
+  }
+  spec := document.AppSpec.Spec
+  if spec == nil {
+    return 1
+  }
+  return spec.Replicas.Count(nodes)
+}
+
+// Validates that the spec of the current workload only sets the fields its
+// kind allows. The replicas are validated by validateReplicas.
+func (run *validationRun) validateKindFields(spec *Spec) {
+  features := kindOf(run.kind)
+  if spec.ServiceName != nil && !features.ServiceName {
+    run.add("spec.serviceName", "ServiceName is not supported for a %s, "+
+      "only a StatefulSet has one.", run.kind)
+  }
+  if spec.Strategy != nil {
+    if !features.Strategy {
+      run.add("spec.strategy", "Strategy is not supported for a %s, only a "+
+        "Deployment has one.", run.kind)
+    } else {
+      run.validateStrategy(spec.Strategy, "spec.strategy")
+    }
+  }
+  if !features.RunToCompletion {
+    if spec.BackoffLimit != nil {
+      run.add("spec.backoffLimit", "BackoffLimit is not supported for a %s, "+
+        "only a Job has one.", run.kind)
+    }
+    if spec.ActiveDeadlineSeconds != nil {
+      run.add("spec.activeDeadlineSeconds", "ActiveDeadlineSeconds is not "+
+        "supported for a %s, only a Job has one.", run.kind)
+    }
+  }
+}
+
+// Validates a bound of a rolling update, given at path. Returns the bound in
+// pods or percents, or -1 if it is invalid.
+func (run *validationRun) validateRollingUpdateBound(bound *IntOrString,
+  field string, path string) int {
+  if bound.IntVal != nil {
+    if *bound.IntVal < 0 {
+      run.add(path, "Strategy %s must not be negative, got %d.", field,
+        *bound.IntVal)
+      return -1
+    }
+    return *bound.IntVal
+  }
+  if !percentRegexp.MatchString(*bound.StrVal) {
+    run.add(path, "Invalid strategy %s %s, expected a number of pods or a "+
+      "percentage such as 25%%.", field, *bound.StrVal)
+    return -1
+  }
+  percent, _ := strconv.Atoi(strings.TrimSuffix(*bound.StrVal, "%"))
+  if field == kMaxUnavailableKeyWord && percent > 100 {
+    run.add(path, "Strategy %s %s is more than 100%%.", field, *bound.StrVal)
+    return -1
+  }
+  return percent
+}
+
+// Validates the update strategy of a Deployment.
+func (run *validationRun) validateStrategy(strategy *DeploymentStrategy,
+  path string) {
+  strategyType := kStrategyRollingUpdate
+  if strategy.Type != nil {
+    strategyType = *strategy.Type
+    if strategyType != kStrategyRollingUpdate &&
+      strategyType != kStrategyRecreate {
+      run.add(path+".type", "Invalid strategy type %s, expected %s or %s.",
+        strategyType, kStrategyRollingUpdate, kStrategyRecreate)
+      return
+    }
+  }
+
+  rollingUpdate := strategy.RollingUpdate
+  if rollingUpdate == nil {
+    return
+  }
+  rollingUpdatePath := path + ".rollingUpdate"
+  if strategyType != kStrategyRollingUpdate {
+    run.add(rollingUpdatePath, "Strategy rollingUpdate is only allowed with "+
+      "type %s.", kStrategyRollingUpdate)
+    return
+  }
+  // Either bound defaults to 25% when it is not set.
+  maxUnavailable, maxSurge := -1, -1
+  if rollingUpdate.MaxUnavailable != nil {
+    maxUnavailable = run.validateRollingUpdateBound(
+      rollingUpdate.MaxUnavailable, kMaxUnavailableKeyWord,
+      rollingUpdatePath+"."+kMaxUnavailableKeyWord)
+  }
+  if rollingUpdate.MaxSurge != nil {
+    maxSurge = run.validateRollingUpdateBound(rollingUpdate.MaxSurge,
+      kMaxSurgeKeyWord, rollingUpdatePath+"."+kMaxSurgeKeyWord)
+  }
+  if maxUnavailable == 0 && maxSurge == 0 {
+    run.add(rollingUpdatePath, "Strategy maxUnavailable and maxSurge can "+
+      "not both be 0, the update could not replace any pod.")
+  }
+}
@@ -0,0 +1,379 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file runs lint rules, the house rules of a team which go beyond what
+// the app platform requires, over the objects of an appspec. Rules are kept in
+// a registry, see RegisterRule, and enabled, disabled and given a severity by
+// a lint config file named .appspeclint.yaml, which looks like:
+//
+//   rules:
+//     image-tag:
+//       severity: error
+//     memory-request:
+//       enabled: false
+//     name-prefix:
+//       enabled: true
+//       options:
+//         prefix: view-browser
+//
+// A comment "# appspec:ignore rule-id" in the appspec ignores the findings of
+// a rule at the field it is on, or above, and within that field.
+
+package appspecvalidator
+
+import (
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strings"
+  "sync"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/field_path"
+  "gopkg.in/yaml.v3"
+)
+
+const (
+  // LintConfigFileName is the name of the lint config file looked up by
+  // FindLintConfig.
+  LintConfigFileName string = ".appspeclint.yaml"
+)
+
+// Rule is a lint rule checking the objects of an appspec.
+type Rule interface {
+  // Id names the rule in lint configs and ignore comments, e.g. image-tag.
+  Id() string
+  // Description says what the rule checks, in a sentence.
+  Description() string
+  // Check reports the violations of the rule by the objects of an appspec
+  // through context.
+  Check(documents []*Document, context *RuleContext)
+}
+
+// RuleOptionsValidator is implemented by rules which take options, so that
+// the options set in a lint config are checked when the config is parsed.
+type RuleOptionsValidator interface {
+  ValidateOptions(options map[string]string) error
+}
+
+// registeredRule is a rule of the registry.
+type registeredRule struct {
+  rule Rule
+  // Whether the rule is run if the lint config does not say.
+  enabled bool
+}
+
+var (
+  rulesMutex sync.RWMutex
+  // The registered rules keyed by their id.
+  rules = make(map[string]*registeredRule)
+
+  // Matches the ids of rules.
+  ruleIdRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+  // Matches an ignore comment, capturing the ids of the rules it ignores.
+  ignoreCommentRegexp = regexp.MustCompile(
+    `^#\s*appspec:ignore\s+([a-z0-9-]+(?:\s*,\s*[a-z0-9-]+)*)\s*$`)
+)
+
+// RegisterRule adds rule to the registry, enabled by default if enabled is
+// set. Its findings are warnings unless the lint config says otherwise. It
+// panics if the id of the rule is invalid or already registered, so it is
+// meant to be called from init functions.
+func RegisterRule(rule Rule, enabled bool) {
+  rulesMutex.Lock()
+  defer rulesMutex.Unlock()
+  id := rule.Id()
+  if !ruleIdRegexp.MatchString(id) {
+    panic(fmt.Sprintf("Invalid lint rule id %q.", id))
+  }
+  if _, ok := rules[id]; ok {
+    panic(fmt.Sprintf("Lint rule %s registered twice.", id))
+  }
+  rules[id] = &registeredRule{rule: rule, enabled: enabled}
+}
+
+// Rules returns the registered rules sorted by id.
+func Rules() []Rule {
+  rulesMutex.RLock()
+  defer rulesMutex.RUnlock()
+  ids := make([]string, 0, len(rules))
+  for id := range rules {
+    ids = append(ids, id)
+  }
+  sort.Strings(ids)
+  ruleList := make([]Rule, 0, len(ids))
+  for _, id := range ids {
+    ruleList = append(ruleList, rules[id].rule)
+  }
+  return ruleList
+}
+
+// Returns the registered rule with the given id, or nil if there is none.
+func lookupRule(id string) *registeredRule {
+  rulesMutex.RLock()
+  defer rulesMutex.RUnlock()
+  return rules[id]
+}
+
+// RuleConfig says whether and how a rule is run.
+type RuleConfig struct {
+  Enabled  bool
+  Severity Severity
+  Options  map[string]string
+}
+
+// LintConfig holds the config of the rules to run, keyed by their id.
+type LintConfig struct {
+  Rules map[string]*RuleConfig
+}
+
+// Returns the config of the registered rule when a lint config does not say.
+func defaultRuleConfig(registered *registeredRule) *RuleConfig {
+  return &RuleConfig{
+    Enabled:  registered.enabled,
+    Severity: SeverityWarning,
+    Options:  make(map[string]string),
+  }
+}
+
+// DefaultLintConfig returns the config running the rules enabled by default,
+// with warnings.
+func DefaultLintConfig() *LintConfig {
+  config := &LintConfig{Rules: make(map[string]*RuleConfig)}
+  for _, rule := range Rules() {
+    config.Rules[rule.Id()] = defaultRuleConfig(lookupRule(rule.Id()))
+  }
+  return config
+}
+
+// lintConfigFile is the content of a lint config file.
+type lintConfigFile struct {
+  Rules map[string]*ruleConfigFile `yaml:"rules"`
+}
+
+type ruleConfigFile struct {
+  Enabled  *bool             `yaml:"enabled"`
+  Severity *string           `yaml:"severity"`
+  Options  map[string]string `yaml:"options"`
+}
+
+// Returns the ids of the registered rules.
+func ruleIds() []string {
+  var ids []string
+  for _, rule := range Rules() {
+    ids = append(ids, rule.Id())
+  }
+  return ids
+}
+
+// ParseLintConfig parses a lint config file read from reader. The rules it
+// does not mention keep their default config.
+func ParseLintConfig(reader io.Reader) (*LintConfig, error) {
+  var file lintConfigFile
+  dec := yaml.NewDecoder(reader)
+  dec.KnownFields(true)
+  if err := dec.Decode(&file); err != nil && err != io.EOF {
+    return nil, fmt.Errorf("Invalid lint config. %v", err)
+  }
+
+  config := DefaultLintConfig()
+  for id, ruleFile := range file.Rules {
+    ruleConfig, ok := config.Rules[id]
+    if !ok {
+      errMsg := fmt.Sprintf("Unknown lint rule %s", id)
+      if suggestion := SuggestField(id, ruleIds()); suggestion != "" {
+        errMsg += fmt.Sprintf(", did you mean %s?", suggestion)
+      } else {
+        errMsg += "."
+      }
+      return nil, fmt.Errorf("Invalid lint config. %s", errMsg)
+    }
+    if ruleFile == nil {
+      continue
+    }
+    if ruleFile.Enabled != nil {
+      ruleConfig.Enabled = *ruleFile.Enabled
+    }
+    if ruleFile.Severity != nil {
+      severity := Severity(*ruleFile.Severity)
+      if severity != SeverityError && severity != SeverityWarning {
+        return nil, fmt.Errorf("Invalid lint config. Severity %s of rule %s "+
+          "is not %s or %s.", *ruleFile.Severity, id, SeverityError,
+          SeverityWarning)
+      }
+      ruleConfig.Severity = severity
+    }
+    for name, value := range ruleFile.Options {
+      ruleConfig.Options[name] = value
+    }
+  }
+
+  // Check the options of the rules which are run, whether they come from the
+  // file or not.
+  for id, ruleConfig := range config.Rules {
+    validator, ok := lookupRule(id).rule.(RuleOptionsValidator)
+    if !ruleConfig.Enabled || !ok {
+      continue
+    }
+    if err := validator.ValidateOptions(ruleConfig.Options); err != nil {
+      return nil, fmt.Errorf("Invalid lint config. Rule %s: %v", id, err)
+    }
+  }
+  return config, nil
+}
+
+// LoadLintConfigFile parses the lint config file at path.
+func LoadLintConfigFile(path string) (*LintConfig, error) {
+  configFile, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer configFile.Close()
+  return ParseLintConfig(configFile)
+}
+
+// FindLintConfig returns the path of the lint config file in dir or the
+// closest of its parents, or "" if there is none.
+func FindLintConfig(dir string) string {
+  dir, err := filepath.Abs(dir)
+  if err != nil {
+    return ""
+  }
+  for {
+    path := filepath.Join(dir, LintConfigFileName)
+    if info, err := os.Stat(path); err == nil && !info.IsDir() {
+      return path
+    }
+    parent := filepath.Dir(dir)
+    if parent == dir {
+      return ""
+    }
+    dir = parent
+  }
+}
+
+// RuleContext is given to a rule to report its findings.
+type RuleContext struct {
+  run    *validationRun
+  rule   Rule
+  config *RuleConfig
+}
+
+// Option returns the value of the option of the rule set in the lint config,
+// or "" if it is not set.
+func (context *RuleContext) Option(name string) string {
+  return context.config.Options[name]
+}
+
+// Report records a violation of the rule at the given field of document,
+// unless an ignore comment of the appspec ignores the rule there.
+func (context *RuleContext) Report(document *Document, field string,
+  format string, args ...interface{}) {
+  if document.isIgnored(context.rule.Id(), field) {
+    return
+  }
+  context.run.setDocument(document)
+  finding := context.run.addFinding(context.config.Severity, field, format,
+    args...)
+  finding.Rule = context.rule.Id()
+}
+
+// Runs the rules enabled by the lint config of the Validator, if any.
+func (run *validationRun) validateLintRules() {
+  config := run.validator.Lint
+  if config == nil {
+    return
+  }
+  for _, rule := range Rules() {
+    ruleConfig, ok := config.Rules[rule.Id()]
+    if !ok {
+      // The rule was registered after the config was made.
+      ruleConfig = defaultRuleConfig(lookupRule(rule.Id()))
+    }
+    if !ruleConfig.Enabled {
+      continue
+    }
+    rule.Check(run.documents, &RuleContext{
+      run:    run,
+      rule:   rule,
+      config: ruleConfig,
+    })
+  }
+}
+
+// Records in ignores the ids of the rules ignored by the ignore comments
+// among comments, for the field at path.
+func addIgnores(ignores map[string]map[string]bool, path string,
+  comments ...string) {
+  for _, comment := range comments {
+    for _, line := range strings.Split(comment, "\n") {
+      match := ignoreCommentRegexp.FindStringSubmatch(strings.TrimSpace(line))
+      if match == nil {
+        continue
+      }
+      if ignores[path] == nil {
+        ignores[path] = make(map[string]bool)
+      }
+      for _, id := range strings.Split(match[1], ",") {
+        ignores[path][strings.TrimSpace(id)] = true
+      }
+    }
+  }
+}
+
+// Records in ignores the rules ignored by the comments of the node at path
+// and its descendants. A comment above a list item covers the whole item, a
+// comment above or at the end of the line of a field covers that field. The
+// comment above the first field of the object covers the whole object.
+func collectIgnores(node *yaml.Node, path string,
+  ignores map[string]map[string]bool) {
+  switch node.Kind {
+  case yaml.MappingNode:
+    for i := 0; i+1 < len(node.Content); i += 2 {
+      key, value := node.Content[i], node.Content[i+1]
+      fieldPath := fieldpath.Join(path, key.Value)
+      headPath := fieldPath
+      if path == "" && i == 0 {
+        headPath = ""
+      }
+      addIgnores(ignores, headPath, key.HeadComment)
+      addIgnores(ignores, fieldPath, key.LineComment, value.HeadComment,
+        value.LineComment)
+      collectIgnores(value, fieldPath, ignores)
+    }
+  case yaml.SequenceNode:
+    for i, item := range node.Content {
+      itemPath := fieldpath.Index(path, i)
+      addIgnores(ignores, itemPath, item.HeadComment, item.LineComment)
+      collectIgnores(item, itemPath, ignores)
+    }
+  }
+}
+
+// Returns the rules ignored by the comments of the YAML document node, keyed
+// by the field they cover, "" for the whole object.
+func ignoreComments(documentNode *yaml.Node) map[string]map[string]bool {
+  ignores := make(map[string]map[string]bool)
+  addIgnores(ignores, "", documentNode.HeadComment)
+  if len(documentNode.Content) > 0 {
+    root := documentNode.Content[0]
+    addIgnores(ignores, "", root.HeadComment)
+    collectIgnores(root, "", ignores)
+  }
+  return ignores
+}
+
+// Returns true if an ignore comment of the document ignores the rule with the
+// given id at field.
+func (document *Document) isIgnored(id string, field string) bool {
+  for {
+    if document.ignores[field][id] {
+      return true
+    }
+    if field == "" {
+      return false
+    }
+    field = fieldpath.Parent(field)
+  }
+}
@@ -0,0 +1,201 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file provides the output formats in which findings can be reported.
+
+package appspecvalidator
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "path/filepath"
+)
+
+const (
+  kSarifVersion       string = "2.1.0"
+  kSarifSchema        string = "https://json.schemastore.org/sarif-2.1.0.json"
+  kSarifToolName      string = "appspecvalidator"
+  kSarifToolUri       string = "https://github.com/cohesity/cohesity-appspec"
+  kSarifDefaultRuleId string = "appspec"
+)
+
+// WriteText writes the findings as human readable text, one finding per line,
+// followed by a summary line.
+func (findings Findings) WriteText(writer io.Writer) error {
+  var err error
+  if findings.HasErrors() {
+    _, err = fmt.Fprintf(writer, "Invalid App Spec. %d finding(s).\n",
+      len(findings))
+  }
+  if err != nil {
+    return err
+  }
+  for _, finding := range findings {
+    if _, err = fmt.Fprintln(writer, finding); err != nil {
+      return err
+    }
+  }
+  if !findings.HasErrors() {
+    _, err = fmt.Fprintln(writer, "Valid App Spec.")
+  }
+  return err
+}
+
+// jsonReport is the document written by WriteJSON.
+type jsonReport struct {
+  File     string   `json:"file,omitempty"`
+  Valid    bool     `json:"valid"`
+  Findings Findings `json:"findings"`
+}
+
+// WriteJSON writes the findings for the appspec at path as a JSON document.
+func (findings Findings) WriteJSON(writer io.Writer, path string) error {
+  report := jsonReport{
+    File:     path,
+    Valid:    !findings.HasErrors(),
+    Findings: findings,
+  }
+  if report.Findings == nil {
+    report.Findings = Findings{}
+  }
+  encoder := json.NewEncoder(writer)
+  encoder.SetIndent("", "  ")
+  return encoder.Encode(report)
+}
+
+// The subset of SARIF 2.1.0 needed to report findings, see
+// https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html.
+type sarifLog struct {
+  Version string      `json:"version"`
+  Schema  string      `json:"$schema"`
+  Runs    []*sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+  Tool    *sarifTool     `json:"tool"`
+  Results []*sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+  Driver *sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+  Name           string       `json:"name"`
+  InformationUri string       `json:"informationUri"`
+  Rules          []*sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+  Id               string        `json:"id"`
+  ShortDescription *sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+  Text string `json:"text"`
+}
+
+type sarifResult struct {
+  RuleId    string           `json:"ruleId"`
+  Level     string           `json:"level"`
+  Message   *sarifMessage    `json:"message"`
+  Locations []*sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+  PhysicalLocation *sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+  ArtifactLocation *sarifArtifactLocation `json:"artifactLocation"`
+  Region           *sarifRegion           `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+  Uri string `json:"uri"`
+}
+
+type sarifRegion struct {
+  StartLine   int `json:"startLine"`
+  StartColumn int `json:"startColumn,omitempty"`
+}
+
+// WriteSARIF writes the findings for the appspec at path as a SARIF log, the
+// format consumed by code scanning tools such as GitHub code scanning.
+func (findings Findings) WriteSARIF(writer io.Writer, path string) error {
+  rules := []*sarifRule{
+    &sarifRule{
+      Id: kSarifDefaultRuleId,
+      ShortDescription: &sarifMessage{
+        Text: "Cohesity appspec validation",
+      },
+    },
+  }
+  // The findings of lint rules are reported under the id of the rule.
+  ruleIds := make(map[string]bool)
+  results := make([]*sarifResult, 0, len(findings))
+  for _, finding := range findings {
+    ruleId := kSarifDefaultRuleId
+    if finding.Rule != "" {
+      ruleId = finding.Rule
+      if registered := lookupRule(ruleId); registered != nil &&
+        !ruleIds[ruleId] {
+        ruleIds[ruleId] = true
+        rules = append(rules, &sarifRule{
+          Id: ruleId,
+          ShortDescription: &sarifMessage{
+            Text: registered.rule.Description(),
+          },
+        })
+      }
+    }
+    message := finding.Message
+    if finding.Field != "" {
+      message = finding.Field + ": " + message
+    }
+    if finding.Kind != "" {
+      message += fmt.Sprintf(" (%s %s)", finding.Kind, finding.Name)
+    }
+    file := finding.File
+    if file == "" {
+      file = path
+    }
+    location := &sarifPhysicalLocation{
+      ArtifactLocation: &sarifArtifactLocation{Uri: filepath.ToSlash(file)},
+    }
+    if finding.Line > 0 {
+      location.Region = &sarifRegion{
+        StartLine:   finding.Line,
+        StartColumn: finding.Column,
+      }
+    }
+    results = append(results, &sarifResult{
+      RuleId:  ruleId,
+      Level:   string(finding.Severity),
+      Message: &sarifMessage{Text: message},
+      Locations: []*sarifLocation{
+        &sarifLocation{PhysicalLocation: location},
+      },
+    })
+  }
+
+  log := sarifLog{
+    Version: kSarifVersion,
+    Schema:  kSarifSchema,
+    Runs: []*sarifRun{
+      &sarifRun{
+        Tool: &sarifTool{
+          Driver: &sarifDriver{
+            Name:           kSarifToolName,
+            InformationUri: kSarifToolUri,
+            Rules:          rules,
+          },
+        },
+        Results: results,
+      },
+    },
+  }
+  encoder := json.NewEncoder(writer)
+  encoder.SetIndent("", "  ")
+  return encoder.Encode(log)
+}
@@ -0,0 +1,236 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file parses resource quantities like cpu and memory using the grammar
+// of Kubernetes:
+//
+//   <quantity>        ::= <signedNumber><suffix>
+//   <signedNumber>    ::= <number> | +<number> | -<number>
+//   <number>          ::= <digits> | <digits>.<digits> | <digits>. | .<digits>
+//   <suffix>          ::= <binarySI> | <decimalExponent> | <decimalSI>
+//   <binarySI>        ::= Ki | Mi | Gi | Ti | Pi | Ei
+//   <decimalSI>       ::= n | u | m | "" | k | M | G | T | P | E
+//   <decimalExponent> ::= e<signedNumber> | E<signedNumber>
+
+package appspecvalidator
+
+import (
+  "errors"
+  "fmt"
+  "math"
+  "math/big"
+  "strconv"
+  "strings"
+)
+
+const (
+  // Bounds the exponent of a quantity so that parsing stays cheap.
+  kMaxQuantityExponent int = 64
+)
+
+var (
+  // Sanity limits for the requests of a single container, used when the
+  // Validator does not configure any.
+  defaultMaxCpu    = MustParseQuantity("64")
+  defaultMaxMemory = MustParseQuantity("512Gi")
+)
+
+// Quantity is a parsed resource quantity such as "500m" or "1.5Gi".
+type Quantity struct {
+  // The quantity as written in the appspec.
+  str string
+  // The quantity in base units, i.e. cores or bytes.
+  value *big.Rat
+  // One of kBinarySIFormat, kDecimalSIFormat and kDecimalExpFormat.
+  format string
+}
+
+// ParseQuantity parses a resource quantity.
+func ParseQuantity(str string) (*Quantity, error) {
+  if str == "" {
+    return nil, errors.New("Empty resource quantity.")
+  }
+
+  pos := 0
+  negative := false
+  if str[pos] == '+' || str[pos] == '-' {
+    negative = str[pos] == '-'
+    pos++
+  }
+  intStart := pos
+  for pos < len(str) && str[pos] >= '0' && str[pos] <= '9' {
+    pos++
+  }
+  intDigits := str[intStart:pos]
+  fracDigits := ""
+  if pos < len(str) && str[pos] == '.' {
+    pos++
+    fracStart := pos
+    for pos < len(str) && str[pos] >= '0' && str[pos] <= '9' {
+      pos++
+    }
+    fracDigits = str[fracStart:pos]
+  }
+  if intDigits == "" && fracDigits == "" {
+    return nil, fmt.Errorf("Invalid resource quantity %s, expected a "+
+      "number.", str)
+  }
+
+  // The number is intDigits.fracDigits = (intDigits fracDigits) / 10^len.
+  value, _ := new(big.Rat).SetString("0" + intDigits + fracDigits)
+  value.Quo(value, new(big.Rat).SetInt(pow10(len(fracDigits))))
+  if negative {
+    value.Neg(value)
+  }
+
+  suffix := str[pos:]
+  quantity := &Quantity{str: str, value: value}
+  if exponent, ok := binarySIMap[suffix]; ok {
+    quantity.format = kBinarySIFormat
+    value.Mul(value, new(big.Rat).SetInt(new(big.Int).Lsh(big.NewInt(1),
+      uint(exponent))))
+    return quantity, nil
+  }
+
+  exponent, ok := decimalSIMap[suffix]
+  if ok {
+    quantity.format = kDecimalSIFormat
+  } else if suffix[0] == 'e' || suffix[0] == 'E' {
+    var err error
+    exponent, err = strconv.Atoi(suffix[1:])
+    if err != nil {
+      return nil, fmt.Errorf("Invalid resource quantity %s, bad exponent "+
+        "%s.", str, suffix)
+    }
+    if exponent > kMaxQuantityExponent || exponent < -kMaxQuantityExponent {
+      return nil, fmt.Errorf("Invalid resource quantity %s, exponent out "+
+        "of range.", str)
+    }
+    quantity.format = kDecimalExpFormat
+  } else {
+    return nil, fmt.Errorf("Invalid resource quantity %s, unknown suffix "+
+      "%s.%s", str, suffix, suggestQuantitySuffix(suffix))
+  }
+
+  if exponent >= 0 {
+    value.Mul(value, new(big.Rat).SetInt(pow10(exponent)))
+  } else {
+    value.Quo(value, new(big.Rat).SetInt(pow10(-exponent)))
+  }
+  return quantity, nil
+}
+
+// MustParseQuantity is like ParseQuantity but panics if str is invalid. It is
+// meant for quantities known at compile time.
+func MustParseQuantity(str string) *Quantity {
+  quantity, err := ParseQuantity(str)
+  if err != nil {
+    panic(err)
+  }
+  return quantity
+}
+
+// Returns a hint about the valid suffix the user likely meant, e.g. Ki for ki.
+func suggestQuantitySuffix(suffix string) string {
+  for validSuffix := range binarySIMap {
+    if strings.EqualFold(suffix, validSuffix) {
+      return fmt.Sprintf(" Did you mean %s?", validSuffix)
+    }
+  }
+  if suffix == "K" {
+    return " Did you mean k?"
+  }
+  return ""
+}
+
+// Returns 10^exponent.
+func pow10(exponent int) *big.Int {
+  return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)
+}
+
+// String returns the quantity as written in the appspec.
+func (quantity *Quantity) String() string {
+  return quantity.str
+}
+
+// Format returns how the quantity is written: BinarySI, DecimalSI or
+// DecimalExponent.
+func (quantity *Quantity) Format() string {
+  return quantity.format
+}
+
+// Rat returns the quantity in base units, i.e. cores for cpu and bytes for
+// memory.
+func (quantity *Quantity) Rat() *big.Rat {
+  return new(big.Rat).Set(quantity.value)
+}
+
+// Float64 returns the quantity in base units as a float.
+func (quantity *Quantity) Float64() float64 {
+  value, _ := quantity.value.Float64()
+  return value
+}
+
+// Returns the quantity multiplied by scale, rounded up like Kubernetes does.
+func (quantity *Quantity) scaledValue(scale int64) int64 {
+  scaled := new(big.Rat).Mul(quantity.value, new(big.Rat).SetInt64(scale))
+  result := new(big.Int).Quo(scaled.Num(), scaled.Denom())
+  if new(big.Rat).SetInt(result).Cmp(scaled) < 0 {
+    result.Add(result, big.NewInt(1))
+  }
+  if !result.IsInt64() {
+    if result.Sign() < 0 {
+      return math.MinInt64
+    }
+    return math.MaxInt64
+  }
+  return result.Int64()
+}
+
+// Value returns the quantity in base units rounded up to an integer, e.g. the
+// number of bytes of a memory quantity.
+func (quantity *Quantity) Value() int64 {
+  return quantity.scaledValue(1)
+}
+
+// MilliValue returns the quantity in thousandths of base units rounded up to
+// an integer, e.g. the millicores of a cpu quantity.
+func (quantity *Quantity) MilliValue() int64 {
+  return quantity.scaledValue(1000)
+}
+
+// Sign returns -1, 0 or 1 depending on the sign of the quantity.
+func (quantity *Quantity) Sign() int {
+  return quantity.value.Sign()
+}
+
+// Cmp compares the quantity with other and returns -1, 0 or 1.
+func (quantity *Quantity) Cmp(other *Quantity) int {
+  return quantity.value.Cmp(other.value)
+}
+
+// IsWhole returns true if the quantity is an integer number of base units.
+func (quantity *Quantity) IsWhole() bool {
+  return quantity.value.IsInt()
+}
+
+// IsWholeMilli returns true if the quantity is an integer number of
+// thousandths of base units.
+func (quantity *Quantity) IsWholeMilli() bool {
+  return new(big.Rat).Mul(quantity.value, big.NewRat(1000, 1)).IsInt()
+}
+
+// CpuQuantity returns the parsed cpu request, or nil if none is set.
+func (requests *Requests) CpuQuantity() (*Quantity, error) {
+  if requests == nil || requests.Cpu == nil {
+    return nil, nil
+  }
+  return ParseQuantity(*requests.Cpu)
+}
+
+// MemoryQuantity returns the parsed memory request, or nil if none is set.
+func (requests *Requests) MemoryQuantity() (*Quantity, error) {
+  if requests == nil || requests.Memory == nil {
+    return nil, nil
+  }
+  return ParseQuantity(*requests.Memory)
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file tests the parsing of resource quantities.
+
+package appspecvalidator
+
+import (
+  "math"
+  "math/big"
+  "strings"
+  "testing"
+)
+
+func TestParseQuantity(t *testing.T) {
+  tests := []struct {
+    str    string
+    value  string
+    format string
+  }{
+    {"0", "0", kDecimalSIFormat},
+    {"1", "1", kDecimalSIFormat},
+    {"+1", "1", kDecimalSIFormat},
+    {"-1", "-1", kDecimalSIFormat},
+    {".5", "1/2", kDecimalSIFormat},
+    {"1.", "1", kDecimalSIFormat},
+    {"1.5", "3/2", kDecimalSIFormat},
+    {"100n", "1/10000000", kDecimalSIFormat},
+    {"100u", "1/10000", kDecimalSIFormat},
+    {"500m", "1/2", kDecimalSIFormat},
+    {"2k", "2000", kDecimalSIFormat},
+    {"2M", "2000000", kDecimalSIFormat},
+    {"2G", "2000000000", kDecimalSIFormat},
+    {"2T", "2000000000000", kDecimalSIFormat},
+    {"2P", "2000000000000000", kDecimalSIFormat},
+    {"2E", "2000000000000000000", kDecimalSIFormat},
+    {"1Ki", "1024", kBinarySIFormat},
+    {"1.5Ki", "1536", kBinarySIFormat},
+    {"1Mi", "1048576", kBinarySIFormat},
+    {"1Gi", "1073741824", kBinarySIFormat},
+    {"1Ti", "1099511627776", kBinarySIFormat},
+    {"1Pi", "1125899906842624", kBinarySIFormat},
+    {"1Ei", "1152921504606846976", kBinarySIFormat},
+    {"1e3", "1000", kDecimalExpFormat},
+    {"1E3", "1000", kDecimalExpFormat},
+    {"1e+3", "1000", kDecimalExpFormat},
+    {"1e-3", "1/1000", kDecimalExpFormat},
+    {"1.5e2", "150", kDecimalExpFormat},
+    {"1e64", "1" + strings.Repeat("0", 64), kDecimalExpFormat},
+  }
+  for _, test := range tests {
+    quantity, err := ParseQuantity(test.str)
+    if err != nil {
+      t.Errorf("ParseQuantity(%q) failed: %v", test.str, err)
+      continue
+    }
+    value, _ := new(big.Rat).SetString(test.value)
+    if quantity.Rat().Cmp(value) != 0 {
+      t.Errorf("ParseQuantity(%q) = %s, expected %s", test.str,
+        quantity.Rat().RatString(), test.value)
+    }
+    if quantity.Format() != test.format {
+      t.Errorf("ParseQuantity(%q) has format %s, expected %s", test.str,
+        quantity.Format(), test.format)
+    }
+    if quantity.String() != test.str {
+      t.Errorf("ParseQuantity(%q).String() = %q", test.str,
+        quantity.String())
+    }
+  }
+}
+
+func TestParseQuantityErrors(t *testing.T) {
+  tests := []struct {
+    str string
+    // A part of the expected error message.
+    err string
+  }{
+    {"", "Empty resource quantity."},
+    {"Mi", "expected a number"},
+    {"m", "expected a number"},
+    {"-", "expected a number"},
+    {".", "expected a number"},
+    {"1..5", "unknown suffix"},
+    {"1 Mi", "unknown suffix"},
+    {"1x", "unknown suffix x."},
+    {"1mi", "Did you mean Mi?"},
+    {"1KI", "Did you mean Ki?"},
+    {"1gi", "Did you mean Gi?"},
+    {"1K", "Did you mean k?"},
+    {"1e", "bad exponent"},
+    {"1ex", "bad exponent"},
+    {"1e65", "exponent out of range"},
+    {"1e-65", "exponent out of range"},
+    {"1e99999999999999999999", "bad exponent"},
+  }
+  for _, test := range tests {
+    quantity, err := ParseQuantity(test.str)
+    if err == nil {
+      t.Errorf("ParseQuantity(%q) = %s, expected an error", test.str,
+        quantity.Rat().RatString())
+      continue
+    }
+    if !strings.Contains(err.Error(), test.err) {
+      t.Errorf("ParseQuantity(%q) failed with %q, expected %q", test.str,
+        err, test.err)
+    }
+  }
+}
+
+func TestQuantityValue(t *testing.T) {
+  tests := []struct {
+    str        string
+    value      int64
+    milliValue int64
+  }{
+    {"1", 1, 1000},
+    {"100m", 1, 100},
+    {"0.1m", 1, 1},
+    {"-100m", 0, -100},
+    {"1Ki", 1024, 1024000},
+    // Overflows int64, so the value saturates.
+    {"10Ei", math.MaxInt64, math.MaxInt64},
+    {"-10Ei", math.MinInt64, math.MinInt64},
+    {"1e19", math.MaxInt64, math.MaxInt64},
+    {"1e16", 10000000000000000, math.MaxInt64},
+  }
+  for _, test := range tests {
+    quantity := MustParseQuantity(test.str)
+    if value := quantity.Value(); value != test.value {
+      t.Errorf("Value of %s = %d, expected %d", test.str, value, test.value)
+    }
+    if milliValue := quantity.MilliValue(); milliValue != test.milliValue {
+      t.Errorf("MilliValue of %s = %d, expected %d", test.str, milliValue,
+        test.milliValue)
+    }
+  }
+}
+
+func TestQuantityPrecision(t *testing.T) {
+  if !MustParseQuantity("1Mi").IsWhole() {
+    t.Errorf("1Mi is not whole")
+  }
+  if MustParseQuantity("100m").IsWhole() {
+    t.Errorf("100m is whole")
+  }
+  if !MustParseQuantity("100m").IsWholeMilli() {
+    t.Errorf("100m is not whole in milli units")
+  }
+  if MustParseQuantity("0.5m").IsWholeMilli() {
+    t.Errorf("0.5m is whole in milli units")
+  }
+  if MustParseQuantity("1Gi").Cmp(MustParseQuantity("1G")) <= 0 {
+    t.Errorf("1Gi is not larger than 1G")
+  }
+}
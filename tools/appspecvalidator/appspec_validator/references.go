@@ -0,0 +1,246 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file validates the references between the objects of an appspec, i.e.
+// checks which can only be done once the whole appspec has been read.
+
+package appspecvalidator
+
+import (
+  "sort"
+  "strings"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/field_path"
+)
+
+const (
+  kSelectorOperatorIn           string = "In"
+  kSelectorOperatorNotIn        string = "NotIn"
+  kSelectorOperatorExists       string = "Exists"
+  kSelectorOperatorDoesNotExist string = "DoesNotExist"
+)
+
+// Map returns all the labels, including app, as a map.
+func (labels *Labels) Map() map[string]string {
+  labelMap := make(map[string]string)
+  if labels == nil {
+    return labelMap
+  }
+  for key, value := range labels.Other {
+    labelMap[key] = value
+  }
+  if labels.App != nil {
+    labelMap["app"] = *labels.App
+  }
+  return labelMap
+}
+
+// Returns the labels formatted as key=value pairs in key order.
+func formatLabels(labels map[string]string) string {
+  pairs := make([]string, 0, len(labels))
+  for key, value := range labels {
+    pairs = append(pairs, key+"="+value)
+  }
+  sort.Strings(pairs)
+  return strings.Join(pairs, ",")
+}
+
+// Returns true if every label in subset has the same value in labels.
+func labelsSubset(subset map[string]string, labels map[string]string) bool {
+  for key, value := range subset {
+    if labelValue, ok := labels[key]; !ok || labelValue != value {
+      return false
+    }
+  }
+  return true
+}
+
+// Returns true if the expression selects the given labels.
+func (expression *MatchExpression) matches(labels map[string]string) bool {
+  if expression.Key == nil || expression.Operator == nil {
+    return false
+  }
+  value, ok := labels[*expression.Key]
+  switch *expression.Operator {
+  case kSelectorOperatorExists:
+    return ok
+  case kSelectorOperatorDoesNotExist:
+    return !ok
+  case kSelectorOperatorIn, kSelectorOperatorNotIn:
+    in := false
+    for _, expressionValue := range expression.Values {
+      if ok && value == expressionValue {
+        in = true
+        break
+      }
+    }
+    return in == (*expression.Operator == kSelectorOperatorIn)
+  }
+  return false
+}
+
+// IsEmpty returns true if the selector has no requirements.
+func (selector *Selector) IsEmpty() bool {
+  return len(selector.Labels) == 0 && len(selector.MatchExpressions) == 0 &&
+    len(selector.MatchLabels.Map()) == 0
+}
+
+// Matches returns true if the selector selects the given labels. Both the
+// Service form, which lists the labels directly, and the workload form with
+// matchLabels and matchExpressions are handled. A selector without any
+// requirement selects nothing.
+func (selector *Selector) Matches(labels map[string]string) bool {
+  if selector.IsEmpty() {
+    return false
+  }
+  if !labelsSubset(selector.Labels, labels) ||
+    !labelsSubset(selector.MatchLabels.Map(), labels) {
+    return false
+  }
+  for _, expression := range selector.MatchExpressions {
+    if expression == nil || !expression.matches(labels) {
+      return false
+    }
+  }
+  return true
+}
+
+// Returns the labels of the pod template of the workload in document.
+func templateLabels(document *Document) map[string]string {
+  spec := document.AppSpec.Spec
+  if spec == nil || spec.Template == nil || spec.Template.Metadata == nil {
+    return map[string]string{}
+  }
+  return spec.Template.Metadata.Labels.Map()
+}
+
+// Validates the references between the objects of the appspec.
+func (run *validationRun) validateReferences() {
+  var workloads []*Document
+  services := make(map[string]*Document)
+  configs := make(map[Pair]*Document)
+  for _, document := range run.documents {
+    if document.IsWorkload() {
+      workloads = append(workloads, document)
+    } else if document.Kind() == "Service" {
+      services[document.Name()] = document
+    } else if document.IsConfig() {
+      configs[document.Pair()] = document
+    }
+  }
+
+  for _, document := range workloads {
+    run.setDocument(document)
+    run.validateWorkloadSelector(document)
+    run.validateServiceName(document, services)
+    run.validateConfigReferences(document, configs)
+  }
+  for _, document := range run.documents {
+    if document.Kind() == "Service" {
+      run.setDocument(document)
+      run.validateServiceSelector(document, workloads)
+      run.validateServiceTargets(document, workloads)
+    }
+  }
+  run.validateUnusedConfigs()
+}
+
+// Validates that the selector of a workload selects its own pod template.
+func (run *validationRun) validateWorkloadSelector(document *Document) {
+  spec := document.AppSpec.Spec
+  if spec == nil {
+    return
+  }
+  if spec.Selector == nil {
+    // Jobs get a selector generated, the other workloads must declare one.
+    if kindOf(document.Kind()).RequiresSelector {
+      run.add("spec.selector", "Selector missing.")
+    }
+    return
+  }
+
+  if len(spec.Selector.Labels) > 0 {
+    run.add("spec.selector", "Selector labels must be listed under "+
+      "matchLabels.")
+  }
+  for i, expression := range spec.Selector.MatchExpressions {
+    expressionPath := fieldpath.Index("spec.selector.matchExpressions", i)
+    if expression == nil {
+      run.add(expressionPath, "MatchExpression empty.")
+      continue
+    }
+    if expression.Key == nil {
+      run.add(expressionPath+".key", "MatchExpression key missing.")
+    }
+    if expression.Operator == nil {
+      run.add(expressionPath+".operator", "MatchExpression operator missing.")
+      continue
+    }
+    switch *expression.Operator {
+    case kSelectorOperatorIn, kSelectorOperatorNotIn:
+      if len(expression.Values) == 0 {
+        run.add(expressionPath+".values", "MatchExpression operator %s "+
+          "requires values.", *expression.Operator)
+      }
+    case kSelectorOperatorExists, kSelectorOperatorDoesNotExist:
+      if len(expression.Values) != 0 {
+        run.add(expressionPath+".values", "MatchExpression operator %s "+
+          "does not take values.", *expression.Operator)
+      }
+    default:
+      run.add(expressionPath+".operator", "Invalid MatchExpression operator "+
+        "%s, expected one of %s, %s, %s, %s.", *expression.Operator,
+        kSelectorOperatorIn, kSelectorOperatorNotIn, kSelectorOperatorExists,
+        kSelectorOperatorDoesNotExist)
+    }
+  }
+
+  labels := templateLabels(document)
+  if spec.Selector.IsEmpty() {
+    run.add("spec.selector", "Selector has no requirements.")
+  } else if !spec.Selector.Matches(labels) {
+    run.add("spec.selector", "Selector does not match the template labels "+
+      "{%s}.", formatLabels(labels))
+  }
+}
+
+// Validates that the serviceName of a StatefulSet names a Service of the
+// appspec.
+func (run *validationRun) validateServiceName(document *Document,
+  services map[string]*Document) {
+  spec := document.AppSpec.Spec
+  if !kindOf(document.Kind()).ServiceName || spec == nil ||
+    spec.ServiceName == nil {
+    return
+  }
+  if _, ok := services[*spec.ServiceName]; !ok {
+    run.add("spec.serviceName", "ServiceName %s does not name a Service in "+
+      "the appspec.", *spec.ServiceName)
+  }
+}
+
+// Validates that the selector of a Service selects the pods of at least one
+// workload.
+func (run *validationRun) validateServiceSelector(document *Document,
+  workloads []*Document) {
+  spec := document.AppSpec.Spec
+  if spec == nil || spec.Selector == nil {
+    return
+  }
+  selector := spec.Selector
+  if selector.MatchLabels != nil || selector.MatchExpressions != nil {
+    run.add("spec.selector", "Service selector must list the labels "+
+      "directly, matchLabels and matchExpressions are not supported.")
+    return
+  }
+  if len(selector.Labels) == 0 {
+    run.add("spec.selector", "Service spec selector has no labels.")
+    return
+  }
+  for _, workload := range workloads {
+    if selector.Matches(templateLabels(workload)) {
+      return
+    }
+  }
+  run.add("spec.selector", "Service selector {%s} does not match the "+
+    "template labels of any workload.", formatLabels(selector.Labels))
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file validates the replica policy of workloads and computes how many
+// pods, and how much cpu and memory, a policy amounts to on a cluster.
+//
+// A workload runs either a fixed number of pods, or share pods per node of
+// the cluster, bounded by min and max.
+
+package appspecvalidator
+
+import (
+  "fmt"
+  "io"
+  "math/big"
+  "text/tabwriter"
+)
+
+// Validates the replica policy of the current object, given at path.
+func (run *validationRun) validateReplicas(replicas *Replicas, path string) {
+  if replicas == nil {
+    return
+  }
+  if features := kindOf(run.kind); !features.Replicas {
+    pods := "a single pod"
+    if features.PodPerNode {
+      pods = "a pod on every node"
+    }
+    run.add(path, "Replicas are not supported for a %s, which runs %s.",
+      run.kind, pods)
+    return
+  }
+
+  if replicas.Fixed != nil {
+    if replicas.Share != nil || replicas.Min != nil || replicas.Max != nil {
+      run.add(path, "Replica specification incorrect. fixed can not be "+
+        "combined with share, min or max.")
+    }
+    if *replicas.Fixed < 1 {
+      run.add(path+".fixed", "Replicas fixed must be at least 1, got %d.",
+        *replicas.Fixed)
+    }
+    return
+  }
+  if replicas.Share == nil {
+    run.add(path, "Replica specification incorrect. Either fixed or share "+
+      "must be set.")
+    return
+  }
+
+  if *replicas.Share < 1 {
+    run.add(path+".share", "Replicas share must be at least 1, got %d.",
+      *replicas.Share)
+  }
+  if replicas.Min != nil && *replicas.Min < 1 {
+    run.add(path+".min", "Replicas min must be at least 1, got %d.",
+      *replicas.Min)
+  }
+  if replicas.Max != nil && *replicas.Max < 1 {
+    run.add(path+".max", "Replicas max must be at least 1, got %d.",
+      *replicas.Max)
+  }
+  if replicas.Min != nil && replicas.Max != nil &&
+    *replicas.Min > *replicas.Max {
+    run.add(path+".min", "Replicas min %d is greater than max %d.",
+      *replicas.Min, *replicas.Max)
+  }
+  if replicas.Max == nil {
+    run.warn(path, "Replicas share without max grows with the size of the "+
+      "cluster. Set max to bound the number of pods.")
+  }
+}
+
+// WorkloadReplicas is the number of pods of a workload on a cluster, and the
+// resources they request together.
+type WorkloadReplicas struct {
+  Kind     string
+  Name     string
+  Replicas int
+  // True for the cleanup Job, which only runs when the app is uninstalled.
+  Cleanup bool
+  // Cpu in cores and memory in bytes requested by all the pods.
+  Cpu    *big.Rat
+  Memory *big.Rat
+}
+
+// ReplicaCounts returns the pods each workload of a valid appspec runs on a
+// cluster of the given number of nodes, and the resources they request.
+func ReplicaCounts(documents []*Document, nodes int) []*WorkloadReplicas {
+  var counts []*WorkloadReplicas
+  for _, document := range documents {
+    spec := document.AppSpec.Spec
+    if !document.IsWorkload() || spec == nil {
+      continue
+    }
+    count := &WorkloadReplicas{
+      Kind:     document.Kind(),
+      Name:     document.Name(),
+      Replicas: document.Replicas(nodes),
+      Cleanup:  document.IsCleanupJob(),
+      Cpu:      new(big.Rat),
+      Memory:   new(big.Rat),
+    }
+    if spec.Template != nil && spec.Template.TemplateSpec != nil {
+      for _, container := range spec.Template.TemplateSpec.Containers {
+        if container == nil || container.Resources == nil {
+          continue
+        }
+        // The quantities of a valid appspec parse.
+        requests := container.Resources.Requests
+        if cpu, _ := requests.CpuQuantity(); cpu != nil {
+          count.Cpu.Add(count.Cpu, cpu.value)
+        }
+        if memory, _ := requests.MemoryQuantity(); memory != nil {
+          count.Memory.Add(count.Memory, memory.value)
+        }
+      }
+    }
+    replicas := new(big.Rat).SetInt64(int64(count.Replicas))
+    count.Cpu.Mul(count.Cpu, replicas)
+    count.Memory.Mul(count.Memory, replicas)
+    counts = append(counts, count)
+  }
+  return counts
+}
+
+// FormatCpu formats cores as a cpu quantity, e.g. 2 or 1500m.
+func FormatCpu(cores *big.Rat) string {
+  if cores.IsInt() {
+    return cores.Num().String()
+  }
+  millis := new(big.Rat).Mul(cores, big.NewRat(1000, 1))
+  if millis.IsInt() {
+    return millis.Num().String() + "m"
+  }
+  return cores.FloatString(3)
+}
+
+// FormatMemory formats bytes as a memory quantity with the largest binary
+// suffix which divides it, e.g. 1536Mi.
+func FormatMemory(bytes *big.Rat) string {
+  if !bytes.IsInt() {
+    return bytes.FloatString(3)
+  }
+  value := new(big.Int).Set(bytes.Num())
+  suffix := ""
+  unit := big.NewInt(1024)
+  for _, next := range []string{"Ki", "Mi", "Gi", "Ti", "Pi", "Ei"} {
+    quotient, remainder := new(big.Int).QuoRem(value, unit, new(big.Int))
+    if value.Sign() == 0 || remainder.Sign() != 0 {
+      break
+    }
+    value = quotient
+    suffix = next
+  }
+  return fmt.Sprintf("%s%s", value, suffix)
+}
+
+// WriteReplicaReport writes the pods each workload runs on a cluster of the
+// given number of nodes, with the cpu and memory they request, followed by
+// the total requested by the app. The cleanup Job is left out of the total,
+// since it only runs when the app is uninstalled. If budget is not nil, the
+// total is compared with it.
+func WriteReplicaReport(writer io.Writer, counts []*WorkloadReplicas,
+  nodes int, budget *Budget) error {
+  table := tabwriter.NewWriter(writer, 0, 8, 2, ' ', 0)
+  fmt.Fprintf(table, "Replicas on %d node(s):\n", nodes)
+  fmt.Fprintln(table, "  KIND\tNAME\tREPLICAS\tCPU\tMEMORY")
+  totalCpu := new(big.Rat)
+  totalMemory := new(big.Rat)
+  for _, count := range counts {
+    name := count.Name
+    if count.Cleanup {
+      name += " (cleanup)"
+    } else {
+      totalCpu.Add(totalCpu, count.Cpu)
+      totalMemory.Add(totalMemory, count.Memory)
+    }
+    fmt.Fprintf(table, "  %s\t%s\t%d\t%s\t%s\n", count.Kind, name,
+      count.Replicas, FormatCpu(count.Cpu), FormatMemory(count.Memory))
+  }
+  fmt.Fprintf(table, "  Total\t\t\t%s\t%s\n", FormatCpu(totalCpu),
+    FormatMemory(totalMemory))
+  if budget != nil {
+    fmt.Fprintf(table, "  Budget\t\t\t%s\t%s\n",
+      budgetShare(totalCpu, budget.Cpu), budgetShare(totalMemory,
+        budget.Memory))
+  }
+  return table.Flush()
+}
+
+// Returns the budget of a resource and the percentage of it used by total,
+// e.g. 4 (75%), or "-" if the resource is not limited.
+func budgetShare(total *big.Rat, budget *Quantity) string {
+  if budget == nil {
+    return "-"
+  }
+  if budget.Sign() == 0 {
+    return budget.String()
+  }
+  percent := new(big.Rat).Quo(total, budget.value)
+  percent.Mul(percent, big.NewRat(100, 1))
+  return fmt.Sprintf("%s (%s%%)", budget, percent.FloatString(0))
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file defines the lint rules shipped with the validator, see lint.go.
+
+package appspecvalidator
+
+import (
+  "fmt"
+  "strings"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/field_path"
+)
+
+const (
+  kContainersPath string = "spec.template.spec.containers"
+
+  kNamePrefixOption string = "prefix"
+)
+
+func init() {
+  RegisterRule(&memoryRequestRule{}, true)
+  RegisterRule(&imageTagRule{}, true)
+  RegisterRule(&namePrefixRule{}, false)
+}
+
+// Returns the name of a container as shown in findings.
+func containerName(container *ContainerSpec, index int) string {
+  if container.Name == nil {
+    return fmt.Sprintf("%d", index)
+  }
+  return *container.Name
+}
+
+// memoryRequestRule requires every container to request memory, so that the
+// app is not starved of memory by the other apps of its nodes.
+type memoryRequestRule struct{}
+
+func (rule *memoryRequestRule) Id() string {
+  return "memory-request"
+}
+
+func (rule *memoryRequestRule) Description() string {
+  return "Every container must request memory."
+}
+
+func (rule *memoryRequestRule) Check(documents []*Document,
+  context *RuleContext) {
+  for _, document := range documents {
+    for i, container := range document.Containers() {
+      if container == nil {
+        continue
+      }
+      resources := container.Resources
+      if resources != nil && resources.Requests != nil &&
+        resources.Requests.Memory != nil {
+        continue
+      }
+      context.Report(document,
+        fieldpath.Index(kContainersPath, i)+".resources.requests.memory",
+        "Container %s does not request memory.",
+        containerName(container, i))
+    }
+  }
+}
+
+// imageTagRule requires images to be pinned to a tag other than latest, or
+// to a digest, so that the app always runs the images it was tested with.
+type imageTagRule struct{}
+
+func (rule *imageTagRule) Id() string {
+  return "image-tag"
+}
+
+func (rule *imageTagRule) Description() string {
+  return "Images must be pinned to a tag other than latest, or to a digest."
+}
+
+func (rule *imageTagRule) Check(documents []*Document, context *RuleContext) {
+  for _, document := range documents {
+    for i, container := range document.Containers() {
+      if container == nil || container.Image == nil {
+        continue
+      }
+      ref := NormalizeImageRef(*container.Image)
+      if strings.Contains(ref, "@") ||
+        ref[strings.LastIndex(ref, ":")+1:] != kDefaultImageTag {
+        continue
+      }
+      context.Report(document, fieldpath.Index(kContainersPath, i)+".image",
+        "Image %s of container %s is not pinned to a tag other than %s.",
+        *container.Image, containerName(container, i), kDefaultImageTag)
+    }
+  }
+}
+
+// namePrefixRule requires the names of all the objects to start with the
+// prefix option, e.g. the name of the app, so that the objects of different
+// apps are told apart.
+type namePrefixRule struct{}
+
+func (rule *namePrefixRule) Id() string {
+  return "name-prefix"
+}
+
+func (rule *namePrefixRule) Description() string {
+  return "Object names must start with the prefix option."
+}
+
+func (rule *namePrefixRule) ValidateOptions(options map[string]string) error {
+  for name := range options {
+    if name != kNamePrefixOption {
+      return fmt.Errorf("Unknown option %s, expected %s.", name,
+        kNamePrefixOption)
+    }
+  }
+  if options[kNamePrefixOption] == "" {
+    return fmt.Errorf("Option %s missing.", kNamePrefixOption)
+  }
+  return nil
+}
+
+func (rule *namePrefixRule) Check(documents []*Document,
+  context *RuleContext) {
+  prefix := context.Option(kNamePrefixOption)
+  for _, document := range documents {
+    name := document.Name()
+    if name == "" || strings.HasPrefix(name, prefix) {
+      continue
+    }
+    context.Report(document, "metadata.name",
+      "Name %s does not start with %s.", name, prefix)
+  }
+}
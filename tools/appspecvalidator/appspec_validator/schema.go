@@ -0,0 +1,588 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file generates a JSON Schema for the Cohesity appspec dialect from the
+// AppSpec model, and validates appspecs against that schema. Editors using
+// the YAML language server can use the schema to complete and check appspecs
+// as they are typed.
+
+package appspecvalidator
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "reflect"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/field_path"
+  "gopkg.in/yaml.v3"
+)
+
+const (
+  kJsonSchemaDraft   string = "http://json-schema.org/draft-07/schema#"
+  kAppSpecSchemaId   string = "https://github.com/cohesity/cohesity-appspec/appspec.schema.json"
+  kSchemaDefinitions string = "#/definitions/"
+
+  // Matches the quantity grammar accepted by ParseQuantity.
+  kQuantityPattern string = `^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)` +
+    `([KMGTPE]i|[numkMGTPE]|[eE][+-]?[0-9]+)?$`
+  // Matches the name of an environment variable.
+  kEnvNamePattern string = `^[A-Za-z_][A-Za-z0-9_]*$`
+)
+
+// Schema is a JSON Schema (draft-07) or one of its subschemas. Only the
+// keywords needed to describe an appspec are supported.
+type Schema struct {
+  Schema      string             `json:"$schema,omitempty"`
+  Id          string             `json:"$id,omitempty"`
+  Ref         string             `json:"$ref,omitempty"`
+  Title       string             `json:"title,omitempty"`
+  Description string             `json:"description,omitempty"`
+  Definitions map[string]*Schema `json:"definitions,omitempty"`
+  // Either a single type name or a list of them.
+  Type                 interface{}        `json:"type,omitempty"`
+  Properties           map[string]*Schema `json:"properties,omitempty"`
+  // Either false or the schema of the properties not listed in Properties.
+  AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+  Required             []string           `json:"required,omitempty"`
+  Items                *Schema            `json:"items,omitempty"`
+  Enum                 []interface{}      `json:"enum,omitempty"`
+  Const                interface{}        `json:"const,omitempty"`
+  Pattern              string             `json:"pattern,omitempty"`
+  Minimum              *float64           `json:"minimum,omitempty"`
+  Maximum              *float64           `json:"maximum,omitempty"`
+  AllOf                []*Schema          `json:"allOf,omitempty"`
+  If                   *Schema            `json:"if,omitempty"`
+  Then                 *Schema            `json:"then,omitempty"`
+}
+
+// Returns a pointer to value, for the Minimum and Maximum keywords.
+func schemaBound(value float64) *float64 {
+  return &value
+}
+
+// Returns the values as an enum.
+func schemaEnum(values ...string) []interface{} {
+  enum := make([]interface{}, 0, len(values))
+  for _, value := range values {
+    enum = append(enum, value)
+  }
+  return enum
+}
+
+var (
+  // Keywords added to the schema of the fields of the model, keyed by the
+  // type name and the YAML key of the field.
+  schemaAnnotations = map[string]*Schema{
+    "AppSpec.apiVersion": &Schema{
+      Description: "API version of the object, which depends on its kind.",
+    },
+    "AppSpec.kind": &Schema{
+      Description: "Kind of the object.",
+    },
+    "Metadata.cohesityTag": &Schema{
+      Description: "Cohesity tag of the object. 'cleanup' marks the Job " +
+        "which cleans up after the app. At most one Job may be tagged.",
+      Enum: schemaEnum(kCohesityCleanupTag),
+    },
+    "Ports.cohesityTag": &Schema{
+      Description: "Cohesity tag of the port of a NodePort Service. 'ui' " +
+        "marks the node port serving the UI of the app, which 'Open App' " +
+        "opens. At most one port of the appspec may be tagged.",
+      Enum: schemaEnum(kCohesityUiNodePortTag),
+    },
+    "Ports.cohesityEnv": &Schema{
+      Description: "Name of an environment variable through which the node " +
+        "port allocated for this port is passed to all the pods of the app. " +
+        "Must be unique in the appspec.",
+      Pattern: kEnvNamePattern,
+    },
+    "Spec.replicas": &Schema{
+      Description: "Number of pods to run. Either 'fixed', or 'share' " +
+        "optionally bounded by 'min' and 'max'.",
+    },
+    "Replicas.fixed": &Schema{
+      Description: "Fixed number of pods, whatever the size of the cluster.",
+      Minimum:     schemaBound(1),
+    },
+    "Replicas.share": &Schema{
+      Description: "Number of pods per node of the cluster.",
+      Minimum:     schemaBound(1),
+    },
+    "Replicas.min": &Schema{
+      Description: "Least number of pods when using 'share'.",
+      Minimum:     schemaBound(1),
+    },
+    "Replicas.max": &Schema{
+      Description: "Most number of pods when using 'share'.",
+      Minimum:     schemaBound(1),
+    },
+    "Spec.type": &Schema{
+      Description: "Type of the Service.",
+      Enum:        schemaEnum("NodePort", "ClusterIP"),
+    },
+    "Spec.strategy": &Schema{
+      Description: "How a Deployment replaces its pods when it is updated.",
+    },
+    "DeploymentStrategy.type": &Schema{
+      Enum: schemaEnum(kStrategyRollingUpdate, kStrategyRecreate),
+    },
+    "Spec.backoffLimit": &Schema{
+      Description: "Number of retries of the pod of a Job before the Job " +
+        "fails. Defaults to 6.",
+      Minimum: schemaBound(0),
+    },
+    "Spec.activeDeadlineSeconds": &Schema{
+      Description: "Most seconds a Job may run, retries included. A " +
+        "cleanup Job should set it, so that a hanging cleanup does not hold " +
+        "up the uninstall of the app.",
+      Minimum: schemaBound(1),
+    },
+    "TemplateSpec.restartPolicy": &Schema{
+      Description: "Whether a failed container is restarted. A Job must " +
+        "set 'OnFailure' or 'Never', the other workloads only allow " +
+        "'Always'.",
+      Enum: schemaEnum(kRestartPolicyAlways, kRestartPolicyOnFailure,
+        kRestartPolicyNever),
+    },
+    "Spec.clusterIp": &Schema{
+      Description: "Only 'None' is allowed, for a headless ClusterIP " +
+        "Service. 'none' is also accepted.",
+      Enum: schemaEnum(kClusterIpNone, kLegacyClusterIpNone),
+    },
+    "VolumeSpec.volumeType": &Schema{
+      Description: "'static' mounts the existing Cohesity view named by " +
+        "'volumeName', 'dynamic' gets a volume created for the app.",
+      Enum: schemaEnum(kVolumeTypeStatic, kVolumeTypeDynamic),
+    },
+    "VolumeSpec.volumeName": &Schema{
+      Description: "Name of the Cohesity view mounted by a static volume.",
+    },
+    "VolumeSpec.fsType": &Schema{
+      Description: "File system type of the volume.",
+    },
+    "VolumeSpec.configMap": &Schema{
+      Description: "ConfigMap of the appspec whose keys are the files of " +
+        "the volume, instead of a Cohesity volume.",
+    },
+    "VolumeSpec.secret": &Schema{
+      Description: "Secret of the appspec whose keys are the files of the " +
+        "volume, instead of a Cohesity volume.",
+    },
+    "AppSpec.data": &Schema{
+      Description: "Keys and values of a ConfigMap or Secret. The values " +
+        "of a Secret are base64 encoded.",
+    },
+    "AppSpec.stringData": &Schema{
+      Description: "Keys and plain values of a Secret.",
+    },
+    "AppSpec.type": &Schema{
+      Description: "Type of a Secret.",
+      Enum:        schemaEnum(kSecretTypeOpaque),
+    },
+    "EnvFromSource.prefix": &Schema{
+      Pattern: kEnvNamePattern,
+    },
+    "Requests.cpu": &Schema{
+      Description: "Cpu quantity, e.g. 500m or 1.5.",
+      Type:        []string{"string", "number"},
+      Pattern:     kQuantityPattern,
+    },
+    "Requests.memory": &Schema{
+      Description: "Memory quantity in bytes, e.g. 100Mi or 1G.",
+      Type:        []string{"string", "number"},
+      Pattern:     kQuantityPattern,
+    },
+    "Requests.ephemeral-storage": &Schema{
+      Description: "Local storage quantity in bytes, e.g. 1Gi.",
+      Type:        []string{"string", "number"},
+      Pattern:     kQuantityPattern,
+    },
+    "ContainerSpec.imagePullPolicy": &Schema{
+      Enum: schemaEnum(kImagePullPolicyAlways, kImagePullPolicyIfNotPresent,
+        kImagePullPolicyNever),
+    },
+    "ContainerPort.containerPort": &Schema{
+      Minimum: schemaBound(float64(kMinPort)),
+      Maximum: schemaBound(float64(kMaxPort)),
+    },
+    "ContainerPort.hostPort": &Schema{
+      Minimum: schemaBound(float64(kMinPort)),
+      Maximum: schemaBound(float64(kMaxPort)),
+    },
+    "ContainerPort.protocol": &Schema{
+      Enum: schemaEnum(kProtocolTcp, kProtocolUdp, kProtocolSctp),
+    },
+    "Ports.port": &Schema{
+      Minimum: schemaBound(float64(kMinPort)),
+      Maximum: schemaBound(float64(kMaxPort)),
+    },
+    "Ports.protocol": &Schema{
+      Enum: schemaEnum(kProtocolTcp, kProtocolUdp),
+    },
+    "Ports.targetPort": &Schema{
+      Description: "Port of the selected pods the traffic is sent to, by " +
+        "number or by the name of a container port. Defaults to 'port'.",
+    },
+    "HttpGetAction.scheme": &Schema{
+      Enum: schemaEnum(kHttpSchemeHttp, kHttpSchemeHttps),
+    },
+    "MatchExpression.operator": &Schema{
+      Enum: schemaEnum(kSelectorOperatorIn, kSelectorOperatorNotIn,
+        kSelectorOperatorExists, kSelectorOperatorDoesNotExist),
+    },
+    "Env.name": &Schema{
+      Pattern: kEnvNamePattern,
+    },
+  }
+
+  // The required fields of the types of the model, keyed by type name.
+  schemaRequired = map[string][]string{
+    "AppSpec":         []string{"apiVersion", "kind", "metadata"},
+    "ContainerSpec":   []string{"name", "image"},
+    "VolumeSpec":      []string{"name"},
+    "VolumeMounts":    []string{"name", "mountPath"},
+    "TemplateSpec":    []string{"containers"},
+    "Template":        []string{"spec"},
+    "ContainerPort":   []string{"containerPort"},
+    "Ports":           []string{"port"},
+    "Env":             []string{"name"},
+    "MatchExpression": []string{"key", "operator"},
+    "KeySelector":     []string{"name", "key"},
+    "ObjectReference": []string{"name"},
+    "KeyToPath":       []string{"key", "path"},
+
+    "ConfigMapVolumeSource": []string{"name"},
+    "SecretVolumeSource":    []string{"secretName"},
+  }
+
+  // The schema generated from the model, see appSpecSchema.
+  generatedSchema     *Schema
+  generatedSchemaOnce sync.Once
+)
+
+// Returns the schema of the YAML values decoded into valueType. The schema of
+// structs is added to definitions and referred to.
+func typeSchema(valueType reflect.Type,
+  definitions map[string]*Schema) *Schema {
+  if reflect.PtrTo(derefType(valueType)).Implements(yamlUnmarshalerType) {
+    // The only such type is IntOrString.
+    return &Schema{Type: []string{"integer", "string"}}
+  }
+  valueType = derefType(valueType)
+  switch valueType.Kind() {
+  case reflect.Struct:
+    name := valueType.Name()
+    if _, ok := definitions[name]; !ok {
+      // Add the definition before filling it in, types may be recursive.
+      definition := &Schema{Type: "object"}
+      definitions[name] = definition
+      fillStructSchema(definition, valueType, definitions)
+    }
+    return &Schema{Ref: kSchemaDefinitions + name}
+  case reflect.Slice:
+    return &Schema{Type: "array", Items: typeSchema(valueType.Elem(),
+      definitions)}
+  case reflect.Map:
+    return &Schema{Type: "object",
+      AdditionalProperties: typeSchema(valueType.Elem(), definitions)}
+  case reflect.String:
+    return &Schema{Type: "string"}
+  case reflect.Bool:
+    return &Schema{Type: "boolean"}
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+    reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+    reflect.Uint64:
+    return &Schema{Type: "integer"}
+  case reflect.Float32, reflect.Float64:
+    return &Schema{Type: "number"}
+  }
+  return &Schema{}
+}
+
+// Fills in the schema of the struct type structType.
+func fillStructSchema(schema *Schema, structType reflect.Type,
+  definitions map[string]*Schema) {
+  fields := structYamlFields(structType)
+  schema.Properties = make(map[string]*Schema)
+  for key, fieldType := range fields.types {
+    property := typeSchema(fieldType, definitions)
+    annotation, ok := schemaAnnotations[structType.Name()+"."+key]
+    if ok {
+      property = annotateSchema(property, annotation)
+    }
+    schema.Properties[key] = property
+  }
+  if fields.anyKey {
+    // Only inline maps of labels accept any key.
+    schema.AdditionalProperties = &Schema{Type: "string"}
+  } else {
+    schema.AdditionalProperties = false
+  }
+  schema.Required = schemaRequired[structType.Name()]
+}
+
+// Returns schema with the keywords of annotation added.
+func annotateSchema(schema *Schema, annotation *Schema) *Schema {
+  if schema.Ref != "" {
+    // Keywords next to $ref are ignored, so wrap the reference.
+    return &Schema{Description: annotation.Description,
+      AllOf: []*Schema{schema}}
+  }
+  annotated := *schema
+  annotated.Description = annotation.Description
+  if annotation.Type != nil {
+    annotated.Type = annotation.Type
+  }
+  annotated.Enum = annotation.Enum
+  annotated.Pattern = annotation.Pattern
+  annotated.Minimum = annotation.Minimum
+  annotated.Maximum = annotation.Maximum
+  return &annotated
+}
+
+// GenerateSchema returns the JSON Schema of a single object of an appspec.
+// An appspec is a stream of such objects, one per YAML document.
+func GenerateSchema() *Schema {
+  definitions := make(map[string]*Schema)
+  schema := &Schema{
+    Schema: kJsonSchemaDraft,
+    Id:     kAppSpecSchemaId,
+    Title:  "Cohesity AppSpec object",
+    Description: "An object of the appspec of a Cohesity app. This is a " +
+      "dialect of Kubernetes with Cohesity extensions such as cohesityTag, " +
+      "cohesityEnv, replicas.fixed/share/min/max and volumeType.",
+    AllOf: []*Schema{
+      typeSchema(reflect.TypeOf(AppSpec{}), definitions),
+      // Objects need a name, the metadata of pod templates does not.
+      &Schema{Properties: map[string]*Schema{
+        "metadata": &Schema{Required: []string{"name"}},
+      }},
+    },
+    Definitions: definitions,
+  }
+  definitions["AppSpec"].Properties["kind"].Enum =
+    schemaEnum(SupportedKinds()...)
+
+  // The apiVersion and the required parts of the spec depend on the kind.
+  // ConfigMaps and Secrets have no spec.
+  for _, kind := range SupportedKinds() {
+    then := &Schema{
+      Properties: map[string]*Schema{
+        "apiVersion": &Schema{Const: ExpectedApiVersion(kind)},
+      },
+    }
+    if !kindOf(kind).Config {
+      specRequired := []string{"template"}
+      if kind == "Service" {
+        specRequired = []string{"type", "selector"}
+      }
+      then.Properties["spec"] = &Schema{Required: specRequired}
+      then.Required = []string{"spec"}
+    }
+    schema.AllOf = append(schema.AllOf, &Schema{
+      If: &Schema{
+        Properties: map[string]*Schema{"kind": &Schema{Const: kind}},
+        Required:   []string{"kind"},
+      },
+      Then: then,
+    })
+  }
+  return schema
+}
+
+// WriteSchema writes the JSON Schema of an appspec object to writer.
+func WriteSchema(writer io.Writer) error {
+  encoder := json.NewEncoder(writer)
+  encoder.SetIndent("", "  ")
+  return encoder.Encode(GenerateSchema())
+}
+
+// Returns the schema generated from the model. It is generated once and
+// never modified, so it can be shared between concurrent validations.
+func appSpecSchema() *Schema {
+  generatedSchemaOnce.Do(func() {
+    generatedSchema = GenerateSchema()
+  })
+  return generatedSchema
+}
+
+// schemaViolation is a violation of a schema found at path.
+type schemaViolation struct {
+  path    string
+  message string
+}
+
+// Returns the JSON type of the YAML node.
+func nodeJsonType(node *yaml.Node) string {
+  switch node.Kind {
+  case yaml.MappingNode:
+    return "object"
+  case yaml.SequenceNode:
+    return "array"
+  }
+  switch node.ShortTag() {
+  case "!!int":
+    return "integer"
+  case "!!float":
+    return "number"
+  case "!!bool":
+    return "boolean"
+  case "!!null":
+    return "null"
+  }
+  return "string"
+}
+
+// Returns the types allowed by the schema.
+func (schema *Schema) types() []string {
+  switch schemaType := schema.Type.(type) {
+  case string:
+    return []string{schemaType}
+  case []string:
+    return schemaType
+  }
+  return nil
+}
+
+// Returns true if the scalar node equals the enum or const value.
+func nodeEquals(node *yaml.Node, value interface{}) bool {
+  return node.Kind == yaml.ScalarNode && node.Value == fmt.Sprint(value)
+}
+
+// Returns the violations of the schema by the YAML node found at path. root
+// is the schema holding the definitions.
+func (schema *Schema) check(node *yaml.Node, path string,
+  root *Schema) []schemaViolation {
+  for node.Kind == yaml.AliasNode {
+    node = node.Alias
+  }
+  if schema.Ref != "" {
+    definition := root.Definitions[strings.TrimPrefix(schema.Ref,
+      kSchemaDefinitions)]
+    return definition.check(node, path, root)
+  }
+
+  var violations []schemaViolation
+  for _, subschema := range schema.AllOf {
+    violations = append(violations, subschema.check(node, path, root)...)
+  }
+  if schema.If != nil && schema.Then != nil &&
+    len(schema.If.check(node, path, root)) == 0 {
+    violations = append(violations, schema.Then.check(node, path, root)...)
+  }
+
+  nodeType := nodeJsonType(node)
+  if types := schema.types(); types != nil {
+    matched := false
+    for _, schemaType := range types {
+      matched = matched || schemaType == nodeType ||
+        schemaType == "number" && nodeType == "integer"
+    }
+    if !matched {
+      return append(violations, schemaViolation{path, fmt.Sprintf(
+        "Expected %s, got %s.", strings.Join(types, " or "), nodeType)})
+    }
+  }
+
+  if schema.Enum != nil {
+    matched := false
+    for _, value := range schema.Enum {
+      matched = matched || nodeEquals(node, value)
+    }
+    if !matched {
+      values := make([]string, 0, len(schema.Enum))
+      for _, value := range schema.Enum {
+        values = append(values, fmt.Sprint(value))
+      }
+      violations = append(violations, schemaViolation{path, fmt.Sprintf(
+        "Invalid value %s, expected one of %s.", node.Value,
+        strings.Join(values, ", "))})
+    }
+  }
+  if schema.Const != nil && !nodeEquals(node, schema.Const) {
+    violations = append(violations, schemaViolation{path, fmt.Sprintf(
+      "Invalid value %s, expected %v.", node.Value, schema.Const)})
+  }
+  if schema.Pattern != "" && nodeType == "string" &&
+    !regexp.MustCompile(schema.Pattern).MatchString(node.Value) {
+    violations = append(violations, schemaViolation{path, fmt.Sprintf(
+      "Invalid value %s, does not match %s.", node.Value, schema.Pattern)})
+  }
+  if nodeType == "integer" || nodeType == "number" {
+    value, err := strconv.ParseFloat(node.Value, 64)
+    if err == nil && schema.Minimum != nil && value < *schema.Minimum {
+      violations = append(violations, schemaViolation{path, fmt.Sprintf(
+        "Value %s is less than the minimum %v.", node.Value,
+        *schema.Minimum)})
+    }
+    if err == nil && schema.Maximum != nil && value > *schema.Maximum {
+      violations = append(violations, schemaViolation{path, fmt.Sprintf(
+        "Value %s is more than the maximum %v.", node.Value,
+        *schema.Maximum)})
+    }
+  }
+
+  switch node.Kind {
+  case yaml.MappingNode:
+    violations = append(violations, schema.checkObject(node, path, root)...)
+  case yaml.SequenceNode:
+    if schema.Items != nil {
+      for i, child := range node.Content {
+        violations = append(violations,
+          schema.Items.check(child, fieldpath.Index(path, i), root)...)
+      }
+    }
+  }
+  return violations
+}
+
+// Returns the violations of the object keywords of the schema by the mapping
+// node found at path.
+func (schema *Schema) checkObject(node *yaml.Node, path string,
+  root *Schema) []schemaViolation {
+  var violations []schemaViolation
+  keys := make(map[string]bool)
+  for i := 0; i+1 < len(node.Content); i += 2 {
+    key := node.Content[i].Value
+    keys[key] = true
+    keyPath := fieldpath.Join(path, key)
+    if property, ok := schema.Properties[key]; ok {
+      violations = append(violations,
+        property.check(node.Content[i+1], keyPath, root)...)
+      continue
+    }
+    switch additional := schema.AdditionalProperties.(type) {
+    case bool:
+      if !additional {
+        violations = append(violations, schemaViolation{keyPath,
+          fmt.Sprintf("Unknown field %s.", key)})
+      }
+    case *Schema:
+      violations = append(violations,
+        additional.check(node.Content[i+1], keyPath, root)...)
+    }
+  }
+
+  required := append([]string(nil), schema.Required...)
+  sort.Strings(required)
+  for _, key := range required {
+    if !keys[key] {
+      violations = append(violations, schemaViolation{fieldpath.Join(path, key),
+        fmt.Sprintf("Required field %s missing.", key)})
+    }
+  }
+  return violations
+}
+
+// Validates the current document against the generated schema.
+func (run *validationRun) validateSchema(node *yaml.Node) {
+  schema := appSpecSchema()
+  for _, violation := range schema.check(node, "", schema) {
+    run.add(violation.path, "Schema: %s", violation.message)
+  }
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file validates the ports of Services and the container ports they
+// send traffic to.
+
+package appspecvalidator
+
+import (
+  "strconv"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/field_path"
+)
+
+const (
+  kServiceTypeNodePort  string = "NodePort"
+  kServiceTypeClusterIp string = "ClusterIP"
+
+  // The only clusterIp an appspec may set, which makes a headless Service.
+  // Appspecs used to spell it none, which is still accepted.
+  kClusterIpNone       string = "None"
+  kLegacyClusterIpNone string = "none"
+
+  // Service port names are DNS labels.
+  kMaxServicePortNameLength int = 63
+)
+
+// IsHeadless returns true if the Service with the spec gets no cluster IP,
+// because its clusterIp is None.
+func (spec *Spec) IsHeadless() bool {
+  return spec.ClusterIp != nil && (*spec.ClusterIp == kClusterIpNone ||
+    *spec.ClusterIp == kLegacyClusterIpNone)
+}
+
+// Returns true if name is a valid Service port name.
+func isValidServicePortName(name string) bool {
+  return len(name) <= kMaxServicePortNameLength &&
+    portNameRegexp.MatchString(name)
+}
+
+// Validates the ports of a Service, whatever its type.
+func (run *validationRun) validateServicePorts(ports []*Ports) {
+  names := make(map[string]bool)
+  numbers := make(map[string]bool)
+  for i, port := range ports {
+    portPath := fieldpath.Index("spec.ports", i)
+    if port == nil {
+      run.add(portPath, "Port empty.")
+      continue
+    }
+
+    protocol := kProtocolTcp
+    if port.Protocol != nil {
+      protocol = *port.Protocol
+      if protocol != kProtocolTcp && protocol != kProtocolUdp {
+        run.add(portPath+".protocol", "Invalid protocol %s, expected %s or "+
+          "%s.", protocol, kProtocolTcp, kProtocolUdp)
+      }
+    }
+
+    if port.Port == nil {
+      run.add(portPath+".port", "Service port port missing.")
+    } else if !isValidPort(*port.Port) {
+      run.add(portPath+".port", "Service port %d out of range %d-%d.",
+        *port.Port, kMinPort, kMaxPort)
+    } else {
+      key := strconv.Itoa(*port.Port) + "/" + protocol
+      if numbers[key] {
+        run.add(portPath+".port", "Service port %s is not unique in the "+
+          "Service.", key)
+      }
+      numbers[key] = true
+    }
+
+    // Kubernetes tells the ports of a Service apart by their names.
+    if port.Name == nil {
+      if len(ports) > 1 {
+        run.add(portPath+".name", "Port name missing, it is required when "+
+          "the Service has more than one port.")
+      }
+    } else if !isValidServicePortName(*port.Name) {
+      run.add(portPath+".name", "Invalid port name %s, expected at most %d "+
+        "lowercase letters, digits and dashes.", *port.Name,
+        kMaxServicePortNameLength)
+    } else if names[*port.Name] {
+      run.add(portPath+".name", "Port name %s is not unique in the Service.",
+        *port.Name)
+    } else {
+      names[*port.Name] = true
+    }
+
+    if target := port.TargetPort; target != nil {
+      if target.IntVal != nil && !isValidPort(*target.IntVal) {
+        run.add(portPath+".targetPort", "Target port %d out of range %d-%d.",
+          *target.IntVal, kMinPort, kMaxPort)
+      } else if target.StrVal != nil && !isValidPortName(*target.StrVal) {
+        run.add(portPath+".targetPort", "Invalid target port name %s, "+
+          "expected the name of a container port.", *target.StrVal)
+      }
+    }
+  }
+}
+
+// Validates that the ports of a ClusterIP Service carry no Cohesity tag or
+// env, which are about node ports.
+func (run *validationRun) validateClusterIpPorts(ports []*Ports) {
+  for i, port := range ports {
+    if port == nil {
+      continue
+    }
+    portPath := fieldpath.Index("spec.ports", i)
+    if port.IsUi() {
+      run.add(portPath+"."+kCohesityTagKeyWord, "The %s tag is only "+
+        "supported on a Service of type %s, the UI is opened through its "+
+        "node port.", kCohesityUiNodePortTag, kServiceTypeNodePort)
+    } else if port.CohesityTag != nil {
+      run.add(portPath+"."+kCohesityTagKeyWord, "Invalid port tag %s, tags "+
+        "are only supported on a Service of type %s.", *port.CohesityTag,
+        kServiceTypeNodePort)
+    }
+    if port.CohesityEnv != nil {
+      run.add(portPath+"."+kCohesityEnvKeyWord, "CohesityEnv is only "+
+        "supported on a Service of type %s, a %s Service has no node port.",
+        kServiceTypeNodePort, kServiceTypeClusterIp)
+    }
+  }
+}
+
+// Returns true if any of the containers declares a port.
+func declaresPorts(containers []*ContainerSpec) bool {
+  for _, container := range containers {
+    if container != nil && len(container.Ports) > 0 {
+      return true
+    }
+  }
+  return false
+}
+
+// Returns true if any of the containers declares port, by name or number.
+func containersHavePort(containers []*ContainerSpec,
+  port *IntOrString) bool {
+  for _, container := range containers {
+    if container != nil && containerHasPort(container, port) {
+      return true
+    }
+  }
+  return false
+}
+
+// Validates that the port each port of a Service targets is declared by the
+// containers of every workload the Service selects. A target named after a
+// container port which no container declares can not be resolved, so it is an
+// error. Containers may listen on ports they do not declare, so a target
+// number is only checked against workloads which declare ports, and a
+// mismatch is a warning.
+func (run *validationRun) validateServiceTargets(document *Document,
+  workloads []*Document) {
+  spec := document.AppSpec.Spec
+  if spec == nil || spec.Selector == nil || spec.Selector.IsEmpty() {
+    return
+  }
+  var selected []*Document
+  for _, workload := range workloads {
+    if spec.Selector.Matches(templateLabels(workload)) {
+      selected = append(selected, workload)
+    }
+  }
+
+  for i, port := range spec.Ports {
+    if port == nil {
+      continue
+    }
+    targetPath := fieldpath.Index("spec.ports", i) + ".targetPort"
+    target := port.TargetPort
+    if target == nil {
+      if port.Port == nil {
+        continue
+      }
+      target = &IntOrString{IntVal: port.Port}
+      targetPath = fieldpath.Index("spec.ports", i) + ".port"
+    }
+    if target.IntVal != nil && !isValidPort(*target.IntVal) {
+      continue
+    }
+    for _, workload := range selected {
+      containers := workload.Containers()
+      if containersHavePort(containers, target) {
+        continue
+      }
+      if target.StrVal != nil {
+        run.add(targetPath, "Target port %s is not the name of a container "+
+          "port of %s %s.", target, workload.Kind(), workload.Name())
+      } else if declaresPorts(containers) {
+        run.warn(targetPath, "Target port %s is not declared in the ports of "+
+          "the containers of %s %s.", target, workload.Kind(),
+          workload.Name())
+      }
+    }
+  }
+}
@@ -0,0 +1,210 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file implements the strict mode of the validator, which rejects the
+// keys of an appspec that are not part of the AppSpec model. Without it, the
+// YAML decoder silently drops such keys, so a typo like "volumMounts" leaves
+// the container without its mounts.
+
+package appspecvalidator
+
+import (
+  "fmt"
+  "reflect"
+  "sort"
+  "strings"
+
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/field_path"
+  "gopkg.in/yaml.v3"
+)
+
+var (
+  // Types which decode themselves from YAML, their keys are not checked.
+  yamlUnmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+  selectorType        = reflect.TypeOf(Selector{})
+)
+
+// yamlFields describes the keys a struct type accepts in YAML.
+type yamlFields struct {
+  // Maps each key to the type of its value.
+  types map[string]reflect.Type
+  // True if the struct has an inline map, which accepts any other key.
+  anyKey bool
+}
+
+// Returns the keys accepted by the struct type structType, following the yaml
+// tags of its fields the way the YAML decoder does.
+func structYamlFields(structType reflect.Type) *yamlFields {
+  fields := &yamlFields{types: make(map[string]reflect.Type)}
+  for i := 0; i < structType.NumField(); i++ {
+    field := structType.Field(i)
+    if field.PkgPath != "" {
+      // Unexported fields are never decoded.
+      continue
+    }
+    tag := field.Tag.Get("yaml")
+    if tag == "-" {
+      continue
+    }
+    tagParts := strings.Split(tag, ",")
+    name := tagParts[0]
+    inline := false
+    for _, flag := range tagParts[1:] {
+      if flag == "inline" {
+        inline = true
+      }
+    }
+    if inline {
+      fieldType := derefType(field.Type)
+      if fieldType.Kind() == reflect.Map {
+        fields.anyKey = true
+      } else if fieldType.Kind() == reflect.Struct {
+        inlineFields := structYamlFields(fieldType)
+        for key, keyType := range inlineFields.types {
+          fields.types[key] = keyType
+        }
+        fields.anyKey = fields.anyKey || inlineFields.anyKey
+      }
+      continue
+    }
+    if name == "" {
+      name = strings.ToLower(field.Name)
+    }
+    fields.types[name] = field.Type
+  }
+  return fields
+}
+
+// Returns the type pointed to by valueType, following any number of pointers.
+func derefType(valueType reflect.Type) reflect.Type {
+  for valueType.Kind() == reflect.Ptr {
+    valueType = valueType.Elem()
+  }
+  return valueType
+}
+
+// Returns the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+  previous := make([]int, len(b)+1)
+  current := make([]int, len(b)+1)
+  for j := range previous {
+    previous[j] = j
+  }
+  for i := 1; i <= len(a); i++ {
+    current[0] = i
+    for j := 1; j <= len(b); j++ {
+      cost := 1
+      if a[i-1] == b[j-1] {
+        cost = 0
+      }
+      current[j] = previous[j-1] + cost
+      if previous[j]+1 < current[j] {
+        current[j] = previous[j] + 1
+      }
+      if current[j-1]+1 < current[j] {
+        current[j] = current[j-1] + 1
+      }
+    }
+    previous, current = current, previous
+  }
+  return previous[len(b)]
+}
+
+// SuggestField returns the candidate closest to key by edit distance, or ""
+// if none is close enough to be a likely typo. Case differences count as a
+// single edit.
+func SuggestField(key string, candidates []string) string {
+  suggestion := ""
+  bestDistance := 0
+  for _, candidate := range candidates {
+    distance := editDistance(strings.ToLower(key), strings.ToLower(candidate))
+    if distance == 0 && key != candidate {
+      distance = 1
+    }
+    if suggestion == "" || distance < bestDistance ||
+      distance == bestDistance && candidate < suggestion {
+      suggestion = candidate
+      bestDistance = distance
+    }
+  }
+  // Allow about one typo in every three characters, but at least two.
+  maxDistance := len(key) / 3
+  if maxDistance < 2 {
+    maxDistance = 2
+  }
+  if suggestion == "" || bestDistance > maxDistance {
+    return ""
+  }
+  return suggestion
+}
+
+// Returns true if the struct type structType, with the keys fields, accepts
+// any other key in the object being validated. The keys of an inline map, like
+// labels, are free-form. A Selector holds the labels it selects inline only in
+// a Service, the selector of a workload has just its fixed keys.
+func (run *validationRun) acceptsAnyKey(structType reflect.Type,
+  fields *yamlFields) bool {
+  if structType == selectorType {
+    return run.kind == "Service"
+  }
+  return fields.anyKey
+}
+
+// Reports the keys of node, found at path, which the type valueType does not
+// accept.
+func (run *validationRun) validateKnownFields(node *yaml.Node,
+  valueType reflect.Type, path string) {
+  if reflect.PtrTo(derefType(valueType)).Implements(yamlUnmarshalerType) {
+    return
+  }
+  valueType = derefType(valueType)
+  switch valueType.Kind() {
+  case reflect.Slice:
+    if node.Kind != yaml.SequenceNode {
+      return
+    }
+    for i, child := range node.Content {
+      run.validateKnownFields(child, valueType.Elem(), fieldpath.Index(path, i))
+    }
+  case reflect.Map:
+    if node.Kind != yaml.MappingNode {
+      return
+    }
+    for i := 0; i+1 < len(node.Content); i += 2 {
+      run.validateKnownFields(node.Content[i+1], valueType.Elem(),
+        fieldpath.Join(path, node.Content[i].Value))
+    }
+  case reflect.Struct:
+    if node.Kind != yaml.MappingNode {
+      return
+    }
+    fields := structYamlFields(valueType)
+    keys := make([]string, 0, len(fields.types))
+    for key := range fields.types {
+      keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for i := 0; i+1 < len(node.Content); i += 2 {
+      keyNode := node.Content[i]
+      key := keyNode.Value
+      keyPath := fieldpath.Join(path, key)
+      fieldType, ok := fields.types[key]
+      if ok {
+        run.validateKnownFields(node.Content[i+1], fieldType, keyPath)
+        continue
+      }
+      if run.acceptsAnyKey(valueType, fields) {
+        continue
+      }
+      message := fmt.Sprintf("Unknown field %s.", key)
+      if suggestion := SuggestField(key, keys); suggestion != "" {
+        message = fmt.Sprintf("Unknown field %s, did you mean %s?", key,
+          suggestion)
+      }
+      // The finding points at the key, since a mapping or list value starts
+      // on the lines below it.
+      finding := run.addFinding(SeverityError, keyPath, "%s", message)
+      finding.Line = keyNode.Line
+      finding.Column = keyNode.Column
+    }
+  }
+}
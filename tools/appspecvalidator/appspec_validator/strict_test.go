@@ -0,0 +1,87 @@
+// Copyright 2019 Cohesity Inc.
+//
+// This file tests the strict mode of the validator.
+
+package appspecvalidator
+
+import (
+  "strings"
+  "testing"
+)
+
+// Returns the findings of a strict validation of appSpec which are about
+// unknown fields.
+func unknownFieldFindings(t *testing.T, appSpec string) Findings {
+  validator := &Validator{Strict: true}
+  findings, err := validator.Validate(strings.NewReader(appSpec))
+  if err != nil {
+    t.Fatal(err)
+  }
+  var unknownFields Findings
+  for _, finding := range findings {
+    if strings.HasPrefix(finding.Message, "Unknown field") {
+      unknownFields = append(unknownFields, finding)
+    }
+  }
+  return unknownFields
+}
+
+func TestStrictWorkloadSelector(t *testing.T) {
+  findings := unknownFieldFindings(t, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: web
+    tier: frontend
+spec:
+  replicas: 1
+  selector:
+    matchLabel:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: web:1.0
+`)
+  if len(findings) != 1 {
+    t.Fatalf("Expected 1 unknown field, got %v", findings)
+  }
+  finding := findings[0]
+  if finding.Field != "spec.selector.matchLabel" {
+    t.Errorf("Unknown field reported at %s", finding.Field)
+  }
+  if !strings.Contains(finding.Message, "did you mean matchLabels?") {
+    t.Errorf("Unexpected message %q", finding.Message)
+  }
+  if finding.Line != 11 || finding.Column != 5 {
+    t.Errorf("Unknown field reported at %d:%d, expected 11:5", finding.Line,
+      finding.Column)
+  }
+}
+
+func TestStrictServiceSelector(t *testing.T) {
+  // A Service lists the labels it selects directly under its selector, so
+  // any key is a label.
+  findings := unknownFieldFindings(t, `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+spec:
+  type: NodePort
+  selector:
+    app: web
+    matchLabel: web
+  ports:
+  - port: 80
+`)
+  if len(findings) != 0 {
+    t.Errorf("Expected no unknown fields, got %v", findings)
+  }
+}
@@ -3,23 +3,406 @@
 // Utility to parse and validate developer's appspec.
 // Build the appspecvalidator_exec binary and pass the absolute appspec path
 // as commandline  argument. Eg. ./appspecvalidator_exec appspecpath
+// The app.json of the app can be passed as a second argument to validate it
+// along with the appspec. Eg. ./appspecvalidator_exec appspecpath appjsonpath
+// The JSON Schema of appspecs is printed with
+// ./appspecvalidator_exec --schema
+// Mistakes with a single correct fix are fixed in place with --fix, or shown
+// as a diff with --diff. Eg. ./appspecvalidator_exec --fix appspecpath
+// The replicas of the workloads on a cluster, and the resources they request,
+// are printed with --nodes. Eg. ./appspecvalidator_exec --nodes 3 appspecpath
+// The total requests are checked against a budget with --budget_file, or
+// --budget_cpu and --budget_memory.
+// The images run by the containers are checked against the image tarballs
+// shipped with the app with --images. Eg.
+// ./appspecvalidator_exec --images packagedir appspecpath
+// The lint rules are run with the .appspeclint.yaml found next to the appspec
+// or in its parent directories, or the lint config given with --lint_config.
+// They are listed with --list_rules.
+// The lifecycle of the app, i.e. when its objects are created and its Jobs,
+// including the cleanup Job, run, is printed with --lifecycle.
+//
+// The exit code is 0 if the appspec is valid, 1 if it is invalid and 2 if the
+// arguments are wrong or the appspec could not be read.
 
 package main
 
 import (
+  "flag"
   "fmt"
-   "os"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
 
+  "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/app_metadata"
   "github.com/cohesity/cohesity-appspec/tools/appspecvalidator/appspec_validator"
 )
 
+const (
+  kExitValid   int = 0
+  kExitInvalid int = 1
+  kExitError   int = 2
+
+  kFormatText  string = "text"
+  kFormatJson  string = "json"
+  kFormatSarif string = "sarif"
+)
+
+var (
+  // FLAGS_format specifies the output format(text/json/sarif).
+  FLAGS_format string
+
+  // FLAGS_maxCpu specifies the maximum cpu a container may request.
+  FLAGS_maxCpu string
+
+  // FLAGS_maxMemory specifies the maximum memory a container may request.
+  FLAGS_maxMemory string
+
+  // FLAGS_strict specifies whether unknown fields in the appspec are errors.
+  FLAGS_strict bool
+
+  // FLAGS_schema specifies whether to print the JSON Schema of appspecs
+  // instead of validating an appspec.
+  FLAGS_schema bool
+
+  // FLAGS_schemaCheck specifies whether to also validate the appspec against
+  // its JSON Schema.
+  FLAGS_schemaCheck bool
+
+  // FLAGS_fix specifies whether to fix the appspec in place before
+  // validating it.
+  FLAGS_fix bool
+
+  // FLAGS_diff specifies whether to print the fixes of the appspec as a
+  // unified diff.
+  FLAGS_diff bool
+
+  // FLAGS_nodes specifies the number of nodes of the cluster to report the
+  // replicas of the workloads for. 0 means no report.
+  FLAGS_nodes int
+
+  // FLAGS_budgetFile specifies the file of the budget the requests of the
+  // workloads must fit in.
+  FLAGS_budgetFile string
+
+  // FLAGS_budgetCpu specifies the cpu budget, overriding the budget file.
+  FLAGS_budgetCpu string
+
+  // FLAGS_budgetMemory specifies the memory budget, overriding the budget
+  // file.
+  FLAGS_budgetMemory string
+
+  // FLAGS_budgetSeverity specifies whether exceeding the budget is an error
+  // or a warning, overriding the budget file.
+  FLAGS_budgetSeverity string
+
+  // FLAGS_images specifies the comma separated image tarballs, or
+  // directories holding them, shipped with the app.
+  FLAGS_images string
+
+  // FLAGS_lint specifies whether to run the lint rules.
+  FLAGS_lint bool
+
+  // FLAGS_lintConfig specifies the lint config file. If empty, it is looked
+  // up next to the appspec and in its parent directories.
+  FLAGS_lintConfig string
+
+  // FLAGS_listRules specifies whether to list the lint rules instead of
+  // validating an appspec.
+  FLAGS_listRules bool
+
+  // FLAGS_lifecycle specifies whether to print when the objects of the app
+  // are created and its Jobs run.
+  FLAGS_lifecycle bool
+)
+
+// Parses the quantity given for the flag name. An empty value means no
+// quantity.
+func parseQuantityFlag(name string, value string) *appspecvalidator.Quantity {
+  if value == "" {
+    return nil
+  }
+  quantity, err := appspecvalidator.ParseQuantity(value)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "Invalid --%s: %v\n", name, err)
+    usage()
+    os.Exit(kExitError)
+  }
+  return quantity
+}
+
+// Fixes the appspec at path. The fixes are printed as a diff with --diff, and
+// written back to the appspec with --fix.
+func fixAppSpec(path string) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(kExitError)
+  }
+  fixed, fixes, err := appspecvalidator.FixAppSpec(data, path)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(kExitError)
+  }
+  if FLAGS_diff {
+    fmt.Print(appspecvalidator.UnifiedDiff(path, path, string(data),
+      string(fixed)))
+  }
+  if !FLAGS_fix || len(fixes) == 0 {
+    return
+  }
+
+  info, err := os.Stat(path)
+  if err == nil {
+    err = ioutil.WriteFile(path, fixed, info.Mode())
+  }
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(kExitError)
+  }
+  for _, fix := range fixes {
+    fmt.Fprintln(os.Stderr, "Fixed", fix)
+  }
+}
+
+// Returns the budget given by the budget flags, or nil if there is none. The
+// budget file is read first, then the other flags override its values.
+func budget() *appspecvalidator.Budget {
+  if FLAGS_budgetFile == "" && FLAGS_budgetCpu == "" &&
+    FLAGS_budgetMemory == "" {
+    return nil
+  }
+  budget := appspecvalidator.NewBudget()
+  if FLAGS_budgetFile != "" {
+    var err error
+    budget, err = appspecvalidator.LoadBudgetFile(FLAGS_budgetFile)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(kExitError)
+    }
+  }
+  if FLAGS_nodes > 0 {
+    budget.Nodes = FLAGS_nodes
+  }
+  if FLAGS_budgetCpu != "" {
+    budget.Cpu = parseQuantityFlag("budget_cpu", FLAGS_budgetCpu)
+  }
+  if FLAGS_budgetMemory != "" {
+    budget.Memory = parseQuantityFlag("budget_memory", FLAGS_budgetMemory)
+  }
+  switch appspecvalidator.Severity(FLAGS_budgetSeverity) {
+  case "":
+  case appspecvalidator.SeverityError, appspecvalidator.SeverityWarning:
+    budget.Severity = appspecvalidator.Severity(FLAGS_budgetSeverity)
+  default:
+    fmt.Fprintf(os.Stderr, "Invalid --budget_severity %s.\n",
+      FLAGS_budgetSeverity)
+    usage()
+    os.Exit(kExitError)
+  }
+  return budget
+}
+
+// Returns the lint config for the appspec at path, or nil if the lint rules
+// are not run.
+func lintConfig(path string) *appspecvalidator.LintConfig {
+  if !FLAGS_lint {
+    return nil
+  }
+  configPath := FLAGS_lintConfig
+  if configPath == "" {
+    configPath = appspecvalidator.FindLintConfig(filepath.Dir(path))
+  }
+  if configPath == "" {
+    return nil
+  }
+  config, err := appspecvalidator.LoadLintConfigFile(configPath)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(kExitError)
+  }
+  return config
+}
+
+// Prints the registered lint rules, whether they are enabled by default and
+// what they check.
+func listRules() {
+  config := appspecvalidator.DefaultLintConfig()
+  for _, rule := range appspecvalidator.Rules() {
+    state := "disabled"
+    if config.Rules[rule.Id()].Enabled {
+      state = "enabled"
+    }
+    fmt.Printf("%-16s %-8s %s\n", rule.Id(), state, rule.Description())
+  }
+}
+
+func usage() {
+  fmt.Fprintf(flag.CommandLine.Output(),
+    "Usage: %s [flags] appspecpath [appjsonpath]\n", os.Args[0])
+  flag.PrintDefaults()
+}
+
 func main() {
+  flag.StringVar(&FLAGS_format, "format", kFormatText,
+    "Output format: text, json or sarif.")
+  flag.StringVar(&FLAGS_maxCpu, "max_cpu", "",
+    "Maximum cpu a container may request, e.g. 4 or 500m.")
+  flag.StringVar(&FLAGS_maxMemory, "max_memory", "",
+    "Maximum memory a container may request, e.g. 8Gi.")
+  flag.BoolVar(&FLAGS_strict, "strict", false,
+    "Report fields which are not part of the appspec format.")
+  flag.BoolVar(&FLAGS_schema, "schema", false,
+    "Print the JSON Schema of appspec objects and exit.")
+  flag.BoolVar(&FLAGS_schemaCheck, "schema_check", false,
+    "Also validate the appspec against its JSON Schema.")
+  flag.BoolVar(&FLAGS_fix, "fix", false,
+    "Fix the mistakes of the appspec which have a single correct fix, in "+
+      "place, then validate it.")
+  flag.BoolVar(&FLAGS_diff, "diff", false,
+    "Print the fixes of the appspec as a unified diff. Without --fix, the "+
+      "appspec is left unchanged and not validated.")
+  flag.IntVar(&FLAGS_nodes, "nodes", 0,
+    "If set, print the replicas of each workload on a cluster of this many "+
+      "nodes and the cpu and memory they request.")
+  flag.StringVar(&FLAGS_budgetFile, "budget_file", "",
+    "YAML file of the budget the requests of all the workloads must fit in, "+
+      "with the keys nodes, cpu, memory and severity.")
+  flag.StringVar(&FLAGS_budgetCpu, "budget_cpu", "",
+    "Most cpu all the workloads may request together, e.g. 8.")
+  flag.StringVar(&FLAGS_budgetMemory, "budget_memory", "",
+    "Most memory all the workloads may request together, e.g. 16Gi.")
+  flag.StringVar(&FLAGS_budgetSeverity, "budget_severity", "",
+    "Severity of exceeding the budget: error (default) or warning.")
+  flag.StringVar(&FLAGS_images, "images", "",
+    "Comma separated docker save tarballs shipped with the app, or "+
+      "directories holding them. Every container image must be one of them.")
+  flag.BoolVar(&FLAGS_lint, "lint", true,
+    "Run the lint rules of the lint config, if there is one.")
+  flag.StringVar(&FLAGS_lintConfig, "lint_config", "",
+    "Lint config file. By default, the "+
+      appspecvalidator.LintConfigFileName+" next to the appspec or in its "+
+      "parent directories.")
+  flag.BoolVar(&FLAGS_listRules, "list_rules", false,
+    "List the lint rules and exit.")
+  flag.BoolVar(&FLAGS_lifecycle, "lifecycle", false,
+    "Print when the objects of the app are created and its Jobs, including "+
+      "the cleanup Job, run.")
+  flag.Usage = usage
+  flag.Parse()
+
+  if FLAGS_schema {
+    if err := appspecvalidator.WriteSchema(os.Stdout); err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(kExitError)
+    }
+    os.Exit(kExitValid)
+  }
+  if FLAGS_listRules {
+    listRules()
+    os.Exit(kExitValid)
+  }
+
+  if flag.NArg() < 1 || flag.NArg() > 2 {
+    usage()
+    os.Exit(kExitError)
+  }
+  if FLAGS_format != kFormatText && FLAGS_format != kFormatJson &&
+    FLAGS_format != kFormatSarif {
+    fmt.Fprintf(os.Stderr, "Unknown format %s.\n", FLAGS_format)
+    usage()
+    os.Exit(kExitError)
+  }
+  if FLAGS_nodes < 0 {
+    fmt.Fprintf(os.Stderr, "Invalid --nodes %d.\n", FLAGS_nodes)
+    usage()
+    os.Exit(kExitError)
+  }
+
   // Path of the app spec.
-  appSpecPath := os.Args[1]
-  err := appspecvalidator.ParseAndValidateAppSpec(appSpecPath)
+  appSpecPath := flag.Arg(0)
+  if FLAGS_fix || FLAGS_diff {
+    fixAppSpec(appSpecPath)
+    if !FLAGS_fix {
+      os.Exit(kExitValid)
+    }
+  }
+  validator := appspecvalidator.NewValidator()
+  validator.MaxCpu = parseQuantityFlag("max_cpu", FLAGS_maxCpu)
+  validator.MaxMemory = parseQuantityFlag("max_memory", FLAGS_maxMemory)
+  validator.Strict = FLAGS_strict
+  validator.SchemaCheck = FLAGS_schemaCheck
+  validator.Budget = budget()
+  validator.Lint = lintConfig(appSpecPath)
+  if FLAGS_images != "" {
+    var err error
+    validator.Images, err = appspecvalidator.LoadImages(
+      strings.Split(FLAGS_images, ","))
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(kExitError)
+    }
+  }
+  documents, findings, err := validator.ParseAndValidateFile(appSpecPath)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(kExitError)
+  }
+
+  // Path of the app metadata, if given.
+  if flag.NArg() == 2 {
+    _, metadataFindings, err := appmetadata.ValidateFile(flag.Arg(1),
+      documents)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(kExitError)
+    }
+    findings = append(findings, metadataFindings...)
+  }
+
+  switch FLAGS_format {
+  case kFormatJson:
+    err = findings.WriteJSON(os.Stdout, appSpecPath)
+  case kFormatSarif:
+    err = findings.WriteSARIF(os.Stdout, appSpecPath)
+  default:
+    err = findings.WriteText(os.Stdout)
+  }
   if err != nil {
-    fmt.Println(err)
-  } else {
-    fmt.Println("Valid App Spec.")
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(kExitError)
+  }
+
+  // Keep stdout parseable when the findings are written as JSON or SARIF.
+  reportWriter := os.Stdout
+  if FLAGS_format != kFormatText {
+    reportWriter = os.Stderr
+  }
+  if FLAGS_nodes > 0 || validator.Budget != nil {
+    nodes := FLAGS_nodes
+    if validator.Budget != nil {
+      nodes = validator.Budget.Nodes
+    }
+    counts := appspecvalidator.ReplicaCounts(documents, nodes)
+    err = appspecvalidator.WriteReplicaReport(reportWriter, counts, nodes,
+      validator.Budget)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(kExitError)
+    }
+  }
+  if FLAGS_lifecycle {
+    err = appspecvalidator.WriteLifecycleReport(reportWriter,
+      appspecvalidator.AppLifecycle(documents))
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(kExitError)
+    }
+  }
+
+  if findings.HasErrors() {
+    os.Exit(kExitInvalid)
   }
+  os.Exit(kExitValid)
 }
@@ -0,0 +1,35 @@
+// Copyright 2019 Cohesity Inc.
+//
+// Package fieldpath builds and splits the paths of fields reported in
+// findings, like "spec.template.spec.containers[0].image". The findings about
+// an appspec and about its app.json share this format.
+
+package fieldpath
+
+import (
+  "fmt"
+  "strings"
+)
+
+// Join returns the path of the field key of the object at path.
+func Join(path string, key string) string {
+  if path == "" {
+    return key
+  }
+  return path + "." + key
+}
+
+// Index returns the path of the element at index within the list at path.
+func Index(path string, index int) string {
+  return fmt.Sprintf("%s[%d]", path, index)
+}
+
+// Parent returns the path of the object or list holding the field at path,
+// or "" for a top level field.
+func Parent(path string) string {
+  pos := strings.LastIndexAny(path, ".[")
+  if pos == -1 {
+    return ""
+  }
+  return path[:pos]
+}